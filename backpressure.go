@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/valyala/fasthttp"
+)
+
+const DefaultRetryAfter = 5 * time.Second
+
+// BackpressureConfig bounds how much work Telepath takes on while Kafka
+// is slow. Each limit is disabled when zero.
+type BackpressureConfig struct {
+	// MaxQueueDepth is the most messages handed to the producer and not
+	// yet acknowledged.
+	MaxQueueDepth int64 `yaml:"max_queue_depth"`
+
+	// MaxInflightBytes is the most request body bytes being handled at
+	// once.
+	MaxInflightBytes int64 `yaml:"max_inflight_bytes"`
+
+	// MaxStall is how long the producer may go without taking a message
+	// while writes wait on it.
+	MaxStall time.Duration `yaml:"max_stall"`
+
+	// RetryAfter is sent to rejected clients.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+// validateBackpressure reports problems with the backpressure settings.
+func (c *TelepathConfig) validateBackpressure(fail func(string, ...interface{})) {
+	b := c.Backpressure
+	if b.MaxQueueDepth < 0 {
+		fail("backpressure queue depth can't be negative")
+	}
+	if b.MaxInflightBytes < 0 {
+		fail("backpressure in-flight bytes can't be negative")
+	}
+	if b.MaxStall < 0 {
+		fail("backpressure stall can't be negative")
+	}
+	if b.RetryAfter < time.Second {
+		fail("backpressure retry after must be at least 1s")
+	}
+}
+
+// producerQueue hands messages to the producer, spooling them if there is
+// a spool and the producer is too slow, and keeps track of how backed up
+// the producer is. Messages are handed over with the read lock held, so
+// that none are once Close returns.
+type producerQueue struct {
+	sync.RWMutex
+	input       chan<- *sarama.ProducerMessage
+	spool       *spool
+	deadLetters *deadLetters
+
+	// depth counts the messages handed over and not yet acknowledged.
+	// waiting counts the writes blocked on the producer, and progress is
+	// when it last took a message, in Unix nanoseconds.
+	depth    int64
+	waiting  int64
+	progress int64
+
+	// Once closed, messages are no longer handed to the producer, and
+	// done stops those waiting on it. lost counts the messages which were
+	// neither handed over nor spooled.
+	closed bool
+	done   chan struct{}
+	lost   int64
+}
+
+func newProducerQueue(input chan<- *sarama.ProducerMessage, spool *spool) *producerQueue {
+	return &producerQueue{
+		input:    input,
+		spool:    spool,
+		done:     make(chan struct{}),
+		progress: time.Now().UnixNano(),
+	}
+}
+
+// Produce hands a message to the producer, waiting for it if need be.
+func (q *producerQueue) Produce(msg *sarama.ProducerMessage) {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.closed {
+		q.refuse(msg)
+		return
+	}
+
+	metrics.BackpressureQueueDepth().Set(float64(atomic.AddInt64(&q.depth, 1)))
+
+	select {
+	case q.input <- msg:
+		atomic.StoreInt64(&q.progress, time.Now().UnixNano())
+		return
+	default:
+	}
+
+	atomic.AddInt64(&q.waiting, 1)
+	taken, spooled := q.spool.Produce(q.input, q.done, msg)
+	atomic.AddInt64(&q.waiting, -1)
+
+	if taken {
+		atomic.StoreInt64(&q.progress, time.Now().UnixNano())
+		return
+	}
+
+	metrics.BackpressureQueueDepth().Set(float64(atomic.AddInt64(&q.depth, -1)))
+	switch {
+	case spooled:
+		acknowledge(msg, &sarama.ProducerError{Msg: msg, Err: errSpooled})
+	case q.closing():
+		q.refuse(msg)
+	default:
+		q.lose(msg, errNotSpooled)
+	}
+}
+
+// closing reports whether Close has been called.
+func (q *producerQueue) closing() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuse spools a message produced once the queue was closed, if there
+// is a spool, and fails it otherwise.
+func (q *producerQueue) refuse(msg *sarama.ProducerMessage) {
+	if q.spool != nil && q.spool.Spool(msg, spoolReasonShutdown) {
+		acknowledge(msg, &sarama.ProducerError{Msg: msg, Err: errSpooled})
+		return
+	}
+
+	q.lose(msg, sarama.ErrShuttingDown)
+}
+
+// lose fails a message which was neither handed to the producer nor
+// spooled, dead-letters it, and counts it.
+func (q *producerQueue) lose(msg *sarama.ProducerMessage, err error) {
+	atomic.AddInt64(&q.lost, 1)
+
+	perr := &sarama.ProducerError{Msg: msg, Err: err}
+	acknowledge(msg, perr)
+	q.deadLetters.Failed(perr)
+}
+
+// Close stops handing messages to the producer, so that it can be closed.
+// Messages still waiting on the producer are refused, and Close returns
+// once they have given up.
+func (q *producerQueue) Close() {
+	close(q.done)
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+}
+
+// Lost returns how many messages were neither handed to the producer
+// nor spooled.
+func (q *producerQueue) Lost() int64 {
+	return atomic.LoadInt64(&q.lost)
+}
+
+// Rescue spools a message the producer gave up on, if it can.
+func (q *producerQueue) Rescue(err *sarama.ProducerError) bool {
+	if q == nil {
+		return false
+	}
+	return q.spool.Rescue(err)
+}
+
+// Acknowledged records that Kafka accepted or refused a message.
+func (q *producerQueue) Acknowledged(msg *sarama.ProducerMessage) {
+	if q == nil {
+		return
+	}
+	if bypassedQueue(msg) {
+		return
+	}
+
+	metrics.BackpressureQueueDepth().Set(float64(atomic.AddInt64(&q.depth, -1)))
+}
+
+// Depth returns how many messages are waiting on Kafka.
+func (q *producerQueue) Depth() int64 {
+	return atomic.LoadInt64(&q.depth)
+}
+
+// Stall returns how long writes have been waiting on the producer, since
+// it last took a message.
+func (q *producerQueue) Stall() time.Duration {
+	if atomic.LoadInt64(&q.waiting) == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&q.progress)))
+}
+
+// admission turns writes away while the producer is backed up, so that
+// clients back off rather than pile up.
+type admission struct {
+	BackpressureConfig
+	queue    *producerQueue
+	inflight int64
+}
+
+// Admit reserves room for a request body of the given size, returning a
+// rejection if there isn't any. Admitted requests must be released.
+func (a *admission) Admit(size int64) *rejection {
+	stall := a.queue.Stall()
+	metrics.BackpressureStall().Set(stall.Seconds())
+
+	if a.MaxQueueDepth > 0 && a.queue.Depth() >= a.MaxQueueDepth {
+		return a.reject(http.StatusServiceUnavailable, reasonQueueFull,
+			fmt.Sprintf("too many messages waiting on Kafka; retry after %v", a.RetryAfter))
+	}
+	if a.MaxStall > 0 && stall >= a.MaxStall {
+		return a.reject(http.StatusServiceUnavailable, reasonProducerStalled,
+			fmt.Sprintf("Kafka hasn't taken a line for %v; retry after %v", stall/time.Millisecond*time.Millisecond, a.RetryAfter))
+	}
+
+	// A request larger than the limit is let through when it's the only
+	// one, or it could never be written.
+	inflight := atomic.AddInt64(&a.inflight, size)
+	if a.MaxInflightBytes > 0 && inflight > a.MaxInflightBytes && inflight != size {
+		atomic.AddInt64(&a.inflight, -size)
+		return a.reject(http.StatusTooManyRequests, reasonInflightBytes,
+			fmt.Sprintf("too many bytes being written; retry after %v", a.RetryAfter))
+	}
+	metrics.BackpressureInflightBytes().Set(float64(inflight))
+
+	return nil
+}
+
+// Release returns the room reserved for an admitted request.
+func (a *admission) Release(size int64) {
+	metrics.BackpressureInflightBytes().Set(float64(atomic.AddInt64(&a.inflight, -size)))
+}
+
+func (a *admission) reject(status int, reason, message string) *rejection {
+	metrics.BackpressureRejectionCount(reason).Inc()
+	return &rejection{status, reason, message, a.RetryAfter}
+}
+
+// rejection is why a write was turned away, and when to try again.
+type rejection struct {
+	status     int
+	reason     string
+	message    string
+	retryAfter time.Duration
+}
+
+// setRetryAfter tells the client how many seconds to wait before trying
+// again, rounded up.
+func setRetryAfter(ctx *fasthttp.RequestCtx, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	ctx.Response.Header.Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_admission_queue_depth(t *testing.T) {
+	q := newProducerQueue(make(chan *sarama.ProducerMessage, 10), nil)
+	a := &admission{BackpressureConfig: BackpressureConfig{MaxQueueDepth: 2, RetryAfter: time.Second}, queue: q}
+
+	msg := &sarama.ProducerMessage{Topic: "metrics"}
+	q.Produce(msg)
+	assert.Nil(t, a.Admit(10))
+	a.Release(10)
+
+	q.Produce(msg)
+	rejected := a.Admit(10)
+	require.NotNil(t, rejected)
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.status)
+	assert.Equal(t, reasonQueueFull, rejected.reason)
+	assert.Equal(t, time.Second, rejected.retryAfter)
+
+	q.Acknowledged(msg)
+	assert.Nil(t, a.Admit(10))
+
+	// Replayed messages aren't counted.
+	q.Acknowledged(&sarama.ProducerMessage{Metadata: &replayMetadata{}})
+	assert.Equal(t, int64(1), q.Depth())
+}
+
+func Test_producer_queue_close(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	q := newProducerQueue(input, nil)
+	q.Close()
+
+	// Once closed, messages are refused rather than sent to the producer.
+	tracker := newDeliveryTracker()
+	tracker.Add()
+	q.Produce(&sarama.ProducerMessage{Topic: "metrics", Metadata: tracker})
+	tracker.Seal()
+
+	_, failed, _, err := tracker.Result()
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, sarama.ErrShuttingDown, err)
+	assert.Len(t, input, 0)
+	assert.Equal(t, int64(1), q.Lost())
+	assert.Equal(t, int64(0), q.Depth())
+
+	// Or spooled, if there's a spool.
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	spool, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 1000})
+	require.NoError(t, err)
+	defer spool.Close()
+
+	q = newProducerQueue(input, spool)
+	q.Close()
+	q.Produce(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("foo value=1 1")})
+	assert.Len(t, input, 0)
+	assert.Equal(t, int64(0), q.Lost())
+	assert.Len(t, spoolSegments(t, dir), 1)
+}
+
+func Test_producer_queue_close_stops_waiting(t *testing.T) {
+	// Nothing reads the input, as when the producer is stuck.
+	input := make(chan *sarama.ProducerMessage)
+	q := newProducerQueue(input, nil)
+
+	tracker := newDeliveryTracker()
+	tracker.Add()
+	produced := make(chan struct{})
+	go func() {
+		q.Produce(&sarama.ProducerMessage{Topic: "metrics", Metadata: tracker})
+		close(produced)
+	}()
+	for atomic.LoadInt64(&q.waiting) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once closed, the producer's input can be closed too, as nothing is
+	// left waiting to send on it.
+	q.Close()
+	close(input)
+	<-produced
+	tracker.Seal()
+
+	_, failed, _, err := tracker.Result()
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, sarama.ErrShuttingDown, err)
+	assert.Equal(t, int64(1), q.Lost())
+	assert.Equal(t, int64(0), q.Depth())
+}
+
+func Test_producer_queue_spools_past_deadline(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	spool, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 1000, Deadline: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer spool.Close()
+
+	// Nothing reads the input, as when the producer is stuck.
+	dead := make(chan *sarama.ProducerMessage, 10)
+	q := newProducerQueue(make(chan *sarama.ProducerMessage), spool)
+	q.deadLetters = newDeadLetters(DeadLetterConfig{Topic: "dead", Sample: 1}, dead)
+
+	produce := func(line string) error {
+		tracker := newDeliveryTracker()
+		tracker.Add()
+		q.Produce(&sarama.ProducerMessage{
+			Topic:    "metrics",
+			Value:    sarama.StringEncoder(line),
+			Metadata: &lineMetadata{tracker: tracker, origin: origin{db: "test"}},
+		})
+		tracker.Seal()
+
+		_, failed, _, err := tracker.Result()
+		assert.Equal(t, 1, failed)
+		return err
+	}
+
+	assert.Equal(t, errSpooled, produce("a value=1 1"))
+	assert.Len(t, spoolSegments(t, dir), 1)
+	assert.Equal(t, int64(0), q.Lost())
+	assert.Len(t, dead, 0)
+
+	// Once the spool is full, lines are failed, dead-lettered and counted
+	// as lost.
+	assert.Equal(t, errNotSpooled, produce("b value=2 2"+strings.Repeat(" ", 1000)))
+	assert.Equal(t, int64(1), q.Lost())
+	assert.Equal(t, int64(0), q.Depth())
+	require.Len(t, dead, 1)
+	assert.Equal(t, reasonDeliveryFailed, decodeDeadLetter(t, <-dead).Reason)
+}
+
+func Test_admission_producer_stall(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage)
+	q := newProducerQueue(input, nil)
+	a := &admission{BackpressureConfig: BackpressureConfig{MaxStall: 20 * time.Millisecond, RetryAfter: time.Second}, queue: q}
+
+	assert.Equal(t, time.Duration(0), q.Stall(), "nothing is waiting")
+
+	go q.Produce(&sarama.ProducerMessage{Topic: "metrics"})
+	for atomic.LoadInt64(&q.waiting) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	rejected := a.Admit(10)
+	require.NotNil(t, rejected)
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.status)
+	assert.Equal(t, reasonProducerStalled, rejected.reason)
+
+	<-input
+	for atomic.LoadInt64(&q.waiting) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, a.Admit(10))
+}
+
+func Test_admission_inflight_bytes(t *testing.T) {
+	q := newProducerQueue(make(chan *sarama.ProducerMessage), nil)
+	a := &admission{BackpressureConfig: BackpressureConfig{MaxInflightBytes: 100, RetryAfter: time.Second}, queue: q}
+
+	assert.Nil(t, a.Admit(80))
+	rejected := a.Admit(30)
+	require.NotNil(t, rejected)
+	assert.Equal(t, http.StatusTooManyRequests, rejected.status)
+	assert.Equal(t, reasonInflightBytes, rejected.reason)
+
+	a.Release(80)
+	assert.Nil(t, a.Admit(30))
+	a.Release(30)
+
+	assert.Nil(t, a.Admit(200), "a large request is let through on its own")
+	a.Release(200)
+	assert.Equal(t, int64(0), a.inflight)
+}
+
+func Test_write_handler_backpressure(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	q := newProducerQueue(p.Input(), nil)
+	q.depth = 1
+
+	for _, path := range []string{"/write?db=test", "/api/v2/write?bucket=test"} {
+		wh, err := NewWriteHandler(p, writeConfig{
+			queue:        q,
+			backpressure: BackpressureConfig{MaxQueueDepth: 1, RetryAfter: 1500 * time.Millisecond},
+		})
+		require.NoError(t, err)
+
+		handler := wh.Handle
+		if path != "/write?db=test" {
+			handler = wh.HandleV2
+		}
+		client, teardown := newClient(handler)
+
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foo" + path)
+		req.Header.SetMethod("POST")
+		req.SetBody([]byte("foo value=1 1\n"))
+		require.NoError(t, client.Do(&req, &resp))
+		teardown()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode(), path)
+		assert.Equal(t, "2", string(resp.Header.Peek("Retry-After")), path)
+		assert.Contains(t, string(resp.Body()), "too many messages waiting on Kafka; retry after 1.5s", path)
+	}
+}
+
+func Test_backpressure_config_validation(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-backpressure.queue.depth", "-1",
+		"-backpressure.inflight.bytes", "-1",
+		"-backpressure.stall", "-1s",
+		"-backpressure.retry.after", "500ms",
+	}, noEnv)
+	require.Error(t, err)
+	assert.Equal(t, "backpressure queue depth can't be negative; "+
+		"backpressure in-flight bytes can't be negative; "+
+		"backpressure stall can't be negative; "+
+		"backpressure retry after must be at least 1s", err.Error())
+}
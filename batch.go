@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const DefaultBatchLines = 1000
+
+// messageOverhead is an allowance for the framing Kafka adds to each
+// message, on top of its key and value.
+const messageOverhead = 64
+
+// batcher packs lines bound for the same topic and key into a single
+// newline-separated message. A batch is produced once it reaches its
+// line or byte limit, or has lingered long enough.
+//
+// Batches are detached under the lock, and handed to the queue, which may
+// keep them waiting on Kafka, after it's released. Those for the same
+// topic and key are handed over in turn, so they stay in order.
+type batcher struct {
+	sync.Mutex
+	maxLines int
+	maxBytes int
+	linger   time.Duration
+	batches  map[batchKey]*batch
+	sending  map[batchKey]chan struct{}
+	sequence uint64
+	queue    *producerQueue
+	doneCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+type batchKey struct {
+	topic string
+	key   string
+}
+
+type batch struct {
+	topic    string
+	key      sarama.Encoder
+	value    []byte
+	lines    int
+	trackers []*deliveryTracker
+	origins  []originRun
+	created  time.Time
+	sequence uint64
+
+	// The first line's record timestamp and headers
+	timestamp time.Time
+	headers   []sarama.RecordHeader
+
+	// Once detached, the batch is sent after the one before it for its
+	// topic and key, and closes sent when it has been.
+	bk    batchKey
+	after <-chan struct{}
+	sent  chan struct{}
+}
+
+// batchMetadata travels with a batched message, so that each line can be
+// acknowledged to the request it arrived in.
+type batchMetadata struct {
+	lines    int
+	trackers []*deliveryTracker
+	origins  []originRun
+}
+
+// originRun is where a run of consecutive lines in a batch came from.
+type originRun struct {
+	origin origin
+	lines  int
+}
+
+// newBatcher starts a batcher which produces to input. Batches are
+// capped at maxBytes, which is trimmed to fit within the producer's
+// maxMessageBytes. Without a linger interval, batches are only produced
+// when full or flushed.
+func newBatcher(input chan<- *sarama.ProducerMessage, maxLines, maxBytes, maxMessageBytes int, linger time.Duration) *batcher {
+	if maxLines < 1 {
+		maxLines = DefaultBatchLines
+	}
+	if maxBytes < 1 || maxBytes > maxMessageBytes-messageOverhead {
+		maxBytes = maxMessageBytes - messageOverhead
+	}
+
+	b := &batcher{
+		maxLines: maxLines,
+		maxBytes: maxBytes,
+		linger:   linger,
+		batches:  make(map[batchKey]*batch),
+		sending:  make(map[batchKey]chan struct{}),
+		queue:    newProducerQueue(input, nil),
+		doneCh:   make(chan struct{}),
+	}
+
+	if linger > 0 {
+		b.wg.Add(1)
+		go b.run()
+	}
+
+	return b
+}
+
+// Fits returns an error if the message's line is too long to be batched
+// even on its own, as Kafka would refuse the message.
+func (b *batcher) Fits(msg *sarama.ProducerMessage) error {
+	var key int
+	if msg.Key != nil {
+		key = msg.Key.Length()
+	}
+	if msg.Value.Length() > b.maxBytes-key {
+		return fmt.Errorf("line is longer than the %d bytes a batch may hold", b.maxBytes-key)
+	}
+	return nil
+}
+
+// Add appends the message's line to the batch for its topic and key.
+// Lines which don't fit in a batch are sent on their own.
+func (b *batcher) Add(msg *sarama.ProducerMessage, tracker *deliveryTracker, from origin) {
+	line, _ := msg.Value.Encode()
+
+	var key []byte
+	if msg.Key != nil {
+		key, _ = msg.Key.Encode()
+	}
+	limit := b.maxBytes - len(key)
+
+	var ready []*batch
+
+	b.Lock()
+	bk := batchKey{msg.Topic, string(key)}
+	current, ok := b.batches[bk]
+	if ok && len(current.value)+1+len(line) > limit {
+		ready = append(ready, b.detach(current))
+		ok = false
+	}
+	if !ok {
+		b.sequence++
+		current = &batch{
+			bk:        bk,
+			topic:     msg.Topic,
+			key:       msg.Key,
+			value:     make([]byte, 0, len(line)),
+			created:   time.Now(),
+			sequence:  b.sequence,
+			timestamp: msg.Timestamp,
+			headers:   msg.Headers,
+		}
+		b.batches[bk] = current
+	}
+
+	if current.lines > 0 {
+		current.value = append(current.value, '\n')
+	}
+	current.value = append(current.value, line...)
+	current.lines++
+	if tracker != nil {
+		current.trackers = append(current.trackers, tracker)
+	}
+	if n := len(current.origins); n > 0 && current.origins[n-1].origin == from {
+		current.origins[n-1].lines++
+	} else {
+		current.origins = append(current.origins, originRun{from, 1})
+	}
+
+	if current.lines >= b.maxLines || len(current.value) >= limit {
+		ready = append(ready, b.detach(current))
+	}
+	b.Unlock()
+
+	b.send(ready)
+}
+
+// Flush produces every pending batch, in the order they were started.
+func (b *batcher) Flush() {
+	b.Lock()
+	ready := make([]*batch, 0, len(b.batches))
+	for _, current := range b.batches {
+		ready = append(ready, current)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].sequence < ready[j].sequence
+	})
+	for _, current := range ready {
+		b.detach(current)
+	}
+	b.Unlock()
+
+	b.send(ready)
+}
+
+// Close stops the linger timer, and flushes the remaining batches.
+func (b *batcher) Close() {
+	close(b.doneCh)
+	b.wg.Wait()
+	b.Flush()
+}
+
+func (b *batcher) run() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.linger / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.doneCh:
+			return
+
+		case <-ticker.C:
+			var ready []*batch
+			b.Lock()
+			for _, current := range b.batches {
+				if time.Since(current.created) >= b.linger {
+					ready = append(ready, b.detach(current))
+				}
+			}
+			b.Unlock()
+
+			b.send(ready)
+		}
+	}
+}
+
+// detach takes a batch out of the map, and queues it to be sent after the
+// last one detached for its topic and key. It must be called with the lock
+// held.
+func (b *batcher) detach(current *batch) *batch {
+	delete(b.batches, current.bk)
+
+	current.after = b.sending[current.bk]
+	current.sent = make(chan struct{})
+	b.sending[current.bk] = current.sent
+	return current
+}
+
+// send hands detached batches to the queue, without the lock held.
+func (b *batcher) send(ready []*batch) {
+	for _, current := range ready {
+		if current.after != nil {
+			<-current.after
+		}
+		b.produce(current)
+		close(current.sent)
+
+		b.Lock()
+		if b.sending[current.bk] == current.sent {
+			delete(b.sending, current.bk)
+		}
+		b.Unlock()
+	}
+}
+
+// produce stamps a batch with its first line's time. It carries that
+// line's headers only if every line came from the same request.
+func (b *batcher) produce(current *batch) {
+	var headers []sarama.RecordHeader
+	if len(current.origins) == 1 {
+		headers = current.headers
+	}
+
+	metrics.KafkaProducerMessageLines(current.topic).Observe(float64(current.lines))
+	b.queue.Produce(&sarama.ProducerMessage{
+		Topic:     current.topic,
+		Key:       current.key,
+		Value:     sarama.ByteEncoder(current.value),
+		Headers:   headers,
+		Timestamp: current.timestamp,
+		Metadata: &batchMetadata{
+			lines:    current.lines,
+			trackers: current.trackers,
+			origins:  current.origins,
+		},
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_batcher_limits(t *testing.T) {
+	cases := []struct {
+		label    string
+		maxLines int
+		maxBytes int
+		lines    []string
+		expect   []string
+	}{
+		{
+			label:    "line limit",
+			maxLines: 2,
+			lines:    []string{"a v=1 1", "b v=1 1", "c v=1 1"},
+			expect:   []string{"a v=1 1\nb v=1 1", "c v=1 1"},
+		},
+		{
+			label:    "byte limit",
+			maxLines: 10,
+			maxBytes: 16,
+			lines:    []string{"a v=1 1", "b v=1 1", "c v=1 1"},
+			expect:   []string{"a v=1 1\nb v=1 1", "c v=1 1"},
+		},
+		{
+			label:    "byte limit overflow",
+			maxLines: 10,
+			maxBytes: 12,
+			lines:    []string{"a v=1 1", "b v=1 1", "c v=1 1"},
+			expect:   []string{"a v=1 1", "b v=1 1", "c v=1 1"},
+		},
+		{
+			label:    "oversized line",
+			maxLines: 10,
+			maxBytes: 12,
+			lines:    []string{"a v=1 1", "oversized v=1 1", "c v=1 1"},
+			expect:   []string{"a v=1 1", "oversized v=1 1", "c v=1 1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			input := make(chan *sarama.ProducerMessage, 10)
+			b := newBatcher(input, c.maxLines, c.maxBytes, 1000, 0)
+
+			for _, line := range c.lines {
+				b.Add(&sarama.ProducerMessage{Topic: "t", Value: sarama.StringEncoder(line)}, nil, origin{})
+			}
+			b.Close()
+			close(input)
+
+			actual := []string{}
+			for msg := range input {
+				value, _ := msg.Value.Encode()
+				actual = append(actual, string(value))
+			}
+			assert.Equal(t, c.expect, actual)
+		})
+	}
+}
+
+func Test_batcher_separates_topics_and_keys(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	b := newBatcher(input, 10, 0, 1000, 0)
+
+	b.Add(&sarama.ProducerMessage{Topic: "t1", Value: sarama.StringEncoder("a v=1 1")}, nil, origin{})
+	b.Add(&sarama.ProducerMessage{Topic: "t2", Value: sarama.StringEncoder("b v=1 1")}, nil, origin{})
+	b.Add(&sarama.ProducerMessage{Topic: "t1", Key: sarama.StringEncoder("k"), Value: sarama.StringEncoder("c v=1 1")}, nil, origin{})
+	b.Add(&sarama.ProducerMessage{Topic: "t1", Value: sarama.StringEncoder("d v=1 1")}, nil, origin{})
+	b.Close()
+	close(input)
+
+	actual := map[string]string{}
+	for msg := range input {
+		var key []byte
+		if msg.Key != nil {
+			key, _ = msg.Key.Encode()
+		}
+		value, _ := msg.Value.Encode()
+		actual[msg.Topic+"/"+string(key)] = string(value)
+	}
+
+	assert.Equal(t, map[string]string{
+		"t1/":  "a v=1 1\nd v=1 1",
+		"t2/":  "b v=1 1",
+		"t1/k": "c v=1 1",
+	}, actual)
+}
+
+func Test_batcher_respects_max_message_bytes(t *testing.T) {
+	b := newBatcher(make(chan *sarama.ProducerMessage), 10, 1000000, 1000, 0)
+	assert.Equal(t, 1000-messageOverhead, b.maxBytes)
+}
+
+func Test_batcher_fits(t *testing.T) {
+	b := newBatcher(make(chan *sarama.ProducerMessage), 10, 16, 1000, 0)
+
+	assert.NoError(t, b.Fits(&sarama.ProducerMessage{Topic: "t", Value: sarama.StringEncoder("a value=1 1")}))
+	assert.NoError(t, b.Fits(&sarama.ProducerMessage{Topic: "t", Key: sarama.StringEncoder("k"), Value: sarama.StringEncoder("a value=12 1234")}))
+
+	err := b.Fits(&sarama.ProducerMessage{Topic: "t", Key: sarama.StringEncoder("key"), Value: sarama.StringEncoder("a value=12 1234")})
+	require.Error(t, err)
+	assert.Equal(t, "line is longer than the 13 bytes a batch may hold", err.Error())
+}
+
+func Test_batcher_linger(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	b := newBatcher(input, 10, 0, 1000, 10*time.Millisecond)
+	defer b.Close()
+
+	tracker := newDeliveryTracker()
+	tracker.Add()
+	b.Add(&sarama.ProducerMessage{Topic: "t", Value: sarama.StringEncoder("a v=1 1")}, tracker, origin{})
+
+	select {
+	case msg := <-input:
+		value, _ := msg.Value.Encode()
+		assert.Equal(t, "a v=1 1", string(value))
+
+		require.IsType(t, &batchMetadata{}, msg.Metadata)
+		assert.Equal(t, 1, msg.Metadata.(*batchMetadata).lines)
+		assert.Equal(t, []*deliveryTracker{tracker}, msg.Metadata.(*batchMetadata).trackers)
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout while waiting for a lingering batch")
+	}
+}
+
+func Test_batcher_headers_and_timestamp(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	b := newBatcher(input, 2, 0, 1000, 0)
+
+	a, c := origin{db: "a", requestID: "1"}, origin{db: "a", requestID: "2"}
+	headers := []sarama.RecordHeader{{Key: []byte("db"), Value: []byte("a")}}
+	add := func(line string, timestamp int64, from origin) {
+		b.Add(&sarama.ProducerMessage{
+			Topic:     "t",
+			Value:     sarama.StringEncoder(line),
+			Headers:   headers,
+			Timestamp: time.Unix(timestamp, 0),
+		}, nil, from)
+	}
+
+	// A batch of lines from one request carries its headers, and the
+	// first line's time.
+	add("a v=1 1", 1, a)
+	add("a v=2 2", 2, a)
+	msg := <-input
+	assert.Equal(t, headers, msg.Headers)
+	assert.Equal(t, time.Unix(1, 0), msg.Timestamp)
+
+	// One from many doesn't.
+	add("a v=3 3", 3, a)
+	add("a v=4 4", 4, c)
+	msg = <-input
+	assert.Nil(t, msg.Headers)
+	assert.Equal(t, time.Unix(3, 0), msg.Timestamp)
+	assert.Equal(t, []originRun{{a, 1}, {c, 1}}, msg.Metadata.(*batchMetadata).origins)
+}
+
+func Test_batcher_sends_without_the_lock(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage)
+	b := newBatcher(input, 2, 0, 1000, 0)
+	add := func(topic, line string) {
+		b.Add(&sarama.ProducerMessage{Topic: topic, Value: sarama.StringEncoder(line)}, nil, origin{})
+	}
+	sending := func() int {
+		b.Lock()
+		defer b.Unlock()
+		return len(b.sending)
+	}
+
+	// The first batch waits on the producer...
+	first := make(chan struct{})
+	go func() {
+		add("t1", "a v=1 1")
+		add("t1", "b v=1 1")
+		close(first)
+	}()
+	for sending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// ...without holding up lines for other topics...
+	added := make(chan struct{})
+	go func() {
+		add("t2", "c v=1 1")
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout while adding a line behind a waiting batch")
+	}
+
+	// ...and the next batch for its topic waits its turn.
+	second := make(chan struct{})
+	go func() {
+		add("t1", "d v=1 1")
+		add("t1", "e v=1 1")
+		close(second)
+	}()
+
+	for _, expect := range []string{"a v=1 1\nb v=1 1", "d v=1 1\ne v=1 1"} {
+		msg := <-input
+		value, _ := msg.Value.Encode()
+		assert.Equal(t, expect, string(value))
+	}
+	<-first
+	<-second
+
+	go b.Close()
+	msg := <-input
+	value, _ := msg.Value.Encode()
+	assert.Equal(t, "c v=1 1", string(value))
+}
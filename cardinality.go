@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// What to do with a new series when its database is over its limit.
+const (
+	CardinalityReject    = "reject"
+	CardinalityStripTags = "strip_tags"
+)
+
+const (
+	DefaultCardinalityWindow = time.Hour
+	DefaultMaxTagValues      = 1000
+)
+
+const (
+	// Each sketch keeps 2^precision one-byte registers. Series are
+	// counted to within about 1.6%, and tag values to within about 3%.
+	seriesPrecision   = 12
+	tagValuePrecision = 10
+
+	// Each series filter keeps this many bits, and sets this many of
+	// them, for each series the limit allows. Once a database is at its
+	// limit, about one new series in a thousand is mistaken for a known
+	// one, and let through.
+	seriesFilterBits   = 15
+	seriesFilterHashes = 10
+
+	// The window slides a slice at a time.
+	cardinalitySlices = 6
+
+	// How often the series estimate is worked out afresh. In between, it
+	// is counted up as new series arrive.
+	cardinalityEstimateInterval = time.Second
+
+	// The most tag keys tracked in each database. Tags beyond these are
+	// never stripped.
+	cardinalityMaxTagKeys = 256
+)
+
+// CardinalityConfig limits the series each database may write within a
+// sliding window.
+//
+//	cardinality:
+//	  limit: 100000
+//	  action: strip_tags
+//	  databases:
+//	    telegraf: 1000000
+type CardinalityConfig struct {
+	// Limit is the most series each database may write; zero is no
+	// limit. Databases may be given their own.
+	Limit     int64            `yaml:"limit"`
+	Databases map[string]int64 `yaml:"databases"`
+
+	// Window is how long a series counts toward the limit after it was
+	// last written.
+	Window time.Duration `yaml:"window"`
+
+	// Action is what happens to new series over the limit: they are
+	// rejected, or tags with more than MaxTagValues values within the
+	// window are stripped from them.
+	Action       string `yaml:"action"`
+	MaxTagValues int64  `yaml:"max_tag_values"`
+}
+
+func (c CardinalityConfig) enabled() bool {
+	enabled := c.Limit > 0
+	for _, limit := range c.Databases {
+		enabled = enabled || limit > 0
+	}
+	return enabled
+}
+
+// validateCardinality reports problems with the series limits.
+func (c *TelepathConfig) validateCardinality(fail func(string, ...interface{})) {
+	cc := c.Cardinality
+	if cc.Limit < 0 {
+		fail("series limit can't be negative")
+	}
+	for db, limit := range cc.Databases {
+		if limit < 0 {
+			fail("series limit for database %s can't be negative", db)
+		}
+	}
+	if !cc.enabled() {
+		return
+	}
+
+	if cc.Window < cardinalitySlices*time.Second {
+		fail("cardinality window must be at least %v", cardinalitySlices*time.Second)
+	}
+	switch cc.Action {
+	case CardinalityReject:
+	case CardinalityStripTags:
+		if cc.MaxTagValues < 1 {
+			fail("cardinality max tag values must be at least 1")
+		}
+	default:
+		fail("invalid cardinality action %q: use %s or %s", cc.Action, CardinalityReject, CardinalityStripTags)
+	}
+}
+
+// seriesLimitError is why a line with a new series was dropped.
+type seriesLimitError struct {
+	limit int64
+}
+
+func (e *seriesLimitError) Error() string {
+	// The same as InfluxDB's
+	return fmt.Sprintf("max-series-per-database limit exceeded: (%d)", e.limit)
+}
+
+// cardinalityGuard estimates how many series each database with a limit
+// has written within the window, and turns away, or strips the tags of,
+// new series once it is over.
+type cardinalityGuard struct {
+	sync.Mutex
+	CardinalityConfig
+	databases map[string]*databaseCardinality
+	now       func() time.Time
+}
+
+// databaseCardinality sketches the series written to a database, and,
+// when tags may be stripped, the values of each tag key. The series
+// sketch also filters the series, to tell new ones from known ones.
+type databaseCardinality struct {
+	series    *slidingSketch
+	tags      map[string]*slidingSketch
+	estimate  float64
+	estimated time.Time
+}
+
+// newCardinalityGuard returns a guard for the config, or nil if it sets no
+// limits.
+func newCardinalityGuard(config CardinalityConfig) *cardinalityGuard {
+	if !config.enabled() {
+		return nil
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultCardinalityWindow
+	}
+	if config.Action == "" {
+		config.Action = CardinalityReject
+	}
+	if config.MaxTagValues <= 0 {
+		config.MaxTagValues = DefaultMaxTagValues
+	}
+
+	return &cardinalityGuard{
+		CardinalityConfig: config,
+		databases:         make(map[string]*databaseCardinality),
+		now:               time.Now,
+	}
+}
+
+func (g *cardinalityGuard) limit(db string) int64 {
+	if limit, ok := g.Databases[db]; ok {
+		return limit
+	}
+	return g.Limit
+}
+
+// Check counts the point's series. If it is new and the database is over
+// its limit, the point's offending tags are stripped, returning their
+// keys, or, if there are none or the action is to reject, it returns a
+// seriesLimitError.
+func (g *cardinalityGuard) Check(db string, point *Point) ([]string, error) {
+	limit := g.limit(db)
+	if limit <= 0 {
+		return nil, nil
+	}
+	series := hashString(point.SeriesKey())
+
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.now()
+	dc := g.database(db, limit, now)
+	if g.Action == CardinalityStripTags {
+		dc.countTags(point.Tags, g.Window, now)
+	}
+
+	if dc.series.Seen(series) {
+		// Keep it in the window.
+		dc.series.Add(series)
+		return nil, nil
+	}
+	if dc.estimate < float64(limit) {
+		dc.add(series)
+		return nil, nil
+	}
+
+	if g.Action == CardinalityStripTags {
+		var offending []string
+		for _, tag := range point.Tags {
+			if values, ok := dc.tags[tag.Key]; ok && values.Estimate() > float64(g.MaxTagValues) {
+				offending = append(offending, tag.Key)
+			}
+		}
+		if removed := point.RemoveTags(offending...); removed != nil {
+			dc.add(hashString(point.SeriesKey()))
+			metrics.CardinalityStrippedLineCount(db).Inc()
+			return removed, nil
+		}
+	}
+	return nil, &seriesLimitError{limit}
+}
+
+// database returns the database's sketches, slid up to now, with a fresh
+// estimate if it is due. It must be called with the lock held.
+func (g *cardinalityGuard) database(db string, limit int64, now time.Time) *databaseCardinality {
+	dc, ok := g.databases[db]
+	if !ok {
+		dc = &databaseCardinality{
+			series: newSlidingSketch(seriesPrecision, limit, g.Window, now),
+			tags:   make(map[string]*slidingSketch),
+		}
+		g.databases[db] = dc
+	}
+
+	if dc.series.Slide(now) || now.Sub(dc.estimated) >= cardinalityEstimateInterval {
+		dc.estimate = dc.series.Estimate()
+		dc.estimated = now
+		metrics.CardinalitySeries(db).Set(dc.estimate)
+	}
+	return dc
+}
+
+// add counts a series, adding it to the estimate, if it's new, until the
+// next time it's worked out.
+func (dc *databaseCardinality) add(series uint64) {
+	if !dc.series.Seen(series) {
+		dc.estimate++
+	}
+	dc.series.Add(series)
+}
+
+func (dc *databaseCardinality) countTags(tags []Tag, window time.Duration, now time.Time) {
+	for _, tag := range tags {
+		values, ok := dc.tags[tag.Key]
+		if !ok {
+			if len(dc.tags) >= cardinalityMaxTagKeys {
+				continue
+			}
+			values = newSlidingSketch(tagValuePrecision, 0, window, now)
+			dc.tags[tag.Key] = values
+		}
+		values.Slide(now)
+		values.Add(hashString(tag.Value))
+	}
+}
+
+// slidingSketch estimates the distinct values added within a window. The
+// window is split into slices, each with its own sketch, and the oldest is
+// cleared as each new one begins, so values are forgotten between five
+// and six sixths of the window after they were last added.
+//
+// Given a capacity, each slice also has a Bloom filter of the values added
+// to it, so that Seen can tell whether a value is one of about that many
+// already in the window.
+type slidingSketch struct {
+	slices  []hyperLogLog
+	merged  hyperLogLog
+	filters []bloomFilter
+	union   bloomFilter
+	current int
+	start   time.Time
+	width   time.Duration
+}
+
+func newSlidingSketch(precision uint, capacity int64, window time.Duration, now time.Time) *slidingSketch {
+	s := &slidingSketch{
+		slices: make([]hyperLogLog, cardinalitySlices),
+		merged: newHyperLogLog(precision),
+		start:  now,
+		width:  window / cardinalitySlices,
+	}
+	for i := range s.slices {
+		s.slices[i] = newHyperLogLog(precision)
+	}
+	if capacity > 0 {
+		s.filters = make([]bloomFilter, cardinalitySlices)
+		s.union = newBloomFilter(capacity*seriesFilterBits, seriesFilterHashes)
+		for i := range s.filters {
+			s.filters[i] = newBloomFilter(capacity*seriesFilterBits, seriesFilterHashes)
+		}
+	}
+	return s
+}
+
+// Slide moves the window up to now, reporting whether it moved.
+func (s *slidingSketch) Slide(now time.Time) bool {
+	passed := int64(now.Sub(s.start) / s.width)
+	if passed <= 0 {
+		return false
+	}
+	s.start = s.start.Add(time.Duration(passed) * s.width)
+
+	if passed > int64(len(s.slices)) {
+		passed = int64(len(s.slices))
+	}
+	for ; passed > 0; passed-- {
+		s.current = (s.current + 1) % len(s.slices)
+		s.slices[s.current].Reset()
+		if s.filters != nil {
+			s.filters[s.current].Reset()
+		}
+	}
+
+	s.merged.Reset()
+	for _, slice := range s.slices {
+		s.merged.Merge(slice)
+	}
+	if s.filters != nil {
+		s.union.Reset()
+		for _, filter := range s.filters {
+			s.union.Merge(filter)
+		}
+	}
+	return true
+}
+
+// Seen reports whether the value has probably been added within the
+// window. A value which hasn't may be mistaken for one which has, but not
+// the other way around. Without a capacity, nothing has been seen.
+func (s *slidingSketch) Seen(hash uint64) bool {
+	return s.filters != nil && s.union.Has(hash)
+}
+
+func (s *slidingSketch) Add(hash uint64) {
+	s.slices[s.current].Add(hash)
+	s.merged.Add(hash)
+	if s.filters != nil {
+		s.filters[s.current].Add(hash)
+		s.union.Add(hash)
+	}
+}
+
+func (s *slidingSketch) Estimate() float64 {
+	return s.merged.Estimate()
+}
+
+// hyperLogLog estimates the count of distinct hashes added to it. Each
+// register keeps the longest run of leading zeros seen in the hashes which
+// fall into it.
+type hyperLogLog struct {
+	precision uint
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint) hyperLogLog {
+	return hyperLogLog{precision, make([]uint8, 1<<precision)}
+}
+
+// register returns which register a hash falls into, from its top bits,
+// and its rank: one more than the leading zeros in the rest of it.
+func (h hyperLogLog) register(hash uint64) (int, uint8) {
+	index := hash >> (64 - h.precision)
+	rest := hash<<h.precision | 1<<(h.precision-1)
+	return int(index), uint8(leadingZeros(rest) + 1)
+}
+
+// leadingZeros counts the zero bits above a word's highest set bit.
+func leadingZeros(x uint64) int {
+	if x == 0 {
+		return 64
+	}
+	n := 0
+	for shift := uint(32); shift > 0; shift /= 2 {
+		if x>>(64-shift) == 0 {
+			n += int(shift)
+			x <<= shift
+		}
+	}
+	return n
+}
+
+func (h hyperLogLog) Add(hash uint64) {
+	index, rank := h.register(hash)
+	if h.registers[index] < rank {
+		h.registers[index] = rank
+	}
+}
+
+func (h hyperLogLog) Merge(other hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+func (h hyperLogLog) Reset() {
+	for i := range h.registers {
+		h.registers[i] = 0
+	}
+}
+
+// Estimate returns the estimated count, to the nearest whole number. While
+// many registers are empty, it counts them instead, as that's more
+// accurate for small counts.
+func (h hyperLogLog) Estimate() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(estimate + 0.5)
+}
+
+// bloomFilter tells whether a hash has been added to it, though it may
+// mistake one which hasn't for one which has. Each hash sets as many bits
+// as there are hashes, picked by double hashing its two halves.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+func newBloomFilter(bits int64, hashes uint64) bloomFilter {
+	return bloomFilter{make([]uint64, (bits+63)/64), hashes}
+}
+
+// bit returns the index of the hash's i'th bit.
+func (b bloomFilter) bit(hash, i uint64) uint64 {
+	h1, h2 := hash, hash>>32|hash<<32|1
+	return (h1 + i*h2) % (uint64(len(b.bits)) * 64)
+}
+
+func (b bloomFilter) Add(hash uint64) {
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := b.bit(hash, i)
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b bloomFilter) Has(hash uint64) bool {
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := b.bit(hash, i)
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bloomFilter) Merge(other bloomFilter) {
+	for i, word := range other.bits {
+		b.bits[i] |= word
+	}
+}
+
+func (b bloomFilter) Reset() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+}
+
+// hashString hashes a series key or tag value evenly across 64 bits. FNV
+// alone leaves the top bits, which pick a register, poorly mixed, so they
+// are mixed again with MurmurHash3's finalizer.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
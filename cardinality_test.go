@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_hyperloglog_estimate(t *testing.T) {
+	for _, count := range []int{10, 1000, 100000} {
+		h := newHyperLogLog(seriesPrecision)
+		for i := 0; i < count; i++ {
+			h.Add(hashString(fmt.Sprintf("cpu,host=host-%d", i)))
+			h.Add(hashString(fmt.Sprintf("cpu,host=host-%d", i)))
+		}
+		assert.InEpsilon(t, count, h.Estimate(), 0.05, "count %d", count)
+	}
+}
+
+func Test_leading_zeros(t *testing.T) {
+	assert.Equal(t, 64, leadingZeros(0))
+	for i := uint(0); i < 64; i++ {
+		assert.Equal(t, 63-int(i), leadingZeros(1<<i), "bit %d", i)
+		assert.Equal(t, 63-int(i), leadingZeros(1<<i|1), "bit %d", i)
+	}
+	assert.Equal(t, 0, leadingZeros(^uint64(0)))
+}
+
+func Test_sliding_sketch(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	s := newSlidingSketch(seriesPrecision, 100, 6*time.Minute, now)
+
+	assert.False(t, s.Seen(hashString("a")))
+	s.Add(hashString("a"))
+	s.Add(hashString("a"))
+	assert.True(t, s.Seen(hashString("a")))
+	assert.False(t, s.Seen(hashString("b")))
+	assert.Equal(t, float64(1), s.Estimate())
+
+	// A value is kept while it's added within the window.
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Minute)
+		assert.True(t, s.Slide(now))
+		assert.True(t, s.Seen(hashString("a")))
+		s.Add(hashString("a"))
+	}
+	assert.False(t, s.Slide(now.Add(30*time.Second)))
+
+	// And forgotten once it isn't.
+	now = now.Add(6 * time.Minute)
+	s.Slide(now)
+	assert.False(t, s.Seen(hashString("a")))
+	assert.Equal(t, float64(0), s.Estimate())
+}
+
+func Test_bloom_filter(t *testing.T) {
+	b := newBloomFilter(1000*seriesFilterBits, seriesFilterHashes)
+	for i := 0; i < 1000; i++ {
+		b.Add(hashString(fmt.Sprintf("cpu,host=host-%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(t, b.Has(hashString(fmt.Sprintf("cpu,host=host-%d", i))))
+	}
+
+	// Few values which weren't added are mistaken for ones which were.
+	var mistaken int
+	for i := 0; i < 100000; i++ {
+		if b.Has(hashString(fmt.Sprintf("mem,host=host-%d", i))) {
+			mistaken++
+		}
+	}
+	assert.True(t, mistaken < 500, "%d mistaken", mistaken)
+
+	other := newBloomFilter(1000*seriesFilterBits, seriesFilterHashes)
+	other.Merge(b)
+	assert.True(t, other.Has(hashString("cpu,host=host-1")))
+	b.Reset()
+	assert.False(t, b.Has(hashString("cpu,host=host-1")))
+}
+
+func Test_cardinality_guard_reject(t *testing.T) {
+	g := newCardinalityGuard(CardinalityConfig{
+		Limit:     2,
+		Databases: map[string]int64{"unlimited": 0},
+	})
+	require.NotNil(t, g)
+	now := time.Unix(1500000000, 0)
+	g.now = func() time.Time { return now }
+
+	check := func(db, line string) error {
+		point, err := ParsePoint([]byte(line), "ns", now)
+		require.NoError(t, err)
+		stripped, err := g.Check(db, point)
+		assert.Nil(t, stripped)
+		return err
+	}
+
+	assert.NoError(t, check("test", "cpu,host=a value=1"))
+	assert.NoError(t, check("test", "cpu,host=b,region=x value=1"))
+	err := check("test", "cpu,host=c value=1")
+	require.Error(t, err)
+	assert.Equal(t, "max-series-per-database limit exceeded: (2)", err.Error())
+
+	// Known series are still written, whatever order their tags are in.
+	assert.NoError(t, check("test", "cpu,host=a value=2"))
+	assert.NoError(t, check("test", "cpu,region=x,host=b value=1"))
+
+	// Each database has its own limit.
+	assert.NoError(t, check("other", "cpu,host=c value=1"))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, check("unlimited", fmt.Sprintf("cpu,host=%d value=1", i)))
+	}
+
+	// Series are forgotten after the window.
+	now = now.Add(DefaultCardinalityWindow)
+	assert.NoError(t, check("test", "cpu,host=c value=1"))
+}
+
+func Test_cardinality_guard_many_series(t *testing.T) {
+	g := newCardinalityGuard(CardinalityConfig{Limit: 5000})
+	now := time.Unix(1500000000, 0)
+	g.now = func() time.Time { return now }
+
+	// A flood of new series is let through only up to about the limit,
+	// while the estimate is worked out afresh.
+	var accepted int
+	for i := 0; i < 100000; i++ {
+		now = now.Add(time.Millisecond)
+		point, err := ParsePoint([]byte(fmt.Sprintf("cpu,request=%d value=1", i)), "ns", now)
+		require.NoError(t, err)
+		if _, err := g.Check("test", point); err == nil {
+			accepted++
+		}
+	}
+	assert.InEpsilon(t, 5000, accepted, 0.05, "%d accepted", accepted)
+}
+
+func Test_cardinality_guard_strip_tags(t *testing.T) {
+	g := newCardinalityGuard(CardinalityConfig{
+		Limit:        3,
+		Action:       CardinalityStripTags,
+		MaxTagValues: 2,
+	})
+	now := time.Unix(1500000000, 0)
+	g.now = func() time.Time { return now }
+
+	check := func(line string) ([]string, string, error) {
+		point, err := ParsePoint([]byte(line), "ns", now)
+		require.NoError(t, err)
+		stripped, err := g.Check("test", point)
+		return stripped, string(point.Line()), err
+	}
+
+	for _, line := range []string{
+		"cpu,host=a,request=1 value=1 1",
+		"cpu,host=a,request=2 value=1 1",
+		"cpu,host=a,request=3 value=1 1",
+	} {
+		stripped, _, err := check(line)
+		assert.NoError(t, err)
+		assert.Nil(t, stripped)
+	}
+
+	// The tag with too many values is stripped from a new series.
+	stripped, line, err := check("cpu,host=a,request=4 value=1 1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"request"}, stripped)
+	assert.Equal(t, "cpu,host=a value=1 1", line)
+
+	// Without an offending tag, it's rejected.
+	_, _, err = check("mem,host=b value=1 1")
+	assert.Error(t, err)
+}
+
+func Test_cardinality_guard_disabled(t *testing.T) {
+	assert.Nil(t, newCardinalityGuard(CardinalityConfig{}))
+	assert.Nil(t, newCardinalityGuard(CardinalityConfig{Databases: map[string]int64{"test": 0}}))
+	assert.NotNil(t, newCardinalityGuard(CardinalityConfig{Databases: map[string]int64{"test": 1}}))
+}
+
+func Test_write_handler_series_limit(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		cardinality: CardinalityConfig{Limit: 1},
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+
+	cases := []struct {
+		body   string
+		status int
+		expect string
+	}{
+		{"foo,host=a value=1 1\nfoo,host=b value=1 1", http.StatusBadRequest,
+			`{"error":"partial write: max-series-per-database limit exceeded: (1) dropped=1"}`},
+		{"foo,host=c value=1 1", http.StatusBadRequest,
+			`{"error":"max-series-per-database limit exceeded: (1)"}`},
+	}
+
+	for _, c := range cases {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foo/write?db=test")
+		req.Header.SetMethod("POST")
+		req.SetBody([]byte(c.body))
+		require.NoError(t, client.Do(&req, &resp))
+
+		assert.Equal(t, c.status, resp.StatusCode())
+		assert.Equal(t, c.expect, string(resp.Body()))
+	}
+}
+
+func Test_cardinality_config(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-cardinality.limit", "1000",
+		"-cardinality.window", "1s",
+		"-cardinality.action", "drop",
+	}, noEnv)
+	require.Error(t, err)
+	assert.Equal(t, "cardinality window must be at least 6s; "+
+		`invalid cardinality action "drop": use reject or strip_tags`, err.Error())
+}
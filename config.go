@@ -3,89 +3,394 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/Nordstrom/telepath/middleware"
-	log "github.com/Sirupsen/logrus"
 	"github.com/Shopify/sarama"
-	"strings"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
-const DEFAULT_KAFKA_VERSION = "V0_10_0_0"
+const DEFAULT_KAFKA_VERSION = "0.10.0.0"
+
+// Environment variables named for a flag, e.g. TELEPATH_KAFKA_BROKERS for
+// -kafka.brokers, override the config file.
+const envPrefix = "TELEPATH_"
 
 type TelepathConfig struct {
-	Brokers       string
-	TopicTemplate string
-	LogLevel      string
-	LogFormat     string
-	HTTP          HTTPConfig
-	HTTPS         HTTPSConfig
-	Auth          middleware.AuthConfig
-	Version 	  sarama.KafkaVersion
+	ConfigPath    string                `yaml:"-"`
+	ConfigWatch   time.Duration         `yaml:"config_watch"`
+	Brokers       string                `yaml:"brokers"`
+	KafkaVersion  string                `yaml:"kafka_version"`
+	KafkaTLS      KafkaTLSConfig        `yaml:"kafka_tls"`
+	KafkaSASL     KafkaSASLConfig       `yaml:"kafka_sasl"`
+	RecordHeaders string                `yaml:"record_headers"`
+	Producer      ProducerConfig        `yaml:"producer"`
+	TopicTemplate string                `yaml:"topic"`
+	RoutesPath    string                `yaml:"routes_file"`
+	Routes        *RoutesConfig         `yaml:"routes"`
+	KeyTemplate   string                `yaml:"key"`
+	AckMode       string                `yaml:"ack"`
+	AckTimeout    time.Duration         `yaml:"ack_timeout"`
+	LogLevel      string                `yaml:"log_level"`
+	LogFormat     string                `yaml:"log_format"`
+	Batch         BatchConfig           `yaml:"batch"`
+	Spool         SpoolConfig           `yaml:"spool"`
+	Backpressure  BackpressureConfig    `yaml:"backpressure"`
+	RateLimits    RateLimitConfig       `yaml:"rate_limits"`
+	Cardinality   CardinalityConfig     `yaml:"cardinality"`
+	Shutdown      ShutdownConfig        `yaml:"shutdown"`
+	DeadLetter    DeadLetterConfig      `yaml:"dead_letter"`
+	HTTP          HTTPConfig            `yaml:"http"`
+	HTTPS         HTTPSConfig           `yaml:"https"`
+	Auth          middleware.AuthConfig `yaml:"auth"`
+	Version       sarama.KafkaVersion   `yaml:"-"`
+
+	// Problems with the environment, reported by Validate.
+	envErrors ConfigErrors
+}
+
+type BatchConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Lines   int           `yaml:"lines"`
+	Bytes   int           `yaml:"bytes"`
+	Linger  time.Duration `yaml:"linger"`
 }
 
 type HTTPConfig struct {
-	Enabled bool
-	Addr    string
+	Enabled bool   `yaml:"enabled"`
+	Addr    string `yaml:"addr"`
 }
 
 type HTTPSConfig struct {
-	Enabled                bool
-	Addr                   string
-	CertificatePath        string
-	KeyPath                string
-	ClientVerify           string
-	ClientCertificatePaths []string
+	Enabled                bool     `yaml:"enabled"`
+	Addr                   string   `yaml:"addr"`
+	CertificatePath        string   `yaml:"certificate"`
+	KeyPath                string   `yaml:"key"`
+	ClientVerify           string   `yaml:"client_verify"`
+	ClientCertificatePaths []string `yaml:"client_certificates"`
+	ClientCertificateDir   string   `yaml:"client_certificate_dir"`
+
+	// CertificateWatch is how often to check the certificate files for
+	// changes, or zero not to.
+	CertificateWatch time.Duration `yaml:"certificate_watch"`
 }
 
 type stringSlice []string
 
+// ConfigErrors collects every problem found with a configuration, so they
+// can be reported together.
+type ConfigErrors []error
+
+func (ce ConfigErrors) Error() string {
+	messages := make([]string, len(ce))
+	for i, err := range ce {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Parse reads the configuration from the command line, and from the
+// config file and environment. Flags given on the command line win over
+// the environment, which wins over the config file.
 func (c *TelepathConfig) Parse() {
-	var clientCertificatePaths stringSlice
-	version := flag.String("kafka.version", DEFAULT_KAFKA_VERSION, "Kafka version, will default to " + DEFAULT_KAFKA_VERSION)
-	c.Version = StringToKafkaVersion(version)
+	if err := c.parse(flag.CommandLine, os.Args[1:], os.LookupEnv); err != nil {
+		log.Fatalf("Could not read configuration: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	flag.StringVar(&c.Brokers, "kafka.brokers", "", "A comma-separated list of Kafka host:port addrs to connect to")
-	flag.StringVar(&c.TopicTemplate, "topic.name", DefaultTopicTemplate, "The Kafka topic name/template to write metrics to")
+	SetLogFormat(c.LogFormat)
+	SetLogLevel(c.LogLevel)
+}
 
-	flag.StringVar(&c.HTTP.Addr, "http.addr", ":8089", "An HTTP addr to bind to")
-	flag.BoolVar(&c.HTTP.Enabled, "http.enabled", true, "Listen to HTTP addr, if true")
+// loadConfig reads the configuration as Parse does, returning any errors
+// rather than exiting.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*TelepathConfig, error) {
+	c := &TelepathConfig{}
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if err := c.parse(fs, args, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 
-	flag.StringVar(&c.HTTPS.Addr, "https.addr", ":8090", "An HTTPS addr to bind to")
-	flag.BoolVar(&c.HTTPS.Enabled, "https.enabled", false, "Listen to HTTP addr, if true")
-	flag.StringVar(&c.HTTPS.CertificatePath, "https.certificate", "", "Path to a TLS certificate file")
-	flag.StringVar(&c.HTTPS.KeyPath, "https.key", "", "Path to a TLS key file")
-	flag.StringVar(&c.HTTPS.ClientVerify, "https.client.verify", "none", "Client certificate verification: none, optional, or required")
-	flag.Var(&clientCertificatePaths, "https.client.certificate", "Path to a client certificate file")
+	return c, nil
+}
 
-	flag.BoolVar(&c.Auth.Enabled, "auth.enabled", false, "Authenticate user, if true")
-	flag.StringVar(&c.Auth.Username, "auth.username", "", "Name of authenticated user")
-	flag.StringVar(&c.Auth.Password, "auth.password", "", "Password of authenticated user")
+func (c *TelepathConfig) parse(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) error {
+	c.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
 
-	flag.StringVar(&c.LogLevel, "log.level", log.InfoLevel.String(), "Logging level: debug, info, warning, error")
-	flag.StringVar(&c.LogFormat, "log.format", LogFormatText, "Logging format: text, json")
-	flag.Parse()
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
 
-	c.HTTPS.ClientCertificatePaths = make([]string, len(clientCertificatePaths))
-	copy(c.HTTPS.ClientCertificatePaths, clientCertificatePaths)
+	// The config file may be named in the environment, too, so it has to
+	// be found before the file is read.
+	if path, ok := lookupEnv(envName("config")); ok && !explicit["config"] {
+		c.ConfigPath = path
+	}
+	if c.ConfigPath != "" {
+		data, err := ioutil.ReadFile(c.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return fmt.Errorf("%s: %v", c.ConfigPath, err)
+		}
+	}
 
-	SetLogFormat(c.LogFormat)
-	SetLogLevel(c.LogLevel)
+	c.envErrors = nil
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		value, ok := lookupEnv(name)
+		if !ok || explicit[f.Name] {
+			return
+		}
+
+		if ss, ok := f.Value.(*stringSlice); ok {
+			*ss = nil
+			for _, v := range strings.Split(value, ",") {
+				ss.Set(v)
+			}
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			c.envErrors = append(c.envErrors,
+				fmt.Errorf("invalid value %q for %s: %v", value, name, err))
+		}
+	})
+
+	// Reapply the command line, so that it wins.
+	fs.Visit(func(f *flag.Flag) {
+		if ss, ok := f.Value.(*stringSlice); ok {
+			*ss = nil
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Until the brokers are asked, assume the oldest version which can
+	// be asked. An invalid version is reported by Validate.
+	if c.AutoKafkaVersion() {
+		c.Version = sarama.V0_10_0_0
+	} else {
+		c.Version, _ = ParseKafkaVersion(c.KafkaVersion)
+	}
+	return nil
+}
+
+func (c *TelepathConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigPath, "config", "", "Path to a YAML config file")
+	fs.DurationVar(&c.ConfigWatch, "config.watch", 0, "How often to check the config files for changes, and reload them; if 0, only reload on SIGHUP")
+
+	fs.StringVar(&c.Brokers, "kafka.brokers", "", "A comma-separated list of Kafka host:port addrs to connect to")
+	fs.StringVar(&c.KafkaVersion, "kafka.version", DEFAULT_KAFKA_VERSION, "Kafka version, such as 0.10.2 or 1.1, or auto to ask the brokers")
+	fs.StringVar(&c.RecordHeaders, "kafka.headers", DefaultRecordHeaders, "A comma-separated list of record headers to attach on Kafka 0.11 and later: db, precision, principal, client_ip, received, request_id")
+	defaults := sarama.NewConfig()
+	fs.StringVar(&c.Producer.Acks, "kafka.producer.acks", "leader", "Acks the producer waits for: none, leader or all")
+	fs.StringVar(&c.Producer.Compression, "kafka.producer.compression", "snappy", "Producer compression codec: none, gzip, snappy or lz4")
+	fs.IntVar(&c.Producer.FlushBytes, "kafka.producer.flush.bytes", defaults.Producer.Flush.Bytes, "Bytes which trigger a flush of the producer's buffer; 0 for no limit")
+	fs.IntVar(&c.Producer.FlushMessages, "kafka.producer.flush.messages", defaults.Producer.Flush.Messages, "Messages which trigger a flush of the producer's buffer; 0 for no limit")
+	fs.DurationVar(&c.Producer.FlushFrequency, "kafka.producer.flush.frequency", 500*time.Millisecond, "How often to flush the producer's buffer; 0 for as fast as possible")
+	fs.IntVar(&c.Producer.MaxMessageBytes, "kafka.producer.max.message.bytes", defaults.Producer.MaxMessageBytes, "The largest Kafka message to produce")
+	fs.DurationVar(&c.Producer.Timeout, "kafka.producer.timeout", defaults.Producer.Timeout, "How long brokers may wait for acks from all replicas")
+	fs.IntVar(&c.Producer.RetryMax, "kafka.producer.retry.max", defaults.Producer.Retry.Max, "How many times to retry producing a message")
+	fs.DurationVar(&c.Producer.RetryBackoff, "kafka.producer.retry.backoff", defaults.Producer.Retry.Backoff, "How long to wait before retrying")
+	fs.IntVar(&c.Producer.ChannelBufferSize, "kafka.producer.buffer", defaults.ChannelBufferSize, "Messages buffered in each of the producer's channels")
+	fs.StringVar(&c.Producer.Partitioner, "kafka.producer.partitioner", "hash", "How to choose partitions: hash (of the message key), random or roundrobin")
+	fs.StringVar(&c.Producer.ClientID, "kafka.client.id", "telepath", "The client ID to identify Telepath to the brokers")
+	fs.BoolVar(&c.KafkaTLS.Enabled, "kafka.tls", false, "Connect to the Kafka brokers with TLS, if true")
+	fs.StringVar(&c.KafkaTLS.CAPath, "kafka.tls.ca", "", "Path to a PEM bundle of CAs to verify the Kafka brokers with; defaults to the system's")
+	fs.StringVar(&c.KafkaTLS.CertificatePath, "kafka.tls.certificate", "", "Path to a client certificate to present to the Kafka brokers")
+	fs.StringVar(&c.KafkaTLS.KeyPath, "kafka.tls.key", "", "Path to the key of the Kafka client certificate")
+	fs.BoolVar(&c.KafkaTLS.InsecureSkipVerify, "kafka.tls.insecure", false, "Don't verify the Kafka brokers' certificates, if true; for development only")
+	fs.StringVar(&c.KafkaSASL.Mechanism, "kafka.sasl.mechanism", "", "SASL mechanism to authenticate with Kafka: PLAIN; none if empty")
+	fs.StringVar(&c.KafkaSASL.Username, "kafka.sasl.username", "", "SASL username for Kafka")
+	fs.StringVar(&c.KafkaSASL.Password, "kafka.sasl.password", "", "SASL password for Kafka; prefer TELEPATH_KAFKA_SASL_PASSWORD")
+	fs.StringVar(&c.TopicTemplate, "topic.name", DefaultTopicTemplate, "The Kafka topic name/template to write metrics to")
+	fs.StringVar(&c.RoutesPath, "topic.routes", "", "Path to a YAML file of rules routing points to topics; topic.name is the default route")
+	fs.StringVar(&c.KeyTemplate, "kafka.key", "", "The Kafka message key template, e.g. {{.SeriesKey}}; messages are unkeyed if empty")
+	fs.StringVar(&c.AckMode, "write.ack", AckNone, "Wait for Kafka to acknowledge writes before responding: none, kafka")
+	fs.DurationVar(&c.AckTimeout, "write.ack.timeout", DefaultAckTimeout, "How long to wait for Kafka to acknowledge a write")
+
+	fs.BoolVar(&c.Batch.Enabled, "kafka.batch", false, "Pack many lines into each Kafka message, if true")
+	fs.IntVar(&c.Batch.Lines, "kafka.batch.lines", DefaultBatchLines, "The most lines to pack into a Kafka message")
+	fs.IntVar(&c.Batch.Bytes, "kafka.batch.bytes", 0, "The most bytes to pack into a Kafka message; defaults to the producer's max message size")
+	fs.DurationVar(&c.Batch.Linger, "kafka.batch.linger", 0, "How long a partial batch may wait for more lines; if 0, batches are sent at the end of each request")
+
+	fs.StringVar(&c.Spool.Dir, "spool.dir", "", "Directory to spool messages to while Kafka is unavailable; disabled if empty")
+	fs.Int64Var(&c.Spool.SegmentBytes, "spool.segment.bytes", DefaultSpoolSegmentBytes, "The largest spool segment file")
+	fs.Int64Var(&c.Spool.MaxBytes, "spool.max.bytes", DefaultSpoolMaxBytes, "The most bytes to spool; further messages are dropped")
+	fs.DurationVar(&c.Spool.Deadline, "spool.deadline", DefaultSpoolDeadline, "How long to wait for the producer to take a message before spooling it")
+	fs.DurationVar(&c.Spool.ReplayInterval, "spool.replay.interval", DefaultSpoolReplayInterval, "How often to try replaying spooled messages to Kafka")
+
+	fs.Int64Var(&c.Backpressure.MaxQueueDepth, "backpressure.queue.depth", 0, "Most lines waiting on Kafka before writes are refused with 503; 0 for no limit")
+	fs.Int64Var(&c.Backpressure.MaxInflightBytes, "backpressure.inflight.bytes", 0, "Most request bytes being written at once before writes are refused with 429; 0 for no limit")
+	fs.DurationVar(&c.Backpressure.MaxStall, "backpressure.stall", 0, "How long the producer may keep writes waiting before writes are refused with 503; 0 for no limit")
+	fs.DurationVar(&c.Backpressure.RetryAfter, "backpressure.retry.after", DefaultRetryAfter, "How long refused clients are told to wait before retrying")
+
+	fs.StringVar(&c.RateLimits.By, "ratelimit.by", RateLimitByDatabase, "Limit each database's writes per principal or client_ip, too; per database only if empty")
+	fs.Float64Var(&c.RateLimits.Default.Lines, "ratelimit.lines", 0, "Lines per second each database may write; 0 for no limit")
+	fs.Float64Var(&c.RateLimits.Default.LinesBurst, "ratelimit.lines.burst", 0, "Lines each database may write at once; defaults to a second's worth")
+	fs.Float64Var(&c.RateLimits.Default.Bytes, "ratelimit.bytes", 0, "Bytes per second each database may write; 0 for no limit")
+	fs.Float64Var(&c.RateLimits.Default.BytesBurst, "ratelimit.bytes.burst", 0, "Bytes each database may write at once; defaults to a second's worth")
+
+	fs.Int64Var(&c.Cardinality.Limit, "cardinality.limit", 0, "Most series each database may write within the window; 0 for no limit")
+	fs.DurationVar(&c.Cardinality.Window, "cardinality.window", DefaultCardinalityWindow, "How long a series counts toward the limit after it was last written")
+	fs.StringVar(&c.Cardinality.Action, "cardinality.action", CardinalityReject, "What to do with new series over the limit: reject, or strip_tags")
+	fs.Int64Var(&c.Cardinality.MaxTagValues, "cardinality.tag.values", DefaultMaxTagValues, "Tags with more values than this within the window are stripped from new series over the limit")
+
+	fs.StringVar(&c.DeadLetter.Topic, "deadletter.topic", "", "Kafka topic for lines which couldn't be written; disabled if empty")
+	fs.IntVar(&c.DeadLetter.MaxLineBytes, "deadletter.max.line.bytes", DefaultDeadLetterMaxLineBytes, "The most bytes of each dead-lettered line to keep")
+	fs.Float64Var(&c.DeadLetter.Sample, "deadletter.sample", DefaultDeadLetterSample, "The fraction of lines to dead-letter, up to 1 for every line")
+	fs.Float64Var(&c.DeadLetter.Rate, "deadletter.rate", DefaultDeadLetterRate, "The most lines to dead-letter per second; 0 for no limit")
+
+	fs.DurationVar(&c.Shutdown.Grace, "shutdown.grace", DefaultShutdownGrace, "How long requests being handled have to finish when shutting down")
+	fs.DurationVar(&c.Shutdown.FlushTimeout, "shutdown.flush.timeout", DefaultShutdownFlushTimeout, "How long Kafka has to acknowledge the producer's messages when shutting down")
+
+	fs.StringVar(&c.HTTP.Addr, "http.addr", ":8089", "An HTTP addr to bind to")
+	fs.BoolVar(&c.HTTP.Enabled, "http.enabled", true, "Listen to HTTP addr, if true")
+
+	fs.StringVar(&c.HTTPS.Addr, "https.addr", ":8090", "An HTTPS addr to bind to")
+	fs.BoolVar(&c.HTTPS.Enabled, "https.enabled", false, "Listen to HTTP addr, if true")
+	fs.StringVar(&c.HTTPS.CertificatePath, "https.certificate", "", "Path to a TLS certificate file")
+	fs.StringVar(&c.HTTPS.KeyPath, "https.key", "", "Path to a TLS key file")
+	fs.StringVar(&c.HTTPS.ClientVerify, "https.client.verify", "none", "Client certificate verification: none, optional, or required")
+	fs.Var((*stringSlice)(&c.HTTPS.ClientCertificatePaths), "https.client.certificate", "Path to a PEM bundle of client CA certificates to trust")
+	fs.StringVar(&c.HTTPS.ClientCertificateDir, "https.client.certificate.dir", "", "Path to a directory of .pem, .crt or .cer client CA certificates to trust")
+	fs.DurationVar(&c.HTTPS.CertificateWatch, "https.certificate.watch", 10*time.Second, "How often to reload the TLS certificates if their files change; 0 disables")
+
+	fs.BoolVar(&c.Auth.Enabled, "auth.enabled", false, "Authenticate user, if true")
+	fs.StringVar(&c.Auth.Username, "auth.username", "", "Name of authenticated user")
+	fs.StringVar(&c.Auth.Password, "auth.password", "", "Password of authenticated user")
+	fs.StringVar(&c.Auth.UsersPath, "auth.users", "", "Path to a YAML file of users, with bcrypt-hashed passwords and permitted databases")
+	fs.StringVar(&c.Auth.TokensPath, "auth.tokens", "", "Path to a YAML file of API token hashes, with their names and permitted databases")
+	fs.StringVar(&c.Auth.JWT.KeysPath, "auth.jwt.keys", "", "Path to a JWKS file of keys which may sign JWTs")
+	fs.StringVar(&c.Auth.JWT.Issuer, "auth.jwt.issuer", "", "Issuer JWTs must name in their iss claim")
+	fs.StringVar(&c.Auth.JWT.Audience, "auth.jwt.audience", "", "Audience JWTs must include in their aud claim")
+	fs.StringVar(&c.Auth.JWT.DatabasesClaim, "auth.jwt.databases", "", "JWT claim listing the databases the caller may use; any, if unset")
+	fs.StringVar(&c.Auth.CertificatesPath, "auth.certificates", "", "Path to a YAML file mapping client certificate names to principals and permitted databases")
+
+	fs.StringVar(&c.LogLevel, "log.level", log.InfoLevel.String(), "Logging level: debug, info, warning, error")
+	fs.StringVar(&c.LogFormat, "log.format", LogFormatText, "Logging format: text, json")
 }
 
-func StringToKafkaVersion(version *string) sarama.KafkaVersion {
-	switch strings.ToLower(*version) {
-		case "v0_11_0_0": return sarama.V0_11_0_0
-		case "v0_10_2_0": return sarama.V0_10_2_0
-		case "v0_10_1_0": return sarama.V0_10_1_0
-		case "v0_10_0_1": return sarama.V0_10_0_1
-		case "v0_10_0_0": return sarama.V0_10_0_0
-		case "v0_9_0_1": return sarama.V0_9_0_1
-		case "v0_9_0_0": return sarama.V0_9_0_0
-		case "v0_8_2_2": return sarama.V0_8_2_2
-		case "v0_8_2_1": return sarama.V0_8_2_1
-		case "v0_8_2_0": return sarama.V0_8_2_0
-		default: return sarama.V0_10_0_0
+// Validate checks the whole configuration, returning ConfigErrors listing
+// every problem found.
+func (c *TelepathConfig) Validate() error {
+	errs := append(ConfigErrors(nil), c.envErrors...)
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Brokers == "" {
+		fail("at least one Kafka broker is required")
+	}
+	if !c.AutoKafkaVersion() {
+		if _, err := ParseKafkaVersion(c.KafkaVersion); err != nil {
+			fail("%v", err)
+		}
+	}
+	c.validateProducer(fail)
+	c.validateKafkaSecurity(fail)
+	c.validateSpool(fail)
+	c.validateBackpressure(fail)
+	c.validateRateLimits(fail)
+	c.validateCardinality(fail)
+	c.validateShutdown(fail)
+	c.validateDeadLetter(fail)
+	c.validateRecordHeaders(fail)
+	if _, err := NewTopicTemplate(c.TopicTemplate); err != nil {
+		fail("invalid topic template: %v", err)
+	}
+	if _, err := NewKeyTemplate(c.KeyTemplate); err != nil {
+		fail("invalid key template: %v", err)
+	}
+	if c.Routes != nil && c.RoutesPath != "" {
+		fail("routes and a routes file can't both be given")
+	}
+	if c.Routes != nil {
+		if _, err := NewRouteTable(*c.Routes, nil); err != nil {
+			fail("invalid routes: %v", err)
+		}
+	}
+	if err := validateAckMode(c.AckMode); err != nil {
+		fail("%v", err)
+	}
+	if c.AckTimeout <= 0 {
+		fail("ack timeout must be positive")
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		fail("invalid log level %q", c.LogLevel)
 	}
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		fail("invalid log format %q: use text or json", c.LogFormat)
+	}
+
+	if c.Batch.Lines < 1 {
+		fail("batch lines must be at least 1")
+	}
+	if c.Batch.Bytes < 0 {
+		fail("batch bytes can't be negative")
+	}
+	if c.ConfigWatch < 0 {
+		fail("config watch interval can't be negative")
+	}
+	if c.Batch.Linger < 0 {
+		fail("batch linger can't be negative")
+	}
+
+	if !c.HTTP.Enabled && !c.HTTPS.Enabled {
+		fail("at least one of HTTP and HTTPS must be enabled")
+	}
+	if c.HTTP.Enabled && c.HTTP.Addr == "" {
+		fail("an HTTP addr is required")
+	}
+	if c.HTTPS.Enabled {
+		if c.HTTPS.Addr == "" {
+			fail("an HTTPS addr is required")
+		}
+		if c.HTTPS.CertificatePath == "" || c.HTTPS.KeyPath == "" {
+			fail("HTTPS requires a certificate and key")
+		}
+		if c.HTTPS.CertificateWatch < 0 {
+			fail("certificate watch interval can't be negative")
+		}
+		switch c.HTTPS.ClientVerify {
+		case "none", "optional", "required":
+		default:
+			fail("invalid client verification %q: use none, optional or required", c.HTTPS.ClientVerify)
+		}
+	}
+
+	if c.Auth.Enabled && c.Auth.Username == "" && c.Auth.UsersPath == "" && c.Auth.TokensPath == "" &&
+		c.Auth.JWT.KeysPath == "" && c.Auth.CertificatesPath == "" {
+		fail("authentication requires a username, a users file, a tokens file, JWT keys or a certificates file")
+	}
+	if c.Auth.CertificatesPath != "" && (!c.HTTPS.Enabled || c.HTTPS.ClientVerify == "none") {
+		fail("a certificates file requires HTTPS with client verification")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, ".", "_", -1))
 }
 
 func (ss *stringSlice) String() string {
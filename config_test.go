@@ -1,9 +1,15 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
+	"os"
 	"testing"
-	"github.com/stretchr/testify/assert"
+	"time"
+
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_version_parsing(t *testing.T) {
@@ -71,9 +77,176 @@ func Test_version_parsing(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.label, func(t *testing.T) {
-			actual := StringToKafkaVersion(&c.input)
+			actual, err := ParseKafkaVersion(c.input)
+			require.NoError(t, err)
 			assert.Equal(t, c.expect, actual)
 		})
 	}
 }
 
+
+func Test_config_precedence(t *testing.T) {
+	file, err := ioutil.TempFile("", "telepath")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`
+brokers: file:9092
+topic: file-topic
+key: "{{.SeriesKey}}"
+ack_timeout: 3s
+batch:
+  enabled: true
+  lines: 10
+https:
+  client_certificates: [file.pem]
+auth:
+  username: joe
+  password: secret
+routes:
+  rules:
+    - measurement: cpu
+      topics: [cpu]
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	env := map[string]string{
+		"TELEPATH_TOPIC_NAME":               "env-topic",
+		"TELEPATH_KAFKA_BATCH_LINES":        "20",
+		"TELEPATH_AUTH_PASSWORD":            "hunter2",
+		"TELEPATH_HTTPS_CLIENT_CERTIFICATE": "a.pem,b.pem",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	c := &TelepathConfig{}
+	err = c.parse(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-config", file.Name(),
+		"-kafka.batch.lines", "30",
+		"-kafka.version", "V0_10_2_0",
+	}, lookupEnv)
+	require.NoError(t, err)
+
+	assert.Equal(t, "file:9092", c.Brokers)
+	assert.Equal(t, "env-topic", c.TopicTemplate)
+	assert.Equal(t, "{{.SeriesKey}}", c.KeyTemplate)
+	assert.Equal(t, AckNone, c.AckMode)
+	assert.Equal(t, 3*time.Second, c.AckTimeout)
+	assert.True(t, c.Batch.Enabled)
+	assert.Equal(t, 30, c.Batch.Lines)
+	assert.Equal(t, []string{"a.pem", "b.pem"}, c.HTTPS.ClientCertificatePaths)
+	assert.Equal(t, "joe", c.Auth.Username)
+	assert.Equal(t, "hunter2", c.Auth.Password)
+	assert.Equal(t, sarama.V0_10_2_0, c.Version)
+	require.NotNil(t, c.Routes)
+	assert.Len(t, c.Routes.Rules, 1)
+	assert.NoError(t, c.Validate())
+}
+
+func Test_config_repeated_flags_replace_the_file(t *testing.T) {
+	file, err := ioutil.TempFile("", "telepath")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("https:\n  client_certificates: [file.pem]\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	c := &TelepathConfig{}
+	err = c.parse(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-config", file.Name(),
+		"-https.client.certificate", "a.pem",
+		"-https.client.certificate", "b.pem",
+	}, noEnv)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.pem", "b.pem"}, c.HTTPS.ClientCertificatePaths)
+}
+
+func Test_config_file_from_the_environment(t *testing.T) {
+	file, err := ioutil.TempFile("", "telepath")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("brokers: file:9092\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	lookupEnv := func(name string) (string, bool) {
+		if name == "TELEPATH_CONFIG" {
+			return file.Name(), true
+		}
+		return "", false
+	}
+
+	c := &TelepathConfig{}
+	err = c.parse(flag.NewFlagSet("test", flag.ContinueOnError), nil, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, file.Name(), c.ConfigPath)
+	assert.Equal(t, "file:9092", c.Brokers)
+
+	// The command line still wins.
+	c = &TelepathConfig{}
+	err = c.parse(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", ""}, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, "", c.ConfigPath)
+	assert.Equal(t, "", c.Brokers)
+}
+
+func Test_config_file_with_unknown_fields(t *testing.T) {
+	file, err := ioutil.TempFile("", "telepath")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("brokers: localhost:9092\nbroker: localhost:9092\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	c := &TelepathConfig{}
+	err = c.parse(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", file.Name()}, noEnv)
+	assert.Error(t, err)
+}
+
+func Test_config_validation_reports_every_error(t *testing.T) {
+	env := map[string]string{
+		"TELEPATH_KAFKA_BATCH": "maybe",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	c := &TelepathConfig{}
+	err := c.parse(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-write.ack", "sometimes",
+		"-log.format", "xml",
+		"-https.enabled",
+		"-auth.certificates", "certificates.yaml",
+	}, lookupEnv)
+	require.NoError(t, err)
+
+	err = c.Validate()
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Equal(t, []string{
+		`invalid value "maybe" for TELEPATH_KAFKA_BATCH: parse error`,
+		"at least one Kafka broker is required",
+		`invalid ack mode "sometimes": use none or kafka`,
+		`invalid log format "xml": use text or json`,
+		"HTTPS requires a certificate and key",
+		"a certificates file requires HTTPS with client verification",
+	}, errorStrings(err.(ConfigErrors)))
+}
+
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+func errorStrings(errs []error) []string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return messages
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Dead letter defaults.
+const (
+	DefaultDeadLetterMaxLineBytes = 64 * 1024
+	DefaultDeadLetterSample       = 1
+	DefaultDeadLetterRate         = 1000
+)
+
+// Why a line wasn't dead-lettered.
+const (
+	deadLetterSampled     = "sampled"
+	deadLetterRateLimited = "rate_limited"
+	deadLetterBusy        = "busy"
+	deadLetterFailed      = "failed"
+)
+
+// DeadLetterConfig names a Kafka topic for the lines Telepath couldn't
+// write, so that they can be inspected and replayed.
+type DeadLetterConfig struct {
+	// Topic is disabled when empty.
+	Topic string `yaml:"topic"`
+
+	// MaxLineBytes is the most of each line kept; longer lines are cut
+	// short.
+	MaxLineBytes int `yaml:"max_line_bytes"`
+
+	// Sample is the fraction of lines kept, up to 1, which is every line.
+	Sample float64 `yaml:"sample"`
+
+	// Rate is the most lines kept per second, or no limit when zero.
+	Rate float64 `yaml:"rate"`
+}
+
+// validateDeadLetter reports problems with the dead letter settings.
+func (c *TelepathConfig) validateDeadLetter(fail func(string, ...interface{})) {
+	dl := c.DeadLetter
+	if dl.Topic == "" {
+		return
+	}
+	if dl.MaxLineBytes < 1 {
+		fail("dead letter max line bytes must be at least 1")
+	}
+	if dl.Sample <= 0 || dl.Sample > 1 {
+		fail("dead letter sample must be more than 0, and at most 1")
+	}
+	if dl.Rate < 0 {
+		fail("dead letter rate can't be negative")
+	}
+}
+
+// deadLetterMetadata marks a dead letter, which goes straight to the
+// producer, and isn't dead-lettered again if Kafka refuses it.
+type deadLetterMetadata struct{}
+
+// deadLetter is the JSON sent to the dead letter topic for each line.
+type deadLetter struct {
+	Reason    string    `json:"reason"`
+	Database  string    `json:"db"`
+	Topic     string    `json:"topic,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Error     string    `json:"error"`
+	Line      string    `json:"line"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// deadLetters sends the lines Telepath couldn't write to the dead letter
+// topic. They are sent on a best effort basis: sampled, rate limited, and
+// dropped rather than kept waiting on the producer.
+type deadLetters struct {
+	sync.Mutex
+	DeadLetterConfig
+	input  chan<- *sarama.ProducerMessage
+	bucket tokenBucket
+	closed bool
+	random func() float64
+	now    func() time.Time
+}
+
+// newDeadLetters returns a sender for the config, or nil if there's no
+// dead letter topic.
+func newDeadLetters(config DeadLetterConfig, input chan<- *sarama.ProducerMessage) *deadLetters {
+	if config.Topic == "" {
+		return nil
+	}
+	if config.MaxLineBytes <= 0 {
+		config.MaxLineBytes = DefaultDeadLetterMaxLineBytes
+	}
+	if config.Sample <= 0 {
+		config.Sample = DefaultDeadLetterSample
+	}
+
+	return &deadLetters{
+		DeadLetterConfig: config,
+		input:            input,
+		bucket:           newTokenBucket(config.Rate, config.Rate, time.Now()),
+		random:           rand.Float64,
+		now:              time.Now,
+	}
+}
+
+// Send dead-letters a line dropped from a write.
+func (dl *deadLetters) Send(reason string, from origin, topic string, line []byte, err error) {
+	if dl == nil {
+		return
+	}
+
+	dl.Lock()
+	defer dl.Unlock()
+
+	dl.send(reason, from, topic, line, err)
+}
+
+// Failed dead-letters the lines of a message Kafka refused. Dead letters
+// Kafka refuses are dropped.
+func (dl *deadLetters) Failed(err *sarama.ProducerError) {
+	if dl == nil {
+		return
+	}
+
+	msg := err.Msg
+	value, _ := msg.Value.Encode()
+
+	dl.Lock()
+	defer dl.Unlock()
+
+	switch metadata := msg.Metadata.(type) {
+	case *deadLetterMetadata:
+		metrics.DeadLetterSkippedCount(deadLetterFailed).Inc()
+	case *lineMetadata:
+		dl.send(reasonDeliveryFailed, metadata.origin, msg.Topic, value, err.Err)
+	case *batchMetadata:
+		lines := bytes.Split(value, []byte("\n"))
+		for _, run := range metadata.origins {
+			for i := 0; i < run.lines && len(lines) > 0; i++ {
+				dl.send(reasonDeliveryFailed, run.origin, msg.Topic, lines[0], err.Err)
+				lines = lines[1:]
+			}
+		}
+	}
+}
+
+// Close stops sending dead letters, so that the producer can be closed.
+func (dl *deadLetters) Close() {
+	if dl == nil {
+		return
+	}
+
+	dl.Lock()
+	defer dl.Unlock()
+
+	dl.closed = true
+}
+
+// send must be called with the lock held, so that nothing is sent once
+// closed.
+func (dl *deadLetters) send(reason string, from origin, topic string, line []byte, err error) {
+	if dl.closed {
+		return
+	}
+	if dl.Sample < 1 && dl.random() >= dl.Sample {
+		metrics.DeadLetterSkippedCount(deadLetterSampled).Inc()
+		return
+	}
+	now := dl.now()
+	if dl.bucket.wait(1, now) > 0 {
+		metrics.DeadLetterSkippedCount(deadLetterRateLimited).Inc()
+		return
+	}
+
+	letter := deadLetter{
+		Reason:   reason,
+		Database: from.db,
+		Topic:    topic,
+		Client:   from.client,
+		Error:    err.Error(),
+		Time:     now.UTC(),
+	}
+	if len(line) > dl.MaxLineBytes {
+		line = line[:dl.MaxLineBytes]
+		letter.Truncated = true
+	}
+	letter.Line = string(line)
+
+	value, jsonErr := json.Marshal(letter)
+	if jsonErr != nil {
+		log.WithError(jsonErr).Error("Couldn't encode a dead letter.")
+		return
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:    dl.Topic,
+		Key:      sarama.StringEncoder(from.db),
+		Value:    sarama.ByteEncoder(value),
+		Metadata: &deadLetterMetadata{},
+	}
+	select {
+	case dl.input <- msg:
+		dl.bucket.take(1)
+		metrics.DeadLetterCount(reason).Inc()
+	default:
+		metrics.DeadLetterSkippedCount(deadLetterBusy).Inc()
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_dead_letters_send(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	dl := newDeadLetters(DeadLetterConfig{Topic: "dead", MaxLineBytes: 10}, input)
+	require.NotNil(t, dl)
+	now := time.Unix(1500000000, 0)
+	dl.now = func() time.Time { return now }
+
+	from := origin{db: "test", client: "10.0.0.1"}
+	dl.Send(droppedInvalid, from, "metrics", []byte("foo value="), ErrMissingFieldValue)
+	dl.Send(droppedUnroutable, from, "", []byte("foo value=1 1"), ErrNoRoute)
+	require.Len(t, input, 2)
+
+	msg := <-input
+	assert.Equal(t, "dead", msg.Topic)
+	assert.Equal(t, sarama.StringEncoder("test"), msg.Key)
+	assert.Equal(t, deadLetter{
+		Reason:   droppedInvalid,
+		Database: "test",
+		Topic:    "metrics",
+		Client:   "10.0.0.1",
+		Error:    "missing field value",
+		Line:     "foo value=",
+		Time:     now.UTC(),
+	}, decodeDeadLetter(t, msg))
+
+	// Long lines are cut short.
+	letter := decodeDeadLetter(t, <-input)
+	assert.Equal(t, "foo value=", letter.Line)
+	assert.True(t, letter.Truncated)
+
+	// Nothing is sent once closed.
+	dl.Close()
+	dl.Send(droppedInvalid, from, "metrics", []byte("foo"), ErrMissingFields)
+	assert.Len(t, input, 0)
+}
+
+func Test_dead_letters_bounds(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	dl := newDeadLetters(DeadLetterConfig{Topic: "dead", Sample: 0.5, Rate: 2}, input)
+	samples := []float64{0.1, 0.9, 0.2, 0.3}
+	dl.random = func() float64 {
+		sample := samples[0]
+		samples = samples[1:]
+		return sample
+	}
+
+	// One in two lines is kept, and no more than two a second.
+	for i := 0; i < 4; i++ {
+		dl.Send(droppedInvalid, origin{}, "", []byte("foo"), ErrMissingFields)
+	}
+	assert.Len(t, input, 2)
+
+	// When the producer is busy, dead letters are dropped.
+	dl = newDeadLetters(DeadLetterConfig{Topic: "dead", Sample: 1}, make(chan *sarama.ProducerMessage))
+	dl.Send(droppedInvalid, origin{}, "", []byte("foo"), ErrMissingFields)
+}
+
+func Test_dead_letters_failed_deliveries(t *testing.T) {
+	input := make(chan *sarama.ProducerMessage, 10)
+	dl := newDeadLetters(DeadLetterConfig{Topic: "dead", Sample: 1}, input)
+
+	a, b := origin{db: "a", client: "10.0.0.1"}, origin{db: "b", client: "10.0.0.2"}
+	dl.Failed(&sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{
+			Topic:    "metrics",
+			Value:    sarama.StringEncoder("foo value=1 1"),
+			Metadata: &lineMetadata{origin: a},
+		},
+		Err: sarama.ErrMessageSizeTooLarge,
+	})
+	dl.Failed(&sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{
+			Topic:    "metrics",
+			Value:    sarama.StringEncoder("foo value=2 2\nfoo value=3 3\nfoo value=4 4"),
+			Metadata: &batchMetadata{lines: 3, origins: []originRun{{a, 1}, {b, 2}}},
+		},
+		Err: sarama.ErrMessageSizeTooLarge,
+	})
+
+	// Dead letters aren't dead-lettered again.
+	dl.Failed(&sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{Topic: "dead", Value: sarama.StringEncoder("{}"), Metadata: &deadLetterMetadata{}},
+		Err: sarama.ErrMessageSizeTooLarge,
+	})
+
+	require.Len(t, input, 4)
+	for _, expect := range []struct {
+		db   string
+		line string
+	}{
+		{"a", "foo value=1 1"},
+		{"a", "foo value=2 2"},
+		{"b", "foo value=3 3"},
+		{"b", "foo value=4 4"},
+	} {
+		letter := decodeDeadLetter(t, <-input)
+		assert.Equal(t, reasonDeliveryFailed, letter.Reason)
+		assert.Equal(t, expect.db, letter.Database)
+		assert.Equal(t, "metrics", letter.Topic)
+		assert.Equal(t, expect.line, letter.Line)
+		assert.Equal(t, sarama.ErrMessageSizeTooLarge.Error(), letter.Error)
+	}
+}
+
+func Test_dead_letters_disabled(t *testing.T) {
+	var dl *deadLetters
+	assert.Nil(t, newDeadLetters(DeadLetterConfig{}, nil))
+	dl.Send(droppedInvalid, origin{}, "", []byte("foo"), errors.New("oops"))
+	dl.Close()
+}
+
+func Test_write_handler_dead_letters(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	input := make(chan *sarama.ProducerMessage, 10)
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		topicTemplate: "metrics",
+		deadLetters:   newDeadLetters(DeadLetterConfig{Topic: "dead", Sample: 1}, input),
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foo/write?db=test")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("foo value=1 1\nfoo value=\n"))
+	require.NoError(t, client.Do(&req, &resp))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	require.Len(t, input, 1)
+	letter := decodeDeadLetter(t, <-input)
+	assert.Equal(t, droppedInvalid, letter.Reason)
+	assert.Equal(t, "test", letter.Database)
+	assert.Equal(t, "metrics", letter.Topic)
+	assert.Equal(t, "foo value=", letter.Line)
+	assert.Equal(t, "missing field value", letter.Error)
+	assert.NotEmpty(t, letter.Client)
+}
+
+func Test_dead_letter_config_validation(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-deadletter.topic", "dead",
+		"-deadletter.sample", "2",
+	}, noEnv)
+	require.Error(t, err)
+	assert.Equal(t, "dead letter sample must be more than 0, and at most 1", err.Error())
+}
+
+func decodeDeadLetter(t *testing.T, msg *sarama.ProducerMessage) deadLetter {
+	value, err := msg.Value.Encode()
+	require.NoError(t, err)
+
+	var letter deadLetter
+	require.NoError(t, json.Unmarshal(value, &letter))
+	return letter
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const AckNone = "none"
+const AckKafka = "kafka"
+
+const DefaultAckTimeout = 10 * time.Second
+
+// deliveryTracker follows the messages produced for a single write
+// request, until Kafka has acknowledged or rejected every one of them.
+type deliveryTracker struct {
+	sync.Mutex
+	pending   int
+	succeeded int
+	failed    int
+	sealed    bool
+	err       error
+	done      chan struct{}
+	written   map[topicPartition]*partitionOffsets
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type partitionOffsets struct {
+	Topic       string `json:"topic"`
+	Partition   int32  `json:"partition"`
+	FirstOffset int64  `json:"first_offset"`
+	LastOffset  int64  `json:"last_offset"`
+	Lines       int    `json:"lines"`
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		done:    make(chan struct{}),
+		written: make(map[topicPartition]*partitionOffsets),
+	}
+}
+
+// Add records a message which is about to be produced.
+func (dt *deliveryTracker) Add() {
+	dt.Lock()
+	defer dt.Unlock()
+
+	dt.pending++
+}
+
+// Seal marks the end of the request; no more messages will be added.
+func (dt *deliveryTracker) Seal() {
+	dt.Lock()
+	defer dt.Unlock()
+
+	dt.sealed = true
+	dt.complete()
+}
+
+func (dt *deliveryTracker) Success(msg *sarama.ProducerMessage) {
+	dt.Lock()
+	defer dt.Unlock()
+
+	key := topicPartition{msg.Topic, msg.Partition}
+	if offsets, ok := dt.written[key]; ok {
+		if msg.Offset < offsets.FirstOffset {
+			offsets.FirstOffset = msg.Offset
+		}
+		if msg.Offset > offsets.LastOffset {
+			offsets.LastOffset = msg.Offset
+		}
+		offsets.Lines++
+	} else {
+		dt.written[key] = &partitionOffsets{
+			Topic:       msg.Topic,
+			Partition:   msg.Partition,
+			FirstOffset: msg.Offset,
+			LastOffset:  msg.Offset,
+			Lines:       1,
+		}
+	}
+
+	dt.succeeded++
+	dt.pending--
+	dt.complete()
+}
+
+func (dt *deliveryTracker) Failure(err *sarama.ProducerError) {
+	dt.Lock()
+	defer dt.Unlock()
+
+	if dt.err == nil {
+		dt.err = err.Err
+	}
+
+	dt.failed++
+	dt.pending--
+	dt.complete()
+}
+
+// Wait blocks until every message has been acknowledged, or the timeout
+// has passed. It returns false on timeout.
+func (dt *deliveryTracker) Wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-dt.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Result returns counts of the acknowledged, failed and outstanding
+// messages, along with the first error returned by Kafka.
+func (dt *deliveryTracker) Result() (succeeded, failed, pending int, err error) {
+	dt.Lock()
+	defer dt.Unlock()
+
+	return dt.succeeded, dt.failed, dt.pending, dt.err
+}
+
+// Offsets lists the range of offsets written to each partition.
+func (dt *deliveryTracker) Offsets() []partitionOffsets {
+	dt.Lock()
+	defer dt.Unlock()
+
+	offsets := make([]partitionOffsets, 0, len(dt.written))
+	for _, o := range dt.written {
+		offsets = append(offsets, *o)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool {
+		if offsets[i].Topic != offsets[j].Topic {
+			return offsets[i].Topic < offsets[j].Topic
+		}
+		return offsets[i].Partition < offsets[j].Partition
+	})
+
+	return offsets
+}
+
+// origin is the write request the lines in a message arrived in, so that
+// they can be described in record headers, and dead-lettered if Kafka
+// refuses them.
+type origin struct {
+	db        string
+	client    string
+	principal string
+	precision string
+	received  time.Time
+	requestID string
+}
+
+// lineMetadata travels with an unbatched message.
+type lineMetadata struct {
+	tracker *deliveryTracker
+	origin  origin
+}
+
+// acknowledge reports the outcome of a produced message to the requests
+// waiting on it. Failures are reported with a non-nil err.
+func acknowledge(msg *sarama.ProducerMessage, err *sarama.ProducerError) {
+	switch metadata := msg.Metadata.(type) {
+	case *deliveryTracker:
+		metadata.acknowledge(msg, err)
+	case *lineMetadata:
+		if metadata.tracker != nil {
+			metadata.tracker.acknowledge(msg, err)
+		}
+	case *batchMetadata:
+		for _, tracker := range metadata.trackers {
+			tracker.acknowledge(msg, err)
+		}
+	case *replayMetadata:
+		metadata.tracker.acknowledge(msg, err)
+	}
+}
+
+func (dt *deliveryTracker) acknowledge(msg *sarama.ProducerMessage, err *sarama.ProducerError) {
+	if err != nil {
+		dt.Failure(err)
+	} else {
+		dt.Success(msg)
+	}
+}
+
+// complete must be called with the lock held.
+func (dt *deliveryTracker) complete() {
+	if dt.sealed && dt.pending == 0 {
+		select {
+		case <-dt.done:
+		default:
+			close(dt.done)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/Nordstrom/telepath/middleware"
 	"github.com/Shopify/sarama"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxtoacart/bpool"
@@ -35,8 +39,25 @@ const BytePoolCount = 128
 type writeHandler struct {
 	bytePool    *bpool.BytePool
 	maxBodySize int
+	ackMode     string
+	ackTimeout  time.Duration
 	producer    sarama.AsyncProducer
-	tt          *topicTemplate
+	batcher     *batcher
+	queue       *producerQueue
+	admission   *admission
+	limiter     *rateLimiter
+	cardinality *cardinalityGuard
+	deadLetters *deadLetters
+	headers     recordHeaders
+	routing     atomic.Value
+}
+
+// writeRouting decides where each point is produced. It is replaced as a
+// whole when the configuration is reloaded.
+type writeRouting struct {
+	tt     *topicTemplate
+	kt     *keyTemplate
+	routes *routeTable
 }
 
 type writeConfig struct {
@@ -44,7 +65,23 @@ type writeConfig struct {
 	maxLineSize   int
 	maxChunkSize  int
 	bytePoolCount int
+	ackMode       string
+	ackTimeout    time.Duration
 	topicTemplate string
+	keyTemplate   string
+	routes        *RoutesConfig
+	queue         *producerQueue
+	backpressure  BackpressureConfig
+	rateLimits    RateLimitConfig
+	cardinality   CardinalityConfig
+	deadLetters   *deadLetters
+	recordHeaders recordHeaders
+
+	batch           bool
+	batchLines      int
+	batchBytes      int
+	batchLinger     time.Duration
+	maxMessageBytes int
 }
 
 func NewWriteHandler(producer sarama.AsyncProducer, config writeConfig) (*writeHandler, error) {
@@ -64,120 +101,531 @@ func NewWriteHandler(producer sarama.AsyncProducer, config writeConfig) (*writeH
 	if bytePoolCount < 1 {
 		bytePoolCount = BytePoolCount
 	}
+	ackMode := config.ackMode
+	if ackMode == "" {
+		ackMode = AckNone
+	}
+	if err := validateAckMode(ackMode); err != nil {
+		return nil, err
+	}
+	ackTimeout := config.ackTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = DefaultAckTimeout
+	}
 
-	template, err := NewTopicTemplate(config.topicTemplate)
+	routing, err := newWriteRouting(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &writeHandler{
+	queue := config.queue
+	if queue == nil {
+		queue = newProducerQueue(producer.Input(), nil)
+	}
+	backpressure := config.backpressure
+	if backpressure.RetryAfter <= 0 {
+		backpressure.RetryAfter = DefaultRetryAfter
+	}
+
+	var batcher *batcher
+	if config.batch {
+		maxMessageBytes := config.maxMessageBytes
+		if maxMessageBytes < 1 {
+			maxMessageBytes = sarama.NewConfig().Producer.MaxMessageBytes
+		}
+		batcher = newBatcher(producer.Input(), config.batchLines, config.batchBytes,
+			maxMessageBytes, config.batchLinger)
+		batcher.queue = queue
+	}
+
+	wh := &writeHandler{
 		maxBodySize: maxBodySize,
 		bytePool:    bpool.NewBytePool(bytePoolCount, maxChunkSize),
+		ackMode:     ackMode,
+		ackTimeout:  ackTimeout,
 		producer:    producer,
-		tt:          template,
-	}, nil
+		batcher:     batcher,
+		queue:       queue,
+		admission:   &admission{BackpressureConfig: backpressure, queue: queue},
+		limiter:     newRateLimiter(config.rateLimits),
+		cardinality: newCardinalityGuard(config.cardinality),
+		deadLetters: config.deadLetters,
+		headers:     config.recordHeaders,
+	}
+	wh.SetRouting(routing)
+
+	return wh, nil
 }
 
+func newWriteRouting(config writeConfig) (*writeRouting, error) {
+	tt, err := NewTopicTemplate(config.topicTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	kt, err := NewKeyTemplate(config.keyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes *routeTable
+	if config.routes != nil {
+		routes, err = NewRouteTable(*config.routes, tt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &writeRouting{tt, kt, routes}, nil
+}
+
+// SetRouting swaps in new routing. Requests in flight finish with the
+// routing they started with.
+func (wh *writeHandler) SetRouting(routing *writeRouting) {
+	wh.routing.Store(routing)
+}
+
+// Close flushes any batched lines to the producer.
+func (wh *writeHandler) Close() {
+	if wh.batcher != nil {
+		wh.batcher.Close()
+	}
+}
+
+// Handle serves the InfluxDB 1.x /write endpoint.
 func (wh *writeHandler) Handle(ctx *fasthttp.RequestCtx) {
+	wh.handle(ctx, influxV1)
+}
+
+// HandleV2 serves the InfluxDB 2.x /api/v2/write endpoint.
+func (wh *writeHandler) HandleV2(ctx *fasthttp.RequestCtx) {
+	wh.handle(ctx, influxV2)
+}
+
+func (wh *writeHandler) handle(ctx *fasthttp.RequestCtx, api influxAPI) {
 	start := time.Now()
-	wh.handlePayload(ctx)
+	wh.handlePayload(ctx, api)
 
 	metrics.WriteRequestTime(ctx.Method(), ctx.Response.StatusCode()).
 		Observe(Microseconds(time.Since(start)))
 	metrics.WriteRequestSize(ctx.Method(), ctx.Response.StatusCode()).
 		Observe(float64(ctx.Request.Header.ContentLength()))
 	metrics.WriteRequestCount(ctx.Method(), ctx.Response.StatusCode()).Inc()
+	if principal := middleware.PrincipalFrom(ctx); principal != nil {
+		metrics.WritePrincipalRequestCount(principal.Method, principal.Name, ctx.Response.StatusCode()).Inc()
+	}
 }
 
-func (wh *writeHandler) handlePayload(ctx *fasthttp.RequestCtx) {
+func (wh *writeHandler) handlePayload(ctx *fasthttp.RequestCtx, api influxAPI) {
 	if !ctx.IsPost() {
-		ctx.SetStatusCode(http.StatusBadRequest)
+		rejectWrite(ctx, api, "", http.StatusBadRequest, reasonMethod,
+			fmt.Sprintf("%s method is not supported", ctx.Method()))
 		return
 	}
 
 	contentLength := ctx.Request.Header.ContentLength()
 	if contentLength > wh.maxBodySize {
-		ctx.SetStatusCode(http.StatusRequestEntityTooLarge)
+		rejectWrite(ctx, api, "", http.StatusRequestEntityTooLarge, reasonTooLarge,
+			fasthttp.StatusMessage(http.StatusRequestEntityTooLarge))
 		return
 	}
 
-	var db string
-	if param := ctx.QueryArgs().Peek("db"); param != nil {
-		db = string(param)
+	params, reason, err := api.params(ctx.QueryArgs())
+	db := params.db
+	if err != nil {
+		rejectWrite(ctx, api, db, http.StatusBadRequest, reason, err.Error())
+		return
 	}
-	if db == "" {
-		ctx.SetStatusCode(http.StatusBadRequest)
+
+	ackMode := wh.ackMode
+	if param := ctx.QueryArgs().Peek("ack"); param != nil {
+		ackMode = string(param)
+	}
+	if err := validateAckMode(ackMode); err != nil {
+		rejectWrite(ctx, api, db, http.StatusBadRequest, reasonInvalidAck,
+			err.Error())
 		return
 	}
 
-	precision := "ns"
-	if param := ctx.QueryArgs().Peek("precision"); param != nil {
-		precision = string(param)
+	// Turn the write away now if Kafka can't keep up, rather than have it
+	// wait on the producer.
+	size := int64(len(ctx.Request.Body()))
+	if rejected := wh.admission.Admit(size); rejected != nil {
+		setRetryAfter(ctx, rejected.retryAfter)
+		rejectWrite(ctx, api, db, rejected.status, rejected.reason, rejected.message)
+		return
 	}
+	defer wh.admission.Release(size)
 
 	contentEncoding := "text/plain"
 	if header := ctx.Request.Header.Peek("Content-Encoding"); header != nil {
 		contentEncoding = string(header)
 	}
 
-	var reader io.Reader
-	if string(contentEncoding) != "gzip" {
-		reader = bytes.NewReader(ctx.Request.Body())
-	} else {
-		body, err := ctx.Request.BodyGunzip()
+	body := ctx.Request.Body()
+	if string(contentEncoding) == "gzip" {
+		body, err = ctx.Request.BodyGunzip()
 		if err != nil {
 			log.WithError(err).WithFields(
-				log.Fields{db: db}).Error("Couldn't gunzip the payload.")
-			ctx.SetStatusCode(http.StatusBadRequest)
+				log.Fields{"db": db}).Error("Couldn't gunzip the payload.")
+			rejectWrite(ctx, api, db, http.StatusBadRequest, reasonInvalidEncoding,
+				fmt.Sprintf("unable to decode gzip body: %v", err))
+			return
+		}
+	}
+	if len(body) == 0 {
+		rejectWrite(ctx, api, db, http.StatusBadRequest, reasonEmptyBody,
+			"request body is empty")
+		return
+	}
+
+	if wh.limiter != nil {
+		client := wh.limiter.Client(middleware.User(ctx), ctx.RemoteIP().String())
+		lines := bytes.Count(body, []byte("\n"))
+		if body[len(body)-1] != '\n' {
+			lines++
+		}
+		if rejected := wh.limiter.Allow(db, client, lines, len(body)); rejected != nil {
+			setRetryAfter(ctx, rejected.retryAfter)
+			rejectWrite(ctx, api, db, rejected.status, rejected.reason, rejected.message)
 			return
 		}
+	}
+	reader := bytes.NewReader(body)
 
-		reader = bytes.NewReader(body)
+	requestParams := pointParams{
+		Database: db,
+		Org:      params.org,
+		Bucket:   params.bucket,
+		User:     middleware.User(ctx),
 	}
 
-	topic, err := wh.tt.Execute(db)
-	if err != nil {
-		log.WithError(err).WithFields(
-			log.Fields{db: db}).Error("Couldn't build a topic.")
-		ctx.SetStatusCode(http.StatusBadRequest)
-		return
+	// Unless the topic depends on each point, or is routed by rules, every
+	// line in the request goes to the same topic.
+	routing := wh.routing.Load().(*writeRouting)
+	var topic string
+	if routing.routes == nil && !routing.tt.PointAware() {
+		topic, err = routing.tt.Execute(requestParams)
+		if err != nil {
+			log.WithError(err).WithFields(
+				log.Fields{"db": db}).Error("Couldn't build a topic.")
+			rejectWrite(ctx, api, db, http.StatusBadRequest, reasonInvalidTopic,
+				fmt.Sprintf("unable to build a topic: %v", err))
+			return
+		}
 	}
 
 	log.WithFields(log.Fields{
 		"db":               db,
-		"precision":        precision,
+		"precision":        params.precision,
+		"ack":              ackMode,
 		"topic":            topic,
 		"content-length":   contentLength,
 		"content-encoding": contentEncoding,
+		"principal":        middleware.User(ctx),
 	}).Debugf("Handling payload for '%s' database.", db)
 
 	buffer := wh.bytePool.Get()
 	defer wh.bytePool.Put(buffer)
 
+	var tracker *deliveryTracker
+	if ackMode == AckKafka {
+		tracker = newDeliveryTracker()
+	}
+
+	from := origin{
+		db:        db,
+		client:    ctx.RemoteIP().String(),
+		principal: middleware.User(ctx),
+		precision: params.precision,
+		received:  time.Now(),
+	}
+	if wh.headers.Has(HeaderRequestID) {
+		from.requestID = requestID(ctx.Request.Header.Peek("X-Request-Id"))
+		ctx.Response.Header.Set("X-Request-Id", from.requestID)
+	}
+	headers := wh.headers.Build(from)
+
 	var payloadSize int64
-	parser := NewLineParser(buffer, precision)
+	var written, dropped int
+	var lineError error
+	lineReason := reasonUnparsable
+	parser := NewLineParser(buffer, params.precision)
 	for {
-		line, err := parser.Next(reader)
+		point, err := parser.NextPoint(reader)
 		if err == io.EOF {
 			break
 		}
 
 		metrics.InfluxTotalLineCount(db).Inc()
 		if err != nil {
-			metrics.InfluxDroppedLineCount(db).Inc()
+			dropped++
+			if lineError == nil {
+				lineError = err
+			}
+
+			metrics.InfluxDroppedLineCount(db, droppedInvalid).Inc()
+			log.WithError(err).WithFields(
+				log.Fields{"db": db}).Debug("Dropped an invalid line.")
+			if parseErr, ok := err.(*ParseError); ok {
+				wh.deadLetters.Send(droppedInvalid, from, topic, []byte(parseErr.Line), parseErr.Err)
+			}
+			continue
+		}
+
+		if wh.cardinality != nil {
+			stripped, err := wh.cardinality.Check(db, point)
+			if err != nil {
+				dropped++
+				if lineError == nil {
+					lineError, lineReason = err, reasonSeriesLimit
+				}
+
+				metrics.InfluxDroppedLineCount(db, droppedSeriesLimit).Inc()
+				log.WithError(err).WithFields(
+					log.Fields{"db": db}).Debug("Dropped a line with a new series.")
+				wh.deadLetters.Send(droppedSeriesLimit, from, topic, point.Line(), err)
+				continue
+			}
+			if stripped != nil {
+				log.WithFields(log.Fields{
+					"db":   db,
+					"tags": stripped,
+				}).Debug("Stripped tags from a line with a new series.")
+			}
+		}
+
+		line := point.Line()
+		pointParams := requestParams
+		pointParams.point = point
+
+		destinations, err := routing.route(pointParams, topic)
+		if err != nil {
+			wh.deadLetters.Send(droppedUnroutable, from, topic, line, err)
+			if err == ErrNoRoute {
+				err = fmt.Errorf("unable to route '%s': %v", line, err)
+			} else {
+				err = fmt.Errorf("unable to build a topic for '%s': %v", line, err)
+			}
+			dropped++
+			if lineError == nil {
+				lineError = err
+			}
+
+			metrics.InfluxDroppedLineCount(db, droppedUnroutable).Inc()
+			log.WithError(err).WithFields(
+				log.Fields{"db": db}).Debug("Dropped an unroutable line.")
+			continue
+		}
+		if len(destinations) == 0 {
+			log.WithFields(log.Fields{"db": db}).Debug("Dropped an unmatched line.")
 			continue
 		}
 
+		msgs := make([]*sarama.ProducerMessage, len(destinations))
+		for i, dest := range destinations {
+			msg := &sarama.ProducerMessage{
+				Topic:     dest.topic,
+				Value:     sarama.ByteEncoder(line),
+				Headers:   headers,
+				Timestamp: time.Unix(0, point.Time),
+			}
+			kt := routing.kt
+			if dest.kt != nil {
+				kt = dest.kt
+			}
+			if kt != nil {
+				msg.Key = messageKey(kt, pointParams)
+			}
+			msgs[i] = msg
+		}
+
+		if err := wh.batchable(msgs); err != nil {
+			wh.deadLetters.Send(droppedTooLarge, from, topic, line, err)
+			err = fmt.Errorf("unable to batch '%s': %v", line, err)
+			dropped++
+			if lineError == nil {
+				lineError, lineReason = err, reasonTooLarge
+			}
+
+			metrics.InfluxDroppedLineCount(db, droppedTooLarge).Inc()
+			log.WithError(err).WithFields(
+				log.Fields{"db": db}).Debug("Dropped a line too long to batch.")
+			continue
+		}
+
+		written++
 		payloadSize = payloadSize + int64(len(line))
 		metrics.InfluxLineLength(db).Observe(float64(len(line)))
 
-		wh.producer.Input() <- &sarama.ProducerMessage{
-			Topic: topic,
-			Value: sarama.ByteEncoder(line),
+		for _, msg := range msgs {
+			wh.produce(msg, tracker, from)
 		}
 	}
 
-	ctx.SetStatusCode(http.StatusNoContent)
+	// Without a linger interval, batches don't outlive their request. We
+	// won't keep a client waiting on Kafka for the interval, either.
+	if wh.batcher != nil && (wh.batcher.linger == 0 || tracker != nil) {
+		wh.batcher.Flush()
+	}
+
 	metrics.InfluxPayloadCount(db).Inc()
 	metrics.InfluxPayloadSize(db).Observe(float64(payloadSize))
+
+	if tracker != nil {
+		tracker.Seal()
+		if !wh.awaitDelivery(ctx, api, db, tracker) {
+			return
+		}
+	}
+
+	// Like InfluxDB, we'll only report the first invalid line.
+	if written == 0 && lineError != nil {
+		rejectWrite(ctx, api, db, http.StatusBadRequest, lineReason,
+			lineError.Error())
+		return
+	}
+	if dropped > 0 {
+		rejectWrite(ctx, api, db, http.StatusBadRequest, reasonPartialWrite,
+			fmt.Sprintf("partial write: %v dropped=%d", lineError, dropped))
+		return
+	}
+
+	if tracker != nil && ctx.QueryArgs().Has("offsets") {
+		body, _ := json.Marshal(offsetsResponse{tracker.Offsets()})
+
+		ctx.Response.Header.Set("Content-Type", "application/json")
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetBody(body)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusNoContent)
+}
+
+// batchable returns an error if the line in the messages is too long to be
+// batched for any of them.
+func (wh *writeHandler) batchable(msgs []*sarama.ProducerMessage) error {
+	if wh.batcher == nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if err := wh.batcher.Fits(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wh *writeHandler) produce(msg *sarama.ProducerMessage, tracker *deliveryTracker, from origin) {
+	if tracker != nil {
+		tracker.Add()
+	}
+
+	if wh.batcher != nil {
+		wh.batcher.Add(msg, tracker, from)
+		return
+	}
+
+	msg.Metadata = &lineMetadata{tracker, from}
+	wh.queue.Produce(msg)
+}
+
+// route returns the destinations for a point: those chosen by the routing
+// rules, or else the topic template's.
+func (r *writeRouting) route(params pointParams, topic string) ([]destination, error) {
+	if r.routes != nil {
+		return r.routes.Route(params)
+	}
+
+	if r.tt.PointAware() {
+		var err error
+		if topic, err = r.tt.Execute(params); err != nil {
+			return nil, err
+		}
+	}
+
+	return []destination{{topic: topic}}, nil
+}
+
+// Build the message key for a point, so the hash partitioner can keep
+// each series on one partition. Unkeyed messages are spread randomly.
+func messageKey(kt *keyTemplate, params pointParams) sarama.Encoder {
+	key, err := kt.Execute(params)
+	if err != nil {
+		log.WithError(err).WithFields(
+			log.Fields{"db": params.Database}).Error("Couldn't build a message key.")
+		return nil
+	}
+	if len(key) == 0 {
+		return nil
+	}
+
+	return sarama.ByteEncoder(key)
+}
+
+// Wait for Kafka to acknowledge every line sent for this request,
+// responding with an error if any of them failed or took too long.
+func (wh *writeHandler) awaitDelivery(ctx *fasthttp.RequestCtx, api influxAPI, db string, tracker *deliveryTracker) bool {
+	if !tracker.Wait(wh.ackTimeout) {
+		_, _, pending, _ := tracker.Result()
+		rejectWrite(ctx, api, db, http.StatusGatewayTimeout, reasonDeliveryTimeout,
+			fmt.Sprintf("timeout waiting for Kafka to acknowledge %d lines", pending))
+		return false
+	}
+
+	if _, failed, _, err := tracker.Result(); failed > 0 {
+		rejectWrite(ctx, api, db, http.StatusInternalServerError, reasonDeliveryFailed,
+			fmt.Sprintf("unable to write %d lines to Kafka: %v", failed, err))
+		return false
+	}
+
+	return true
+}
+
+func validateAckMode(mode string) error {
+	if mode != AckNone && mode != AckKafka {
+		return fmt.Errorf("invalid ack mode %q: use %s or %s", mode, AckNone, AckKafka)
+	}
+	return nil
+}
+
+// Reasons for rejecting some or all of a write request
+const (
+	reasonMethod           = "method"
+	reasonMissingDatabase  = "missing_database"
+	reasonTooLarge         = "too_large"
+	reasonInvalidPrecision = "invalid_precision"
+	reasonInvalidAck       = "invalid_ack"
+	reasonInvalidEncoding  = "invalid_encoding"
+	reasonEmptyBody        = "empty_body"
+	reasonInvalidTopic     = "invalid_topic"
+	reasonUnparsable       = "unparsable"
+	reasonPartialWrite     = "partial_write"
+	reasonDeliveryFailed   = "delivery_failed"
+	reasonDeliveryTimeout  = "delivery_timeout"
+	reasonQueueFull        = "queue_full"
+	reasonProducerStalled  = "producer_stalled"
+	reasonInflightBytes    = "inflight_bytes"
+	reasonRateLimited      = "rate_limited"
+	reasonSeriesLimit      = "series_limit"
+)
+
+// Reasons for dropping a line from a write
+const (
+	droppedInvalid     = "invalid"
+	droppedUnroutable  = "unroutable"
+	droppedSeriesLimit = "series_limit"
+	droppedTooLarge    = "too_large"
+)
+
+type offsetsResponse struct {
+	Results []partitionOffsets `json:"results"`
+}
+
+// Respond to a write the same way InfluxDB does, with a JSON error
+// message in the body.
+func rejectWrite(ctx *fasthttp.RequestCtx, api influxAPI, db string, status int, reason, message string) {
+	api.reject(ctx, status, message)
+	metrics.WriteErrorCount(db, reason).Inc()
 }
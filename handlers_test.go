@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
@@ -11,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Nordstrom/telepath/middleware"
 	"github.com/Shopify/sarama"
 	"github.com/Shopify/sarama/mocks"
 	"github.com/stretchr/testify/assert"
@@ -85,10 +87,11 @@ func Test_write_handler_with_empty_payload(t *testing.T) {
 	client, teardown := newClient(makeWriteHandler(p, writeConfig{}))
 	defer teardown()
 
-	statusCode, _, err := client.Post(nil, "http://foo/write?db=test", nil)
+	statusCode, body, err := client.Post(nil, "http://foo/write?db=test", nil)
 
 	assert.NoError(t, err)
-	assert.Equal(t, http.StatusNoContent, statusCode)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, `{"error":"request body is empty"}`, string(body))
 }
 
 func Test_write_handler_sequential_payloads(t *testing.T) {
@@ -167,6 +170,13 @@ func Test_write_handler_with_metrics(t *testing.T) {
 				"multiple_metrics,x=z value=1 1494462271",
 			},
 		},
+		{
+			url:  "http://foo/write?db=test",
+			body: []byte("escaped_metric,x=a\\ b msg=\"c d\" 1494462271\n"),
+			lines: []string{
+				"escaped_metric,x=a\\ b msg=\"c d\" 1494462271",
+			},
+		},
 		{
 			url:  "http://foo/write?db=test&precision=s",
 			body: []byte("upscale_from_seconds_metric,x=y value=1 6494462272\n"),
@@ -232,24 +242,102 @@ func Test_write_handler_with_oversized_payload(t *testing.T) {
 }
 
 func Test_write_handler_with_oversized_metric_line(t *testing.T) {
-	t.Skip("Not implemented")
-	//p := mocks.NewAsyncProducer(t, nil)
-	//defer p.Close()
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
 
-	//client, teardown := newClient(makeWriteHandler(p, writeConfig{maxLineSize: 32}))
-	//defer teardown()
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{maxLineSize: 32}))
+	defer teardown()
 
-	//var req fasthttp.Request
-	//var resp fasthttp.Response
+	var req fasthttp.Request
+	var resp fasthttp.Response
 
-	//req.SetRequestURI("http://foo/write?db=test")
-	//req.Header.SetMethod("POST")
-	//req.Header.Add("Content-Encoding", "text/plain")
-	//req.SetBody([]byte("foo,x=y very=1 long=2 metric=3 1494462271"))
-	//err := client.Do(&req, &resp)
+	req.SetRequestURI("http://foo/write?db=test")
+	req.Header.SetMethod("POST")
+	req.Header.Add("Content-Encoding", "text/plain")
+	req.SetBody([]byte("foo,x=y very=1 long=2 metric=3 1494462271"))
+	err := client.Do(&req, &resp)
 
-	//assert.NoError(t, err)
-	//assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+}
+
+func Test_write_handler_with_invalid_lines(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+
+	cases := []struct {
+		label string
+		body  string
+		lines []string
+		error string
+	}{
+		{
+			label: "partial write",
+			body:  "valid,x=y value=1 1\ninvalid,x=y value 2\nvalid,x=y value=3 3\ninvalid\n",
+			lines: []string{"valid,x=y value=1 1", "valid,x=y value=3 3"},
+			error: "partial write: unable to parse 'invalid,x=y value 2': missing field value dropped=2",
+		},
+		{
+			label: "nothing written",
+			body:  "invalid,x=y value 1\ninvalid\n",
+			error: "unable to parse 'invalid,x=y value 1': missing field value",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			p := mocks.NewAsyncProducer(t, config)
+			defer p.Close()
+
+			client, teardown := newClient(makeWriteHandler(p, writeConfig{}))
+			defer teardown()
+
+			for _ = range c.lines {
+				p.ExpectInputAndSucceed()
+			}
+
+			var req fasthttp.Request
+			var resp fasthttp.Response
+
+			req.SetRequestURI("http://foo/write?db=test")
+			req.Header.SetMethod("POST")
+			req.SetBody([]byte(c.body))
+			err := client.Do(&req, &resp)
+
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+			assert.Equal(t, "application/json", string(resp.Header.Peek("Content-Type")))
+			assert.Equal(t, c.error, string(resp.Header.Peek("X-Influxdb-Error")))
+
+			var body map[string]string
+			require.NoError(t, json.Unmarshal(resp.Body(), &body))
+			assert.Equal(t, c.error, body["error"])
+
+			for _, line := range c.lines {
+				select {
+				case msg := <-p.Successes():
+					metric, _ := msg.Value.Encode()
+					assert.Equal(t, line, string(metric))
+				case <-time.After(time.Second):
+					t.Fatalf("Timeout while waiting for message from channel")
+				}
+			}
+		})
+	}
+}
+
+func Test_write_handler_with_invalid_precision(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{}))
+	defer teardown()
+
+	statusCode, body, err := client.Post(nil, "http://foo/write?db=test&precision=fortnight", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, `{"error":"invalid precision \"fortnight\": use n, u, ms, s, m or h"}`, string(body))
 }
 
 func Test_write_handler_with_broken_gzip_payload(t *testing.T) {
@@ -272,6 +360,427 @@ func Test_write_handler_with_broken_gzip_payload(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
 }
 
+func Test_write_handler_waits_for_kafka_acks(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+
+	cases := []struct {
+		label   string
+		url     string
+		expect  func(p *mocks.AsyncProducer)
+		status  int
+		body    string
+		timeout time.Duration
+	}{
+		{
+			label: "acknowledged",
+			url:   "http://foo/write?db=test&ack=kafka",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed()
+				p.ExpectInputAndSucceed()
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			label: "acknowledged with offsets",
+			url:   "http://foo/write?db=test&ack=kafka&offsets",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed()
+				p.ExpectInputAndSucceed()
+			},
+			status: http.StatusOK,
+			body:   `{"results":[{"topic":"telepath-influx-metrics","partition":0,"first_offset":1,"last_offset":2,"lines":2}]}`,
+		},
+		{
+			label: "failed",
+			url:   "http://foo/write?db=test&ack=kafka",
+			expect: func(p *mocks.AsyncProducer) {
+				p.ExpectInputAndSucceed()
+				p.ExpectInputAndFail(sarama.ErrNotLeaderForPartition)
+			},
+			status: http.StatusInternalServerError,
+			body:   `{"error":"unable to write 1 lines to Kafka: kafka server: Tried to send a message to a replica that is not the leader for some partition. Your metadata is out of date."}`,
+		},
+		{
+			label: "invalid ack mode",
+			url:   "http://foo/write?db=test&ack=maybe",
+			expect: func(p *mocks.AsyncProducer) {
+			},
+			status: http.StatusBadRequest,
+			body:   `{"error":"invalid ack mode \"maybe\": use none or kafka"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			p := mocks.NewAsyncProducer(t, config)
+			defer p.Close()
+
+			go followProducer(p, nil, nil, nil)
+
+			client, teardown := newClient(makeWriteHandler(p, writeConfig{}))
+			defer teardown()
+
+			c.expect(p)
+
+			var req fasthttp.Request
+			var resp fasthttp.Response
+
+			req.SetRequestURI(c.url)
+			req.Header.SetMethod("POST")
+			req.SetBody([]byte("foo value=1 1\nfoo value=2 2\n"))
+			err := client.Do(&req, &resp)
+
+			require.NoError(t, err)
+			assert.Equal(t, c.status, resp.StatusCode())
+			assert.Equal(t, c.body, string(resp.Body()))
+		})
+	}
+}
+
+func Test_write_handler_times_out_waiting_for_kafka_acks(t *testing.T) {
+	// Without Return.Successes, the mock producer never acknowledges.
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	go followProducer(p, nil, nil, nil)
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		ackMode:    AckKafka,
+		ackTimeout: 10 * time.Millisecond,
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("foo value=1 1\n"))
+	err := client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode())
+	assert.Equal(t, `{"error":"timeout waiting for Kafka to acknowledge 1 lines"}`, string(resp.Body()))
+}
+
+func Test_write_handler_v2(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+
+	cases := []struct {
+		label  string
+		url    string
+		lines  []string
+		topic  string
+		status int
+		body   string
+	}{
+		{
+			label:  "bucket and org",
+			url:    "http://foo/api/v2/write?org=acme&bucket=test&precision=s",
+			lines:  []string{"foo value=1 1000000000"},
+			topic:  "acme-test",
+			status: http.StatusNoContent,
+		},
+		{
+			label:  "default precision",
+			url:    "http://foo/api/v2/write?orgID=acme&bucket=test",
+			lines:  []string{"foo value=1 1"},
+			topic:  "acme-test",
+			status: http.StatusNoContent,
+		},
+		{
+			label:  "missing bucket",
+			url:    "http://foo/api/v2/write?org=acme",
+			status: http.StatusBadRequest,
+			body:   `{"code":"invalid","message":"bucket is required"}`,
+		},
+		{
+			label:  "v1 precision",
+			url:    "http://foo/api/v2/write?org=acme&bucket=test&precision=u",
+			status: http.StatusBadRequest,
+			body:   `{"code":"invalid","message":"invalid precision \"u\": use ns, us, ms or s"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			p := mocks.NewAsyncProducer(t, config)
+			defer p.Close()
+
+			client, teardown := newClient(makeV2WriteHandler(p, writeConfig{
+				topicTemplate: "{{.Org}}-{{.Bucket}}",
+			}))
+			defer teardown()
+
+			for _ = range c.lines {
+				p.ExpectInputAndSucceed()
+			}
+
+			var req fasthttp.Request
+			var resp fasthttp.Response
+
+			req.SetRequestURI(c.url)
+			req.Header.SetMethod("POST")
+			req.SetBody([]byte("foo value=1 1\n"))
+			err := client.Do(&req, &resp)
+
+			require.NoError(t, err)
+			assert.Equal(t, c.status, resp.StatusCode())
+			assert.Equal(t, c.body, string(resp.Body()))
+
+			for _, line := range c.lines {
+				select {
+				case msg := <-p.Successes():
+					metric, _ := msg.Value.Encode()
+					assert.Equal(t, line, string(metric))
+					assert.Equal(t, c.topic, msg.Topic)
+				case <-time.After(time.Second):
+					t.Fatalf("Timeout while waiting for message from channel")
+				}
+			}
+		})
+	}
+}
+
+func Test_write_handler_with_message_keys(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+	defer p.Close()
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		keyTemplate: "{{.Database}}/{{.SeriesKey}}",
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+	p.ExpectInputAndSucceed()
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("foo,y=2,x=1 value=1 1\nbar value=2 2\n"))
+	err := client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	for _, expect := range []string{"test/foo,x=1,y=2", "test/bar"} {
+		select {
+		case msg := <-p.Successes():
+			require.NotNil(t, msg.Key)
+			key, _ := msg.Key.Encode()
+			assert.Equal(t, expect, string(key))
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout while waiting for message from channel")
+		}
+	}
+}
+
+func Test_write_handler_with_point_topics(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+	defer p.Close()
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		topicTemplate: "{{.Database}}-{{.Tag \"env\"}}",
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+	p.ExpectInputAndSucceed()
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("foo,env=prod value=1 1\nfoo,env=a/b value=2 2\nbar,env=dev value=3 3\n"))
+	err := client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t,
+		`{"error":"partial write: unable to build a topic for 'foo,env=a/b value=2 2': Topic name has abnormal characters. dropped=1"}`,
+		string(resp.Body()))
+
+	for _, expect := range []string{"test-prod", "test-dev"} {
+		select {
+		case msg := <-p.Successes():
+			assert.Equal(t, expect, msg.Topic)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout while waiting for message from channel")
+		}
+	}
+}
+
+func Test_write_handler_with_routes(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+	defer p.Close()
+
+	handler := makeWriteHandler(p, writeConfig{
+		routes: &RoutesConfig{
+			Rules: []RuleConfig{
+				{Measurement: "cpu", Topics: []string{"cpu", "audit"}, Continue: true},
+				{User: "joe", Topics: []string{"joe"}},
+			},
+			Unmatched: UnmatchedReject,
+		},
+	})
+	client, teardown := newClient(middleware.Auth(handler, &middleware.AuthConfig{
+		Enabled:  true,
+		Username: "joe",
+		Password: "secret",
+	}))
+	defer teardown()
+
+	for i := 0; i < 4; i++ {
+		p.ExpectInputAndSucceed()
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test&u=joe&p=secret")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("cpu value=1 1\nmem value=2 2\n"))
+	err := client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	for _, expect := range []string{"cpu", "audit", "joe", "joe"} {
+		select {
+		case msg := <-p.Successes():
+			assert.Equal(t, expect, msg.Topic)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout while waiting for message from channel")
+		}
+	}
+}
+
+func Test_write_handler_with_unmatched_routes(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+	defer p.Close()
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		routes: &RoutesConfig{
+			Rules:     []RuleConfig{{Measurement: "cpu", Topics: []string{"cpu"}}},
+			Unmatched: UnmatchedReject,
+		},
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("cpu value=1 1\nmem value=2 2\n"))
+	err := client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t,
+		`{"error":"partial write: unable to route 'mem value=2 2': no route matches the point dropped=1"}`,
+		string(resp.Body()))
+
+	select {
+	case msg := <-p.Successes():
+		assert.Equal(t, "cpu", msg.Topic)
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout while waiting for message from channel")
+	}
+}
+
+func Test_write_handler_with_batching(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+	defer p.Close()
+
+	go followProducer(p, nil, nil, nil)
+
+	wh, err := NewWriteHandler(p, writeConfig{
+		batch:       true,
+		batchLines:  2,
+		keyTemplate: "{{.Measurement}}",
+	})
+	require.NoError(t, err)
+	defer wh.Close()
+
+	client, teardown := newClient(wh.Handle)
+	defer teardown()
+
+	p.ExpectInputWithCheckerFunctionAndSucceed(expectValue("foo value=1 1\nfoo value=2 2"))
+	p.ExpectInputWithCheckerFunctionAndSucceed(expectValue("bar value=3 3"))
+	p.ExpectInputWithCheckerFunctionAndSucceed(expectValue("foo value=4 4"))
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test&ack=kafka&offsets")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("foo value=1 1\nfoo value=2 2\nbar value=3 3\nfoo value=4 4\n"))
+	err = client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	var body offsetsResponse
+	require.NoError(t, json.Unmarshal(resp.Body(), &body))
+	require.Len(t, body.Results, 1)
+	assert.Equal(t, 4, body.Results[0].Lines)
+}
+
+func Test_write_handler_drops_lines_too_long_to_batch(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+	defer p.Close()
+
+	go followProducer(p, nil, nil, nil)
+
+	wh, err := NewWriteHandler(p, writeConfig{
+		batch:       true,
+		batchBytes:  20,
+		keyTemplate: "{{.Measurement}}",
+	})
+	require.NoError(t, err)
+	defer wh.Close()
+
+	client, teardown := newClient(wh.Handle)
+	defer teardown()
+
+	p.ExpectInputWithCheckerFunctionAndSucceed(expectValue("foo value=1 1"))
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+
+	req.SetRequestURI("http://foo/write?db=test&ack=kafka")
+	req.Header.SetMethod("POST")
+	req.SetBody([]byte("foo value=1 1\nfoo value=123456789012 2\n"))
+	err = client.Do(&req, &resp)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, "partial write: unable to batch 'foo value=123456789012 2': "+
+		"line is longer than the 17 bytes a batch may hold dropped=1", string(resp.Header.Peek("X-Influxdb-Error")))
+}
+
 func newClient(handlerFunc func(*fasthttp.RequestCtx)) (*fasthttp.Client, func()) {
 	server := &fasthttp.Server{
 		Handler: handlerFunc,
@@ -304,6 +813,24 @@ func makeWriteHandler(producer sarama.AsyncProducer, config writeConfig) func(*f
 	return wh.Handle
 }
 
+func makeV2WriteHandler(producer sarama.AsyncProducer, config writeConfig) func(*fasthttp.RequestCtx) {
+	wh, err := NewWriteHandler(producer, config)
+	if err != nil {
+		panic(err)
+	}
+
+	return wh.HandleV2
+}
+
+func expectValue(expect string) func([]byte) error {
+	return func(actual []byte) error {
+		if string(actual) != expect {
+			return fmt.Errorf("expected %q, got %q", expect, actual)
+		}
+		return nil
+	}
+}
+
 func makeGzipString(str string) []byte {
 	var b bytes.Buffer
 	gz := gzip.NewWriter(&b)
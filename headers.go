@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Record headers which can be attached to each message, about the write
+// request its lines arrived in.
+const (
+	HeaderDatabase  = "db"
+	HeaderPrecision = "precision"
+	HeaderPrincipal = "principal"
+	HeaderClientIP  = "client_ip"
+	HeaderReceived  = "received"
+	HeaderRequestID = "request_id"
+)
+
+const DefaultRecordHeaders = "db,precision,principal,client_ip,received,request_id"
+
+// A client's own request ID is used if it isn't longer than this.
+const maxRequestIDLength = 128
+
+var knownHeaders = []string{
+	HeaderDatabase, HeaderPrecision, HeaderPrincipal, HeaderClientIP, HeaderReceived, HeaderRequestID,
+}
+
+// validateRecordHeaders reports headers which aren't known.
+func (c *TelepathConfig) validateRecordHeaders(fail func(string, ...interface{})) {
+	if _, err := parseRecordHeaders(c.RecordHeaders); err != nil {
+		fail("%v", err)
+	}
+}
+
+// recordHeaders names the headers to attach to each message.
+type recordHeaders []string
+
+// parseRecordHeaders reads a comma-separated list of header names.
+func parseRecordHeaders(names string) (recordHeaders, error) {
+	var headers recordHeaders
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !isOneOfStrings(name, knownHeaders) {
+			return nil, fmt.Errorf("invalid record header %q: use %s", name, strings.Join(knownHeaders, ", "))
+		}
+		headers = append(headers, name)
+	}
+	return headers, nil
+}
+
+// kafkaRecordHeaders returns the headers to attach, or none if the Kafka
+// version can't carry them.
+func kafkaRecordHeaders(config *TelepathConfig) recordHeaders {
+	headers, _ := parseRecordHeaders(config.RecordHeaders)
+	if len(headers) > 0 && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		log.WithFields(log.Fields{
+			"version": KafkaVersionString(config.Version),
+		}).Warn("Kafka before 0.11 can't carry record headers; none will be attached.")
+		return nil
+	}
+	return headers
+}
+
+// Has reports whether the named header is attached.
+func (rh recordHeaders) Has(name string) bool {
+	return isOneOfStrings(name, rh)
+}
+
+// Build returns the headers for the lines from a request. Those with
+// nothing to say, such as the principal of an anonymous request, are left
+// out.
+func (rh recordHeaders) Build(from origin) []sarama.RecordHeader {
+	if len(rh) == 0 {
+		return nil
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(rh))
+	for _, name := range rh {
+		var value string
+		switch name {
+		case HeaderDatabase:
+			value = from.db
+		case HeaderPrecision:
+			value = from.precision
+		case HeaderPrincipal:
+			value = from.principal
+		case HeaderClientIP:
+			value = from.client
+		case HeaderReceived:
+			value = from.received.UTC().Format(time.RFC3339Nano)
+		case HeaderRequestID:
+			value = from.requestID
+		}
+		if value != "" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(name), Value: []byte(value)})
+		}
+	}
+	return headers
+}
+
+// requestID returns the client's request ID, from its X-Request-Id header,
+// or else a new random one.
+func requestID(header []byte) string {
+	if len(header) > 0 && len(header) <= maxRequestIDLength {
+		return string(header)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.WithError(err).Error("Couldn't make a request ID.")
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_record_headers_parsing(t *testing.T) {
+	cases := []struct {
+		names  string
+		expect recordHeaders
+	}{
+		{"", nil},
+		{"db", recordHeaders{"db"}},
+		{" db , request_id,", recordHeaders{"db", "request_id"}},
+		{DefaultRecordHeaders, recordHeaders{"db", "precision", "principal", "client_ip", "received", "request_id"}},
+	}
+
+	for _, c := range cases {
+		headers, err := parseRecordHeaders(c.names)
+		require.NoError(t, err)
+		assert.Equal(t, c.expect, headers, c.names)
+	}
+
+	_, err := parseRecordHeaders("db,user")
+	require.Error(t, err)
+	assert.Equal(t, `invalid record header "user": use db, precision, principal, client_ip, received, request_id`, err.Error())
+}
+
+func Test_record_headers_build(t *testing.T) {
+	headers, _ := parseRecordHeaders(DefaultRecordHeaders)
+	from := origin{
+		db:        "test",
+		client:    "10.0.0.1",
+		precision: "ms",
+		received:  time.Unix(1500000000, 5000).In(time.FixedZone("PDT", -7*3600)),
+		requestID: "abc",
+	}
+
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("db"), Value: []byte("test")},
+		{Key: []byte("precision"), Value: []byte("ms")},
+		{Key: []byte("client_ip"), Value: []byte("10.0.0.1")},
+		{Key: []byte("received"), Value: []byte("2017-07-14T02:40:00.000005Z")},
+		{Key: []byte("request_id"), Value: []byte("abc")},
+	}, headers.Build(from), "an anonymous request has no principal")
+
+	assert.Nil(t, recordHeaders(nil).Build(from))
+}
+
+func Test_record_headers_need_kafka_0_11(t *testing.T) {
+	config := &TelepathConfig{RecordHeaders: "db", Version: sarama.V0_10_2_0}
+	assert.Nil(t, kafkaRecordHeaders(config))
+
+	config.Version = sarama.V0_11_0_0
+	assert.Equal(t, recordHeaders{"db"}, kafkaRecordHeaders(config))
+}
+
+func Test_request_id(t *testing.T) {
+	assert.Equal(t, "abc", requestID([]byte("abc")))
+
+	for _, header := range [][]byte{nil, []byte(strings.Repeat("a", maxRequestIDLength+1))} {
+		id := requestID(header)
+		assert.Len(t, id, 32)
+		assert.NotEqual(t, id, requestID(header))
+	}
+}
+
+func Test_write_handler_record_headers(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	input := make(chan *sarama.ProducerMessage, 10)
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		topicTemplate: "metrics",
+		queue:         newProducerQueue(input, nil),
+		recordHeaders: recordHeaders{HeaderDatabase, HeaderPrecision, HeaderRequestID},
+	}))
+	defer teardown()
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foo/write?db=test&precision=s")
+	req.Header.SetMethod("POST")
+	req.Header.Set("X-Request-Id", "abc")
+	req.SetBody([]byte("foo value=1 1500000000"))
+	require.NoError(t, client.Do(&req, &resp))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	assert.Equal(t, "abc", string(resp.Header.Peek("X-Request-Id")))
+
+	require.Len(t, input, 1)
+	msg := <-input
+	assert.Equal(t, time.Unix(1500000000, 0), msg.Timestamp)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("db"), Value: []byte("test")},
+		{Key: []byte("precision"), Value: []byte("s")},
+		{Key: []byte("request_id"), Value: []byte("abc")},
+	}, msg.Headers)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// influxAPI identifies the InfluxDB write API a request was made against.
+type influxAPI int
+
+const (
+	influxV1 influxAPI = iota
+	influxV2
+)
+
+// writeParams are the query parameters of a write request. InfluxDB 2.x
+// writes to a bucket within an organization, and the bucket stands in
+// for the database.
+type writeParams struct {
+	db        string
+	org       string
+	bucket    string
+	precision string
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type v2ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// params reads the write parameters from the query string, returning a
+// rejection reason alongside any error.
+func (api influxAPI) params(args *fasthttp.Args) (writeParams, string, error) {
+	params := writeParams{precision: "ns"}
+	if param := args.Peek("precision"); param != nil {
+		params.precision = string(param)
+	}
+
+	if api == influxV2 {
+		params.org = string(args.Peek("org"))
+		if params.org == "" {
+			params.org = string(args.Peek("orgID"))
+		}
+		params.bucket = string(args.Peek("bucket"))
+		params.db = params.bucket
+
+		if params.bucket == "" {
+			return params, reasonMissingDatabase, errors.New("bucket is required")
+		}
+
+		switch params.precision {
+		case "ns", "us", "ms", "s":
+		default:
+			return params, reasonInvalidPrecision,
+				fmt.Errorf("%v %q: use ns, us, ms or s", ErrInvalidPrecision, params.precision)
+		}
+
+		return params, "", nil
+	}
+
+	params.db = string(args.Peek("db"))
+	if params.db == "" {
+		return params, reasonMissingDatabase, errors.New("database is required")
+	}
+
+	if _, err := precisionMultiplier(params.precision); err != nil {
+		return params, reasonInvalidPrecision, err
+	}
+
+	return params, "", nil
+}
+
+// reject responds with an error in the shape each InfluxDB version uses.
+func (api influxAPI) reject(ctx *fasthttp.RequestCtx, status int, message string) {
+	var body []byte
+	if api == influxV2 {
+		code := v2ErrorCode(status)
+		body, _ = json.Marshal(v2ErrorResponse{Code: code, Message: message})
+		ctx.Response.Header.Set("X-Platform-Error-Code", code)
+	} else {
+		body, _ = json.Marshal(errorResponse{message})
+		ctx.Response.Header.Set("X-Influxdb-Error", message)
+	}
+
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	ctx.SetStatusCode(status)
+	ctx.SetBody(body)
+}
+
+func v2ErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not found"
+	case http.StatusMethodNotAllowed:
+		return "method not allowed"
+	case http.StatusRequestEntityTooLarge:
+		return "request too large"
+	case http.StatusTooManyRequests:
+		return "too many requests"
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return "unavailable"
+	default:
+		return "internal error"
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+// SASL mechanisms for authenticating with Kafka brokers. Only PLAIN is
+// supported by the version of sarama Telepath is built with.
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// The producer settings accepted for each sarama option.
+var (
+	requiredAcks = map[string]sarama.RequiredAcks{
+		"none":   sarama.NoResponse,
+		"leader": sarama.WaitForLocal,
+		"all":    sarama.WaitForAll,
+	}
+	compressionCodecs = map[string]sarama.CompressionCodec{
+		"none":   sarama.CompressionNone,
+		"gzip":   sarama.CompressionGZIP,
+		"snappy": sarama.CompressionSnappy,
+		"lz4":    sarama.CompressionLZ4,
+	}
+	partitioners = map[string]sarama.PartitionerConstructor{
+		"hash":       sarama.NewHashPartitioner,
+		"random":     sarama.NewRandomPartitioner,
+		"roundrobin": sarama.NewRoundRobinPartitioner,
+	}
+)
+
+// Kafka client IDs may only use these characters.
+var validClientID = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ProducerConfig tunes the Kafka producer. Its defaults are sarama's,
+// except for the acks, compression, flush frequency and client ID.
+type ProducerConfig struct {
+	Acks              string        `yaml:"acks"`
+	Compression       string        `yaml:"compression"`
+	FlushBytes        int           `yaml:"flush_bytes"`
+	FlushMessages     int           `yaml:"flush_messages"`
+	FlushFrequency    time.Duration `yaml:"flush_frequency"`
+	MaxMessageBytes   int           `yaml:"max_message_bytes"`
+	Timeout           time.Duration `yaml:"timeout"`
+	RetryMax          int           `yaml:"retry_max"`
+	RetryBackoff      time.Duration `yaml:"retry_backoff"`
+	ChannelBufferSize int           `yaml:"channel_buffer_size"`
+	Partitioner       string        `yaml:"partitioner"`
+	ClientID          string        `yaml:"client_id"`
+}
+
+type KafkaTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAPath             string `yaml:"ca"`
+	CertificatePath    string `yaml:"certificate"`
+	KeyPath            string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type KafkaSASLConfig struct {
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+// validateProducer reports problems with the producer settings.
+func (c *TelepathConfig) validateProducer(fail func(string, ...interface{})) {
+	p := c.Producer
+	if _, ok := requiredAcks[p.Acks]; !ok {
+		fail("invalid producer acks %q: use none, leader or all", p.Acks)
+	}
+	if codec, ok := compressionCodecs[p.Compression]; !ok {
+		fail("invalid producer compression %q: use none, gzip, snappy or lz4", p.Compression)
+	} else if codec == sarama.CompressionLZ4 && c.Version.IsAtLeast(sarama.V0_8_2_0) && !c.Version.IsAtLeast(sarama.V0_10_0_0) {
+		fail("lz4 compression requires Kafka 0.10 or later")
+	}
+	if _, ok := partitioners[p.Partitioner]; !ok {
+		fail("invalid producer partitioner %q: use hash, random or roundrobin", p.Partitioner)
+	}
+	if !validClientID.MatchString(p.ClientID) {
+		fail("invalid Kafka client ID %q: use letters, digits, '.', '_' and '-'", p.ClientID)
+	}
+
+	if p.FlushBytes < 0 {
+		fail("producer flush bytes can't be negative")
+	}
+	if p.FlushMessages < 0 {
+		fail("producer flush messages can't be negative")
+	}
+	if p.FlushFrequency < 0 {
+		fail("producer flush frequency can't be negative")
+	}
+	if p.MaxMessageBytes < 1 {
+		fail("producer max message bytes must be at least 1")
+	}
+	if p.Timeout <= 0 {
+		fail("producer timeout must be positive")
+	}
+	if p.RetryMax < 0 {
+		fail("producer retry max can't be negative")
+	}
+	if p.RetryBackoff < 0 {
+		fail("producer retry backoff can't be negative")
+	}
+	if p.ChannelBufferSize < 0 {
+		fail("producer channel buffer size can't be negative")
+	}
+}
+
+// validateKafkaSecurity reports problems with the broker TLS and SASL
+// settings.
+func (c *TelepathConfig) validateKafkaSecurity(fail func(string, ...interface{})) {
+	tlsConfig := c.KafkaTLS
+	if !tlsConfig.Enabled && (tlsConfig.CAPath != "" || tlsConfig.CertificatePath != "" ||
+		tlsConfig.KeyPath != "" || tlsConfig.InsecureSkipVerify) {
+		fail("Kafka TLS settings require kafka.tls to be enabled")
+	}
+	if (tlsConfig.CertificatePath == "") != (tlsConfig.KeyPath == "") {
+		fail("a Kafka TLS client certificate and key must be given together")
+	}
+
+	switch strings.ToUpper(c.KafkaSASL.Mechanism) {
+	case "":
+		if c.KafkaSASL.Username != "" || c.KafkaSASL.Password != "" {
+			fail("a Kafka SASL username and password require a SASL mechanism")
+		}
+	case SASLPlain:
+		if c.KafkaSASL.Username == "" || c.KafkaSASL.Password == "" {
+			fail("Kafka SASL/PLAIN requires a username and password")
+		}
+	case SASLScramSHA256, SASLScramSHA512:
+		fail("Kafka SASL mechanism %s isn't supported by this build of Telepath; use PLAIN", strings.ToUpper(c.KafkaSASL.Mechanism))
+	default:
+		fail("invalid Kafka SASL mechanism %q: use PLAIN", c.KafkaSASL.Mechanism)
+	}
+}
+
+// newSaramaConfig returns the producer settings, including TLS and SASL
+// for connecting to the brokers.
+func newSaramaConfig(c *TelepathConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+
+	p := c.Producer
+	config.ClientID = p.ClientID
+	config.ChannelBufferSize = p.ChannelBufferSize
+	config.Producer.RequiredAcks = requiredAcks[p.Acks]
+	config.Producer.Compression = compressionCodecs[p.Compression]
+	config.Producer.Flush.Bytes = p.FlushBytes
+	config.Producer.Flush.Messages = p.FlushMessages
+	config.Producer.Flush.Frequency = p.FlushFrequency
+	config.Producer.MaxMessageBytes = p.MaxMessageBytes
+	config.Producer.Timeout = p.Timeout
+	config.Producer.Retry.Max = p.RetryMax
+	config.Producer.Retry.Backoff = p.RetryBackoff
+	config.Producer.Partitioner = partitioners[p.Partitioner]
+	config.Producer.Return.Successes = true
+	config.Version = c.Version
+
+	if c.KafkaTLS.Enabled {
+		tlsConfig, err := loadKafkaTLSConfig(&c.KafkaTLS)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+
+		if c.KafkaTLS.InsecureSkipVerify {
+			log.Warn("Not verifying the Kafka brokers' certificates; don't do this in production.")
+		}
+	}
+
+	if strings.ToUpper(c.KafkaSASL.Mechanism) == SASLPlain {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = c.KafkaSASL.Username
+		config.Net.SASL.Password = c.KafkaSASL.Password
+
+		if !c.KafkaTLS.Enabled {
+			log.Warn("Kafka SASL/PLAIN without TLS sends the password in the clear.")
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// logProducerConfig reports the settings the producer is really using.
+func logProducerConfig(config *TelepathConfig) {
+	p := config.Producer
+	log.WithFields(log.Fields{
+		"acks":                p.Acks,
+		"compression":         p.Compression,
+		"flush_bytes":         p.FlushBytes,
+		"flush_messages":      p.FlushMessages,
+		"flush_frequency":     p.FlushFrequency,
+		"max_message_bytes":   p.MaxMessageBytes,
+		"timeout":             p.Timeout,
+		"retry_max":           p.RetryMax,
+		"retry_backoff":       p.RetryBackoff,
+		"channel_buffer_size": p.ChannelBufferSize,
+		"partitioner":         p.Partitioner,
+		"client_id":           p.ClientID,
+		"version":             KafkaVersionString(config.Version),
+		"tls":                 config.KafkaTLS.Enabled,
+		"sasl":                config.KafkaSASL.Mechanism,
+	}).Info("Kafka producer settings.")
+}
+
+// loadKafkaTLSConfig reads the CAs to verify the brokers with, and the
+// client certificate to present to them.
+func loadKafkaTLSConfig(config *KafkaTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CAPath != "" {
+		caBytes, err := ioutil.ReadFile(config.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load Kafka CA %s: %v", config.CAPath, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("could not parse Kafka CA %s: no certificates found", config.CAPath)
+		}
+	}
+
+	if config.CertificatePath != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertificatePath, config.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load Kafka client certificate %s: %v", config.CertificatePath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// newKafkaClient connects to the brokers, retrying until one can be
+// reached. With autoVersion, it first asks them which protocol version to
+// use, and sets it in the config.
+func newKafkaClient(brokers []string, config *sarama.Config, autoVersion bool) (client sarama.Client, err error) {
+	retryTimeout := time.Duration(10 * time.Second)
+	for {
+		if autoVersion {
+			version, reached, err := brokerVersion(brokers, config)
+			if err != nil {
+				return nil, err
+			}
+			if !reached {
+				log.Errorf("Couldn't reach a Kafka broker to negotiate the version with! Trying again in %v.", retryTimeout)
+				time.Sleep(retryTimeout)
+				continue
+			}
+			config.Version = version
+			autoVersion = false
+		}
+
+		client, err = sarama.NewClient(brokers, config)
+		if err == nil {
+			log.Infof("Connected to Kafka: %s", strings.Join(brokers, ","))
+			break
+		}
+
+		// Brokers which refuse our credentials won't change their minds,
+		// so only retry when they can't be reached.
+		if handshakeErr := brokerHandshakeError(brokers, config); handshakeErr != nil {
+			return nil, handshakeErr
+		}
+
+		log.Errorf("Couldn't connect to Kafka! Trying again in %v. %v", retryTimeout, err)
+		time.Sleep(retryTimeout)
+	}
+
+	return
+}
+
+// brokerHandshakeError connects to each broker in turn, returning why the
+// first to be reached refused the TLS or SASL handshake, if it did.
+func brokerHandshakeError(brokers []string, config *sarama.Config) error {
+	for _, addr := range brokers {
+		broker := sarama.NewBroker(addr)
+		if err := broker.Open(config); err != nil {
+			return err
+		}
+		_, err := broker.Connected()
+		broker.Close()
+
+		if err == nil {
+			return nil
+		}
+		if isDialError(err) {
+			continue
+		}
+		return handshakeError(addr, err, config)
+	}
+
+	return nil
+}
+
+// isDialError tells a broker which couldn't be reached from one which
+// refused the connection.
+func isDialError(err error) bool {
+	for _, cause := range causes(err) {
+		if opErr, ok := cause.(*net.OpError); ok && opErr.Op == "dial" {
+			return true
+		}
+	}
+	return false
+}
+
+// causes returns an error and those it wraps, outermost first.
+func causes(err error) []error {
+	var errs []error
+	for err != nil {
+		errs = append(errs, err)
+		switch wrapper := err.(type) {
+		case *net.OpError:
+			err = wrapper.Err
+		case interface {
+			Unwrap() error
+		}:
+			err = wrapper.Unwrap()
+		default:
+			err = nil
+		}
+	}
+	return errs
+}
+
+func handshakeError(addr string, err error, config *sarama.Config) error {
+	return fmt.Errorf("handshake with Kafka broker %s failed: %v%s", addr, err, handshakeHint(err, config))
+}
+
+// handshakeHint suggests the setting most likely to be wrong.
+func handshakeHint(err error, config *sarama.Config) string {
+	for _, cause := range causes(err) {
+		switch cause.(type) {
+		case x509.UnknownAuthorityError:
+			return " (check kafka.tls.ca)"
+		case x509.HostnameError:
+			return " (the broker's certificate doesn't match its address)"
+		case tls.RecordHeaderError:
+			return " (is the broker listening for TLS?)"
+		}
+	}
+
+	switch {
+	case err == sarama.ErrUnsupportedSASLMechanism:
+		return " (the broker doesn't accept SASL/PLAIN)"
+	case config.Net.SASL.Enable && (err == io.EOF || err == io.ErrUnexpectedEOF):
+		return " (check the SASL username and password)"
+	}
+	return ""
+}
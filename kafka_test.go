@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_producer_config(t *testing.T) {
+	config, err := newSaramaConfig(defaultConfig(t))
+	require.NoError(t, err)
+	assert.Equal(t, sarama.WaitForLocal, config.Producer.RequiredAcks)
+	assert.Equal(t, sarama.CompressionSnappy, config.Producer.Compression)
+	assert.Equal(t, 500*time.Millisecond, config.Producer.Flush.Frequency)
+	assert.Equal(t, "telepath", config.ClientID)
+	assert.True(t, config.Producer.Return.Successes)
+
+	c, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-kafka.producer.acks", "all",
+		"-kafka.producer.compression", "lz4",
+		"-kafka.producer.flush.bytes", "65536",
+		"-kafka.producer.flush.messages", "100",
+		"-kafka.producer.flush.frequency", "1s",
+		"-kafka.producer.max.message.bytes", "2000000",
+		"-kafka.producer.timeout", "30s",
+		"-kafka.producer.retry.max", "5",
+		"-kafka.producer.retry.backoff", "1s",
+		"-kafka.producer.buffer", "1024",
+		"-kafka.producer.partitioner", "roundrobin",
+		"-kafka.client.id", "telepath-east",
+	}, noEnv)
+	require.NoError(t, err)
+	config, err = newSaramaConfig(c)
+	require.NoError(t, err)
+
+	assert.Equal(t, sarama.WaitForAll, config.Producer.RequiredAcks)
+	assert.Equal(t, sarama.CompressionLZ4, config.Producer.Compression)
+	assert.Equal(t, 65536, config.Producer.Flush.Bytes)
+	assert.Equal(t, 100, config.Producer.Flush.Messages)
+	assert.Equal(t, time.Second, config.Producer.Flush.Frequency)
+	assert.Equal(t, 2000000, config.Producer.MaxMessageBytes)
+	assert.Equal(t, 30*time.Second, config.Producer.Timeout)
+	assert.Equal(t, 5, config.Producer.Retry.Max)
+	assert.Equal(t, time.Second, config.Producer.Retry.Backoff)
+	assert.Equal(t, 1024, config.ChannelBufferSize)
+	assert.Equal(t, "telepath-east", config.ClientID)
+	assert.IsType(t, sarama.NewRoundRobinPartitioner("metrics"), config.Producer.Partitioner("metrics"))
+}
+
+func Test_producer_config_validation(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-kafka.version", "V0_9_0_0",
+		"-kafka.producer.acks", "some",
+		"-kafka.producer.compression", "lz4",
+		"-kafka.producer.flush.bytes", "-1",
+		"-kafka.producer.max.message.bytes", "0",
+		"-kafka.producer.timeout", "0",
+		"-kafka.producer.retry.max", "-1",
+		"-kafka.producer.buffer", "-1",
+		"-kafka.producer.partitioner", "sticky",
+		"-kafka.client.id", "telepath east",
+	}, noEnv)
+
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Equal(t, []string{
+		`invalid producer acks "some": use none, leader or all`,
+		"lz4 compression requires Kafka 0.10 or later",
+		`invalid producer partitioner "sticky": use hash, random or roundrobin`,
+		`invalid Kafka client ID "telepath east": use letters, digits, '.', '_' and '-'`,
+		"producer flush bytes can't be negative",
+		"producer max message bytes must be at least 1",
+		"producer timeout must be positive",
+		"producer retry max can't be negative",
+		"producer channel buffer size can't be negative",
+	}, errorStrings(err.(ConfigErrors)))
+
+	_, err = loadConfig([]string{"-kafka.brokers", "localhost:9092", "-kafka.producer.compression", "zstd"}, noEnv)
+	assert.EqualError(t, err, `invalid producer compression "zstd": use none, gzip, snappy or lz4`)
+}
+
+func Test_kafka_security_validation(t *testing.T) {
+	cases := []struct {
+		label string
+		tls   KafkaTLSConfig
+		sasl  KafkaSASLConfig
+		errs  []string
+	}{
+		{label: "none"},
+		{label: "tls", tls: KafkaTLSConfig{Enabled: true, CAPath: "ca.pem", CertificatePath: "client.pem", KeyPath: "client-key.pem"}},
+		{label: "plain", sasl: KafkaSASLConfig{Mechanism: "plain", Username: "telepath", Password: "secret"}},
+		{
+			label: "tls disabled",
+			tls:   KafkaTLSConfig{CAPath: "ca.pem"},
+			errs:  []string{"Kafka TLS settings require kafka.tls to be enabled"},
+		},
+		{
+			label: "certificate without key",
+			tls:   KafkaTLSConfig{Enabled: true, CertificatePath: "client.pem"},
+			errs:  []string{"a Kafka TLS client certificate and key must be given together"},
+		},
+		{
+			label: "plain without username",
+			sasl:  KafkaSASLConfig{Mechanism: "PLAIN", Username: "telepath"},
+			errs:  []string{"Kafka SASL/PLAIN requires a username and password"},
+		},
+		{
+			label: "scram",
+			sasl:  KafkaSASLConfig{Mechanism: "scram-sha-512", Username: "telepath"},
+			errs:  []string{"Kafka SASL mechanism SCRAM-SHA-512 isn't supported by this build of Telepath; use PLAIN"},
+		},
+		{
+			label: "unknown mechanism",
+			sasl:  KafkaSASLConfig{Mechanism: "GSSAPI"},
+			errs:  []string{`invalid Kafka SASL mechanism "GSSAPI": use PLAIN`},
+		},
+		{
+			label: "username without mechanism",
+			sasl:  KafkaSASLConfig{Username: "telepath"},
+			errs:  []string{"a Kafka SASL username and password require a SASL mechanism"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			config := &TelepathConfig{KafkaTLS: c.tls, KafkaSASL: c.sasl}
+
+			var errs []string
+			config.validateKafkaSecurity(func(format string, args ...interface{}) {
+				errs = append(errs, fmt.Sprintf(format, args...))
+			})
+			assert.Equal(t, c.errs, errs)
+		})
+	}
+}
+
+func Test_sarama_config_security(t *testing.T) {
+	c := defaultConfig(t)
+	c.KafkaTLS = KafkaTLSConfig{
+		Enabled:         true,
+		CAPath:          "etc/ca.pem",
+		CertificatePath: "etc/server.pem",
+		KeyPath:         "etc/server-key.pem",
+	}
+	c.KafkaSASL = KafkaSASLConfig{Mechanism: "plain", Username: "telepath", Password: "secret"}
+	config, err := newSaramaConfig(c)
+	require.NoError(t, err)
+
+	assert.True(t, config.Net.TLS.Enable)
+	assert.NotNil(t, config.Net.TLS.Config.RootCAs)
+	assert.Len(t, config.Net.TLS.Config.Certificates, 1)
+	assert.False(t, config.Net.TLS.Config.InsecureSkipVerify)
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, "telepath", config.Net.SASL.User)
+	assert.Equal(t, "secret", config.Net.SASL.Password)
+
+	config, err = newSaramaConfig(defaultConfig(t))
+	require.NoError(t, err)
+	assert.False(t, config.Net.TLS.Enable)
+	assert.False(t, config.Net.SASL.Enable)
+
+	c = defaultConfig(t)
+	c.KafkaTLS = KafkaTLSConfig{Enabled: true, CAPath: "etc/telegraf.conf"}
+	_, err = newSaramaConfig(c)
+	assert.EqualError(t, err, "could not parse Kafka CA etc/telegraf.conf: no certificates found")
+
+	c = defaultConfig(t)
+	c.KafkaTLS = KafkaTLSConfig{Enabled: true, CertificatePath: "etc/missing.pem", KeyPath: "etc/server-key.pem"}
+	_, err = newSaramaConfig(c)
+	assert.Error(t, err)
+}
+
+func Test_broker_handshake_error(t *testing.T) {
+	// Nothing listens on a closed port, which is worth retrying.
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	c := defaultConfig(t)
+	c.KafkaTLS.Enabled = true
+	config, err := newSaramaConfig(c)
+	require.NoError(t, err)
+	config.Net.DialTimeout = time.Second
+	config.Net.ReadTimeout = time.Second
+	assert.NoError(t, brokerHandshakeError([]string{closedAddr}, config))
+
+	plaintext := serveBytes(t, []byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+	defer plaintext.Close()
+	err = brokerHandshakeError([]string{closedAddr, plaintext.Addr().String()}, config)
+	require.Error(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), "(is the broker listening for TLS?)"), err.Error())
+
+	c = defaultConfig(t)
+	c.KafkaSASL = KafkaSASLConfig{Mechanism: "PLAIN", Username: "telepath", Password: "wrong"}
+	config, err = newSaramaConfig(c)
+	require.NoError(t, err)
+	config.Net.ReadTimeout = time.Second
+	hangup := serveBytes(t, nil)
+	defer hangup.Close()
+	err = brokerHandshakeError([]string{hangup.Addr().String()}, config)
+	require.Error(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), "(check the SASL username and password)"), err.Error())
+}
+
+func Test_handshake_hint(t *testing.T) {
+	config := sarama.NewConfig()
+	wrapped := func(err error) error {
+		return &net.OpError{Op: "remote error", Net: "tcp", Err: err}
+	}
+
+	assert.Equal(t, " (check kafka.tls.ca)", handshakeHint(x509.UnknownAuthorityError{}, config))
+	assert.Equal(t, " (check kafka.tls.ca)", handshakeHint(wrapped(x509.UnknownAuthorityError{}), config))
+	assert.Equal(t, " (the broker's certificate doesn't match its address)", handshakeHint(wrapped(x509.HostnameError{}), config))
+	assert.Equal(t, " (is the broker listening for TLS?)", handshakeHint(tls.RecordHeaderError{}, config))
+	assert.Equal(t, "", handshakeHint(wrapped(io.EOF), config))
+
+	assert.True(t, isDialError(&net.OpError{Op: "dial", Net: "tcp", Err: io.EOF}))
+	assert.False(t, isDialError(wrapped(io.EOF)))
+}
+
+// defaultConfig returns the configuration given only a broker.
+func defaultConfig(t *testing.T) *TelepathConfig {
+	config, err := loadConfig([]string{"-kafka.brokers", "localhost:9092"}, noEnv)
+	require.NoError(t, err)
+	return config
+}
+
+// serveBytes accepts connections, reading the client's first request and
+// writing the response to each before hanging up. Hanging up on unread
+// data would reset the connection instead.
+func serveBytes(t *testing.T, response []byte) net.Listener {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 4096))
+			conn.Write(response)
+			conn.Close()
+		}
+	}()
+
+	return listener
+}
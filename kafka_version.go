@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+// KafkaVersionAuto asks the brokers which version they are.
+const KafkaVersionAuto = "auto"
+
+// kafkaVersions are the protocol versions sarama knows, oldest first.
+var kafkaVersions = []struct {
+	number  [4]uint
+	version sarama.KafkaVersion
+}{
+	{[4]uint{0, 8, 2, 0}, sarama.V0_8_2_0},
+	{[4]uint{0, 8, 2, 1}, sarama.V0_8_2_1},
+	{[4]uint{0, 8, 2, 2}, sarama.V0_8_2_2},
+	{[4]uint{0, 9, 0, 0}, sarama.V0_9_0_0},
+	{[4]uint{0, 9, 0, 1}, sarama.V0_9_0_1},
+	{[4]uint{0, 10, 0, 0}, sarama.V0_10_0_0},
+	{[4]uint{0, 10, 0, 1}, sarama.V0_10_0_1},
+	{[4]uint{0, 10, 1, 0}, sarama.V0_10_1_0},
+	{[4]uint{0, 10, 2, 0}, sarama.V0_10_2_0},
+	{[4]uint{0, 11, 0, 0}, sarama.V0_11_0_0},
+}
+
+// Kafka API keys, and the versions of them which tell broker releases
+// apart.
+const (
+	apiProduce        = 0
+	apiOffsetFetch    = 9
+	apiCreateTopics   = 19
+	apiInitProducerID = 22
+)
+
+// ParseKafkaVersion reads a dotted Kafka version, such as 0.10.2 or 1.1,
+// or one in the old V0_10_2_0 form. Versions newer than sarama knows use
+// the newest protocol it does. An empty version is the default.
+func ParseKafkaVersion(version string) (sarama.KafkaVersion, error) {
+	if version == "" {
+		version = DEFAULT_KAFKA_VERSION
+	}
+
+	number, ok := parseVersionNumber(version)
+	if !ok {
+		return sarama.KafkaVersion{}, fmt.Errorf("invalid Kafka version %q: use a dotted version, such as 0.10.2 or 1.1, or %s", version, KafkaVersionAuto)
+	}
+
+	found := -1
+	for i, known := range kafkaVersions {
+		if !versionAtLeast(number, known.number) {
+			break
+		}
+		found = i
+	}
+	if found < 0 {
+		return sarama.KafkaVersion{}, fmt.Errorf("unsupported Kafka version %q: the oldest supported is %s",
+			version, versionString(kafkaVersions[0].number))
+	}
+
+	return kafkaVersions[found].version, nil
+}
+
+func parseVersionNumber(version string) (number [4]uint, ok bool) {
+	s := strings.TrimPrefix(strings.TrimPrefix(version, "v"), "V")
+	parts := strings.Split(strings.Replace(s, "_", ".", -1), ".")
+	if len(parts) > len(number) {
+		return number, false
+	}
+
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return number, false
+		}
+		number[i] = uint(n)
+	}
+	return number, true
+}
+
+// AutoKafkaVersion reports whether the brokers should be asked which
+// version to use.
+func (c *TelepathConfig) AutoKafkaVersion() bool {
+	return strings.EqualFold(c.KafkaVersion, KafkaVersionAuto)
+}
+
+// KafkaVersionString names a known protocol version.
+func KafkaVersionString(version sarama.KafkaVersion) string {
+	for _, known := range kafkaVersions {
+		if known.version == version {
+			return versionString(known.number)
+		}
+	}
+	return "unknown"
+}
+
+func versionAtLeast(v, other [4]uint) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] > other[i]
+		}
+	}
+	return true
+}
+
+func versionString(number [4]uint) string {
+	return fmt.Sprintf("%d.%d.%d.%d", number[0], number[1], number[2], number[3])
+}
+
+// brokerVersion asks the first broker which can be reached for the API
+// versions it supports, and returns the newest protocol version both it
+// and sarama understand. It reports whether any broker could be reached,
+// so that the caller can retry if none could. Brokers older than 0.10
+// can't be asked.
+func brokerVersion(brokers []string, config *sarama.Config) (version sarama.KafkaVersion, reached bool, err error) {
+	probe := *config
+	probe.Version = sarama.V0_10_0_0
+
+	for _, addr := range brokers {
+		broker := sarama.NewBroker(addr)
+		if err = broker.Open(&probe); err != nil {
+			return version, false, err
+		}
+
+		if _, err = broker.Connected(); err != nil {
+			broker.Close()
+			if isDialError(err) {
+				continue
+			}
+			return version, true, handshakeError(addr, err, config)
+		}
+
+		response, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+		broker.Close()
+		if err == nil && response.Err != sarama.ErrNoError {
+			err = response.Err
+		}
+		if err != nil {
+			return version, true, fmt.Errorf("could not ask Kafka broker %s for its API versions: %v (brokers before 0.10 can't be asked; set kafka.version instead)", addr, err)
+		}
+
+		version = versionFromAPIs(response.ApiVersions)
+		log.WithFields(log.Fields{
+			"broker":  addr,
+			"version": KafkaVersionString(version),
+		}).Info("Negotiated the Kafka version with the broker.")
+		return version, true, nil
+	}
+
+	return version, false, nil
+}
+
+// versionFromAPIs picks the protocol version of the broker release which
+// first supported all of the given APIs.
+func versionFromAPIs(apis []*sarama.ApiVersionsResponseBlock) sarama.KafkaVersion {
+	maxVersions := make(map[int16]int16)
+	for _, api := range apis {
+		maxVersions[api.ApiKey] = api.MaxVersion
+	}
+	supports := func(key, version int16) bool {
+		max, ok := maxVersions[key]
+		return ok && max >= version
+	}
+
+	switch {
+	case supports(apiInitProducerID, 0) || supports(apiProduce, 3):
+		return sarama.V0_11_0_0
+	case supports(apiOffsetFetch, 2):
+		return sarama.V0_10_2_0
+	case supports(apiCreateTopics, 0):
+		return sarama.V0_10_1_0
+	default:
+		return sarama.V0_10_0_0
+	}
+}
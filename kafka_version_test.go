@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parse_kafka_version(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect sarama.KafkaVersion
+	}{
+		{"0.10.2.0", sarama.V0_10_2_0},
+		{"0.10.2", sarama.V0_10_2_0},
+		{"V0_10_2", sarama.V0_10_2_0},
+		{"0.10", sarama.V0_10_0_0},
+		{"0.9.0.1", sarama.V0_9_0_1},
+		{"v0.11.0.0", sarama.V0_11_0_0},
+		{"0.10.1.1", sarama.V0_10_1_0},
+		{"1.1", sarama.V0_11_0_0},
+		{"2.0.0", sarama.V0_11_0_0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			actual, err := ParseKafkaVersion(c.input)
+			require.NoError(t, err)
+			assert.Equal(t, c.expect, actual)
+		})
+	}
+}
+
+func Test_parse_kafka_version_errors(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"0.10.x", `invalid Kafka version "0.10.x"`},
+		{"1.1.0.0.0", `invalid Kafka version "1.1.0.0.0"`},
+		{"V0_8", `unsupported Kafka version "V0_8"`},
+		{"latest", `invalid Kafka version "latest"`},
+		{"0.8.1", `unsupported Kafka version "0.8.1": the oldest supported is 0.8.2.0`},
+		{"0.10.", `invalid Kafka version "0.10."`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			_, err := ParseKafkaVersion(c.input)
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), c.expect), err.Error())
+		})
+	}
+}
+
+func Test_kafka_version_config(t *testing.T) {
+	_, err := loadConfig([]string{"-kafka.brokers", "localhost:9092", "-kafka.version", "1.x"}, noEnv)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid Kafka version "1.x"`)
+
+	c, err := loadConfig([]string{"-kafka.brokers", "localhost:9092", "-kafka.version", "AUTO"}, noEnv)
+	require.NoError(t, err)
+	assert.True(t, c.AutoKafkaVersion())
+	assert.Equal(t, sarama.V0_10_0_0, c.Version)
+
+	c = defaultConfig(t)
+	assert.False(t, c.AutoKafkaVersion())
+	assert.Equal(t, sarama.V0_10_0_0, c.Version)
+	assert.Equal(t, "0.10.0.0", KafkaVersionString(c.Version))
+}
+
+func Test_versions_from_apis(t *testing.T) {
+	cases := []struct {
+		label  string
+		apis   []*sarama.ApiVersionsResponseBlock
+		expect sarama.KafkaVersion
+	}{
+		{"0.10.0", apiVersions(apiProduce, 2, apiOffsetFetch, 1), sarama.V0_10_0_0},
+		{"0.10.1", apiVersions(apiProduce, 2, apiOffsetFetch, 1, apiCreateTopics, 0), sarama.V0_10_1_0},
+		{"0.10.2", apiVersions(apiProduce, 2, apiOffsetFetch, 2, apiCreateTopics, 1), sarama.V0_10_2_0},
+		{"0.11.0", apiVersions(apiProduce, 3, apiOffsetFetch, 3, apiCreateTopics, 2, apiInitProducerID, 0), sarama.V0_11_0_0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			assert.Equal(t, c.expect, versionFromAPIs(c.apis))
+		})
+	}
+}
+
+func Test_broker_version(t *testing.T) {
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockWrapper(&sarama.ApiVersionsResponse{
+			ApiVersions: apiVersions(apiProduce, 2, apiOffsetFetch, 2, apiCreateTopics, 1),
+		}),
+	})
+
+	config := sarama.NewConfig()
+	config.Net.DialTimeout = time.Second
+
+	_, reached, err := brokerVersion([]string{closedAddr}, config)
+	assert.NoError(t, err)
+	assert.False(t, reached)
+
+	version, reached, err := brokerVersion([]string{closedAddr, broker.Addr()}, config)
+	require.NoError(t, err)
+	assert.True(t, reached)
+	assert.Equal(t, sarama.V0_10_2_0, version)
+	assert.Equal(t, sarama.V0_8_2_0, config.Version, "the config is left alone")
+}
+
+func Test_broker_version_errors(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Net.ReadTimeout = time.Second
+
+	hangup := serveBytes(t, nil)
+	defer hangup.Close()
+	_, reached, err := brokerVersion([]string{hangup.Addr().String()}, config)
+	require.Error(t, err)
+	assert.True(t, reached)
+	assert.Contains(t, err.Error(), "set kafka.version instead")
+}
+
+// apiVersions lists API keys and the highest version of each.
+func apiVersions(keysAndVersions ...int16) []*sarama.ApiVersionsResponseBlock {
+	var blocks []*sarama.ApiVersionsResponseBlock
+	for i := 0; i < len(keysAndVersions); i += 2 {
+		blocks = append(blocks, &sarama.ApiVersionsResponseBlock{
+			ApiKey:     keysAndVersions[i],
+			MaxVersion: keysAndVersions[i+1],
+		})
+	}
+	return blocks
+}
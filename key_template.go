@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+type keyTemplate struct {
+	tmpl *template.Template
+}
+
+// NewKeyTemplate parses a template for Kafka message keys. An empty
+// template returns nil, leaving messages unkeyed.
+func NewKeyTemplate(text string) (*keyTemplate, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"toLower": strings.ToLower,
+		"toUpper": strings.ToUpper,
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch references to unknown fields now, rather than on every point.
+	kt := &keyTemplate{tmpl}
+	if _, err := kt.Execute(pointParams{point: &Point{}}); err != nil {
+		return nil, err
+	}
+
+	return kt, nil
+}
+
+func (kt *keyTemplate) Execute(params pointParams) ([]byte, error) {
+	var w bytes.Buffer
+	if err := kt.tmpl.Execute(&w, params); err != nil {
+		return nil, err
+	}
+
+	return w.Bytes(), nil
+}
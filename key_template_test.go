@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_key_template(t *testing.T) {
+	point, err := ParsePoint([]byte("cpu,region=outer,host=Hoth usage=1 1"), "ns", time.Now())
+	require.NoError(t, err)
+
+	cases := []struct {
+		label    string
+		template string
+		expect   string
+	}{
+		{
+			label:    "Database",
+			template: "{{.Database}}",
+			expect:   "telegraf",
+		}, {
+			label:    "Measurement",
+			template: "{{.Measurement}}",
+			expect:   "cpu",
+		}, {
+			label:    "Single tag",
+			template: `{{.Tag "host"}}`,
+			expect:   "Hoth",
+		}, {
+			label:    "Missing tag",
+			template: `{{.Tag "rack"}}`,
+			expect:   "",
+		}, {
+			label:    "Selected tags",
+			template: `{{.Measurement}}:{{.Tags "host" "region"}}`,
+			expect:   "cpu:Hoth,outer",
+		}, {
+			label:    "Series key",
+			template: "{{.SeriesKey}}",
+			expect:   "cpu,host=Hoth,region=outer",
+		}, {
+			label:    "Template toLower",
+			template: `{{.Tag "host" | toLower}}`,
+			expect:   "hoth",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			kt, err := NewKeyTemplate(c.template)
+			require.NoError(t, err)
+
+			key, err := kt.Execute(pointParams{Database: "telegraf", point: point})
+			assert.NoError(t, err)
+			assert.Equal(t, c.expect, string(key))
+		})
+	}
+}
+
+func Test_key_template_errors(t *testing.T) {
+	kt, err := NewKeyTemplate("")
+	assert.NoError(t, err)
+	assert.Nil(t, kt)
+
+	_, err = NewKeyTemplate("{{.Database")
+	assert.Error(t, err)
+
+	_, err = NewKeyTemplate("{{.Host}}")
+	assert.Error(t, err)
+}
@@ -3,18 +3,20 @@ package main
 import (
 	"bytes"
 	"io"
-	"strconv"
-	"strings"
 	"time"
 )
 
 var emptyBuffer = []byte{}
 
+const truncatedLinePrefix = 64
+
 type lineParser struct {
-	linePosition int
-	lineLength   int
-	precision    string
-	buffer       []byte
+	start     int
+	end       int
+	eof       bool
+	truncated []byte
+	precision string
+	buffer    []byte
 }
 
 func NewLineParser(buffer []byte, precision string) *lineParser {
@@ -24,103 +26,99 @@ func NewLineParser(buffer []byte, precision string) *lineParser {
 	}
 }
 
+// Next returns the next valid line of input, with its timestamp
+// rewritten in nanoseconds.
 func (lp *lineParser) Next(reader io.Reader) ([]byte, error) {
-	var offset int
-	var length int
-	line := emptyBuffer
+	point, err := lp.NextPoint(reader)
+	if err != nil {
+		return emptyBuffer, err
+	}
+
+	return point.Line(), nil
+}
+
+// NextPoint parses the next line of input. Blank lines and comments are
+// skipped, and invalid lines are reported with a *ParseError.
+func (lp *lineParser) NextPoint(reader io.Reader) (*Point, error) {
 	for {
-		var err error
-		if lp.linePosition == 0 {
-			zeroBuffer(lp.buffer[offset:])
-			length, err = io.ReadFull(reader, lp.buffer[offset:])
-			if parseComplete(err) {
-				return emptyBuffer, err
-			}
+		line, err := lp.readLine(reader)
+		if err == ErrLineTooLong {
+			return nil, &ParseError{Line: string(line) + "...", Err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
 
-			lp.lineLength = offset + length
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
 		}
 
-		tail := bytes.IndexByte(lp.buffer[lp.linePosition:], '\n')
-		if lp.lineLength < lp.linePosition {
-			// We've over-run the usable data in our buffer!
-			return emptyBuffer, io.EOF
-		} else if tail != -1 {
+		return ParsePoint(line, lp.precision, time.Now())
+	}
+}
+
+// readLine returns the next newline-delimited line from the reader. The
+// line is only valid until the next call. Lines which don't fit in the
+// buffer are discarded, and reported with ErrLineTooLong alongside the
+// start of the line.
+func (lp *lineParser) readLine(reader io.Reader) ([]byte, error) {
+	for {
+		if tail := bytes.IndexByte(lp.buffer[lp.start:lp.end], '\n'); tail != -1 {
 			// We've found a metric!
-			next := lp.linePosition + tail + 1
-			line = lp.buffer[lp.linePosition:next]
-			lp.linePosition = next
-
-			break
-		} else if err == io.ErrUnexpectedEOF {
-			// We're at the end of the line,
-			// and there's no remaining input.
-			tail = offset + lp.lineLength
-			line = lp.buffer[:tail]
-			lp.linePosition = tail
-
-			break
-		} else {
-			// We'll rotate the remainder of this chunk,
-			// making it available for the next iteration.
-			remainder := len(lp.buffer) - lp.linePosition
-			copy(lp.buffer, lp.buffer[lp.linePosition:])
-
-			lp.linePosition = 0
-			offset = remainder
+			line := lp.buffer[lp.start : lp.start+tail]
+			lp.start = lp.start + tail + 1
+
+			return lp.complete(line)
 		}
-	}
 
-	return convertToNanoseconds(trimSpace(trimNewline(line)), lp.precision), nil
-}
+		if lp.eof {
+			// There's no remaining input, so the remainder
+			// of the buffer is the last line.
+			if lp.start == lp.end && lp.truncated == nil {
+				return emptyBuffer, io.EOF
+			}
 
-func zeroBuffer(buffer []byte) {
-	for i := 0; i < len(buffer); i++ {
-		buffer[i] = 0
-	}
-}
+			line := lp.buffer[lp.start:lp.end]
+			lp.start = lp.end
 
-func parseComplete(err error) bool {
-	return err != nil && err != io.ErrUnexpectedEOF
-}
+			return lp.complete(line)
+		}
 
-func trimNewline(line []byte) []byte {
-	length := len(line)
-	if c := line[length-1]; c != '\n' {
-		return line
-	}
-	return line[:length-1]
-}
+		if lp.start == 0 && lp.end == len(lp.buffer) {
+			// The line is bigger than our buffer, so we'll
+			// skip ahead to the next one.
+			if lp.truncated == nil {
+				prefix := lp.end
+				if prefix > truncatedLinePrefix {
+					prefix = truncatedLinePrefix
+				}
+				lp.truncated = append([]byte{}, lp.buffer[:prefix]...)
+			}
+			lp.end = 0
+		}
 
-func trimSpace(line []byte) []byte {
-	length := len(line)
-	if c := line[length-1]; c != ' ' {
-		return line
+		// We'll rotate the remainder of this chunk,
+		// making room for the next read.
+		copy(lp.buffer, lp.buffer[lp.start:lp.end])
+		lp.end = lp.end - lp.start
+		lp.start = 0
+
+		length, err := io.ReadFull(reader, lp.buffer[lp.end:])
+		lp.end = lp.end + length
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			lp.eof = true
+		} else if err != nil {
+			return emptyBuffer, err
+		}
 	}
-	return line[:length-1]
 }
 
-func convertToNanoseconds(input []byte, precision string) []byte {
-	values := strings.Split(string(input[:]), " ")
-	var multiplyer time.Duration
-	switch precision {
-	case "ns":
-		multiplyer = time.Nanosecond
-	case "us":
-		multiplyer = time.Microsecond
-	case "ms":
-		multiplyer = time.Millisecond
-	case "s":
-		multiplyer = time.Second
-	default:
-		multiplyer = time.Nanosecond
+func (lp *lineParser) complete(line []byte) ([]byte, error) {
+	if truncated := lp.truncated; truncated != nil {
+		lp.truncated = nil
+		return truncated, ErrLineTooLong
 	}
 
-	t, err := strconv.ParseInt(values[len(values)-1], 10, 64)
-	if err != nil {
-		values = append(values, strconv.FormatInt(time.Now().UnixNano(), 10))
-	} else {
-		values = values[:len(values)-1]
-		values = append(values, strconv.FormatInt(t*int64(multiplyer), 10))
-	}
-	return []byte(strings.Join(values[:], " "))
+	return line, nil
 }
@@ -184,3 +184,72 @@ func Test_line_parser_appends_missing_timestamp(t *testing.T) {
 	require.Equal(t, emptyBuffer, actual)
 	require.Equal(t, io.EOF, err)
 }
+
+func Test_line_parser_reports_invalid_lines(t *testing.T) {
+	cases := []struct {
+		label   string
+		input   string
+		bufsize int
+		expect  []string
+		errors  int
+	}{
+		{
+			label:   "blank lines and comments",
+			input:   "\n# a comment\nfoo value=1 1\n\n  \nfoo value=1 2\n",
+			bufsize: 32,
+			expect:  []string{"foo value=1 1", "foo value=1 2"},
+		},
+		{
+			label:   "invalid lines between valid ones",
+			input:   "foo value=1 1\nfoo value 2\nfoo value=1 3\nfoo\n",
+			bufsize: 32,
+			expect:  []string{"foo value=1 1", "foo value=1 3"},
+			errors:  2,
+		},
+		{
+			label:   "line longer than the buffer",
+			input:   "foo value=1 1\nfoo,x=y very=1,long=2,metric=3 1494462271\nfoo value=1 2\n",
+			bufsize: 16,
+			expect:  []string{"foo value=1 1", "foo value=1 2"},
+			errors:  1,
+		},
+		{
+			label:   "last line longer than the buffer",
+			input:   "foo value=1 1\nfoo,x=y very=1,long=2,metric=3 1494462271",
+			bufsize: 16,
+			expect:  []string{"foo value=1 1"},
+			errors:  1,
+		},
+		{
+			label:   "escaped space and quoted string",
+			input:   "foo,host=Echo\\ Base msg=\"hello world\" 1\n",
+			bufsize: 64,
+			expect:  []string{"foo,host=Echo\\ Base msg=\"hello world\" 1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			buffer := make([]byte, c.bufsize)
+			lp := NewLineParser(buffer, "")
+			reader := bytes.NewBuffer([]byte(c.input))
+
+			actual := make([]string, 0)
+			errors := 0
+			for {
+				line, err := lp.Next(reader)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					require.IsType(t, &ParseError{}, err)
+					errors++
+					continue
+				}
+				actual = append(actual, string(line))
+			}
+			assert.Equal(t, c.expect, actual)
+			assert.Equal(t, c.errors, errors)
+		})
+	}
+}
@@ -2,16 +2,13 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"io/ioutil"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/Nordstrom/telepath/middleware"
 	"github.com/Shopify/sarama"
@@ -24,85 +21,174 @@ func main() {
 	config := &TelepathConfig{}
 	config.Parse()
 
-	if config.Brokers == "" {
-		log.Fatal("Please specify at least one Kafka broker")
+	if err := loadCredentials(&config.Auth); err != nil {
+		log.Fatal(err)
 	}
 
-	kafkaClient, err := newKafkaClient(strings.Split(config.Brokers, ","), time.Minute, config.Version)
+	routes, err := loadRoutes(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tlsStore *tlsStore
+	if config.HTTPS.Enabled {
+		if tlsStore, err = newTLSStore(&config.HTTPS); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	kafkaConfig, err := newSaramaConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kafkaClient, err := newKafkaClient(strings.Split(config.Brokers, ","), kafkaConfig, config.AutoKafkaVersion())
 	if err != nil {
 		log.Fatalf("Could not connect to Kafka brokers: %v", err)
 	}
+	config.Version = kafkaConfig.Version
+	logProducerConfig(config)
 
 	kafkaProducer, err := sarama.NewAsyncProducerFromClient(kafkaClient)
 	if err != nil {
 		log.Fatalf("Failed to start Kafka producer: %v", err)
 	}
 
+	var spool *spool
+	if config.Spool.Dir != "" {
+		if spool, err = newSpool(&config.Spool); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	queue := newProducerQueue(kafkaProducer.Input(), spool)
+	deadLetters := newDeadLetters(config.DeadLetter, kafkaProducer.Input())
+	queue.deadLetters = deadLetters
 	write, err := NewWriteHandler(kafkaProducer, writeConfig{
-		topicTemplate: config.TopicTemplate,
+		ackMode:         config.AckMode,
+		ackTimeout:      config.AckTimeout,
+		batch:           config.Batch.Enabled,
+		batchLines:      config.Batch.Lines,
+		batchBytes:      config.Batch.Bytes,
+		batchLinger:     config.Batch.Linger,
+		maxMessageBytes: kafkaClient.Config().Producer.MaxMessageBytes,
+		topicTemplate:   config.TopicTemplate,
+		keyTemplate:     config.KeyTemplate,
+		routes:          routes,
+		queue:           queue,
+		backpressure:    config.Backpressure,
+		rateLimits:      config.RateLimits,
+		cardinality:     config.Cardinality,
+		deadLetters:     deadLetters,
+		recordHeaders:   kafkaRecordHeaders(config),
 	})
 
 	if err != nil {
 		log.Fatalf("Could not create a write handler: %v", err)
 	}
 
+	auth := middleware.NewAuthenticator(config.Auth)
+
 	router := fasthttprouter.New()
 	router.GET("/ping", pingHandlerFunc)
-	router.GET("/query", middleware.Auth(queryHandlerFunc, &config.Auth))
-	router.POST("/query", middleware.Auth(queryHandlerFunc, &config.Auth))
-	router.POST("/write", middleware.Auth(write.Handle, &config.Auth))
+	router.GET("/query", auth.Handler(queryHandlerFunc))
+	router.POST("/query", auth.Handler(queryHandlerFunc))
+	router.POST("/write", auth.Handler(write.Handle))
+	router.POST("/api/v2/write", auth.Handler(write.HandleV2))
 	router.GET("/metrics", metrics.Handle)
 
+	drainer := &drainer{}
 	server := &fasthttp.Server{
 		Name:               "Telepath InfluxDB endpoint",
 		MaxRequestBodySize: MaxBodySize,
-		Handler:            router.Handler,
+		Handler:            drainer.Handler(router.Handler),
 	}
 
-	doneCh := make(chan bool)
-	go followProducer(kafkaProducer, doneCh)
+	tally := &producerTally{}
+	followed := make(chan struct{})
+	go func() {
+		followProducer(kafkaProducer, queue, deadLetters, tally)
+		close(followed)
+	}()
 
+	doneCh := make(chan bool)
 	wg := &sync.WaitGroup{}
+	if spool != nil {
+		wg.Add(1)
+		go spool.Replay(kafkaProducer.Input(), wg, doneCh)
+	}
+
 	if config.HTTP.Enabled {
 		go serveHTTP(server, &config.HTTP, wg, doneCh)
 	}
 	if config.HTTPS.Enabled {
-		go serveHTTPS(server, &config.HTTPS, wg, doneCh)
+		go serveHTTPS(server, &config.HTTPS, tlsStore, wg, doneCh)
+		if config.HTTPS.CertificateWatch > 0 {
+			go tlsStore.Watch(config.HTTPS.CertificateWatch, doneCh)
+		}
 	}
 
-	signalCh := make(chan os.Signal)
+	reloader := newReloader(config, write, auth, tlsStore)
+	if config.ConfigWatch > 0 {
+		go reloader.Watch(config.ConfigWatch, doneCh)
+	}
+
+	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh,
-		os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+		os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signalCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
 
-	<-signalCh
+		log.Info("Reloading the configuration.")
+		if err := reloader.Reload(); err != nil {
+			log.WithError(err).Error("Couldn't reload the configuration.")
+		}
+	}
 	log.Infof("Shutting down...")
+	before := tally.Snapshot()
 
+	// Stop taking requests and replaying the spool, and let the requests
+	// being handled finish, before flushing what they wrote to Kafka.
 	close(doneCh)
 	wg.Wait()
-}
-
-func newKafkaClient(brokers []string, timeout time.Duration, version sarama.KafkaVersion) (client sarama.Client, err error) {
-	config := sarama.NewConfig()
-
-	config.Producer.RequiredAcks = sarama.WaitForLocal       // Only wait for the leader to ack
-	config.Producer.Compression = sarama.CompressionSnappy   // Compress messages
-	config.Producer.Flush.Frequency = 500 * time.Millisecond // Flush batches every 500ms
-	config.Producer.Return.Successes = true
-	config.Version = version
-
-	retryTimeout := time.Duration(10 * time.Second)
-	for {
-		client, err = sarama.NewClient(brokers, config)
-		if err == nil {
-			log.Infof("Connected to Kafka: %s", strings.Join(brokers, ","))
-			break
-		}
+	abandoned := drainer.Drain(config.Shutdown.Grace)
+	if abandoned > 0 {
+		log.WithFields(log.Fields{
+			"requests": abandoned,
+			"grace":    config.Shutdown.Grace,
+		}).Error("Gave up waiting for requests to finish.")
+	}
 
-		log.Errorf("Couldn't connect to Kafka! Trying again in %v. %v", retryTimeout, err)
-		time.Sleep(retryTimeout)
+	// Writes still waiting on the producer give up, spooling their lines
+	// if they can, so that nothing is sent to it once it's closed.
+	write.Close()
+	queue.Close()
+	deadLetters.Close()
+	flushed := flushProducer(kafkaProducer, followed, config.Shutdown.FlushTimeout)
+	spool.Close()
+
+	counts := tally.Snapshot().Since(before)
+	lost := counts.failed + queue.Lost()
+	if !flushed {
+		lost += queue.Depth()
+		log.WithFields(log.Fields{
+			"timeout": config.Shutdown.FlushTimeout,
+		}).Error("Gave up waiting for Kafka to acknowledge the producer's messages.")
 	}
 
-	return
+	fields := log.Fields{
+		"flushed": counts.succeeded,
+		"spooled": counts.spooled,
+		"lost":    lost,
+	}
+	if lost > 0 || abandoned > 0 {
+		log.WithFields(fields).Error("Shut down, losing messages.")
+		os.Exit(1)
+	}
+	log.WithFields(fields).Info("Shut down.")
 }
 
 func serveHTTP(server *fasthttp.Server, config *HTTPConfig, wg *sync.WaitGroup, doneCh chan bool) {
@@ -112,8 +198,8 @@ func serveHTTP(server *fasthttp.Server, config *HTTPConfig, wg *sync.WaitGroup,
 	}
 
 	log.Infof("Starting Telepath server: %v", listener.Addr())
+	wg.Add(1)
 	go func(listener net.Listener) {
-		wg.Add(1)
 		defer wg.Done()
 
 		if err := server.Serve(listener); err != nil {
@@ -127,56 +213,15 @@ func serveHTTP(server *fasthttp.Server, config *HTTPConfig, wg *sync.WaitGroup,
 	listener.Close()
 }
 
-func serveHTTPS(server *fasthttp.Server, config *HTTPSConfig, wg *sync.WaitGroup, doneCh chan bool) {
-	serverCertificate, err := tls.LoadX509KeyPair(config.CertificatePath, config.KeyPath)
-	if err != nil {
-		log.Fatalf("Could not load server certificate %s: %v", config.CertificatePath, err)
-	}
-
-	var clientAuth tls.ClientAuthType
-	var clientCertPool *x509.CertPool
-	switch config.ClientVerify {
-	case "optional":
-		clientAuth = tls.RequestClientCert
-		break
-	case "required":
-		clientAuth = tls.RequireAndVerifyClientCert
-		break
-	}
-
-	if clientAuth != tls.NoClientCert {
-		clientCertPool = x509.NewCertPool()
-		for _, certificatePath := range config.ClientCertificatePaths {
-			certBytes, err := ioutil.ReadFile(certificatePath)
-			if err != nil {
-				log.Fatalf("Could not load client certificate %s: %v", certificatePath, err)
-			}
-
-			block, certBytes := pem.Decode(certBytes)
-			clientCertificate, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				log.Fatalf("Could not parse client certificate %s: %v", certificatePath, err)
-			}
-
-			log.Debugf("Adding client certificate %s", certificatePath)
-
-			clientCertPool.AddCert(clientCertificate)
-		}
-	}
-
-	listener, err := tls.Listen("tcp4", config.Addr, &tls.Config{
-		Certificates: []tls.Certificate{serverCertificate},
-		ClientCAs:    clientCertPool,
-		ClientAuth:   clientAuth,
-	})
-
+func serveHTTPS(server *fasthttp.Server, config *HTTPSConfig, store *tlsStore, wg *sync.WaitGroup, doneCh chan bool) {
+	listener, err := tls.Listen("tcp4", config.Addr, store.ListenerConfig())
 	if err != nil {
 		log.Fatalf("Could not setup tls config: %v", err)
 	}
 
 	log.Infof("Starting Telepath server: %v", listener.Addr())
-	go func(litener net.Listener) {
-		wg.Add(1)
+	wg.Add(1)
+	go func(listener net.Listener) {
 		defer wg.Done()
 
 		if err := server.Serve(listener); err != nil {
@@ -190,24 +235,98 @@ func serveHTTPS(server *fasthttp.Server, config *HTTPSConfig, wg *sync.WaitGroup
 	listener.Close()
 }
 
-func followProducer(producer sarama.AsyncProducer, doneCh chan bool) {
-	for {
+// loadCredentials reads the users and API tokens files, if there are any.
+func loadCredentials(config *middleware.AuthConfig) error {
+	if config.UsersPath != "" {
+		users, err := middleware.LoadUserStore(config.UsersPath)
+		if err != nil {
+			return fmt.Errorf("could not load users %s: %v", config.UsersPath, err)
+		}
+		config.Users = users
+	}
+
+	if config.TokensPath != "" {
+		tokens, err := middleware.LoadTokenStore(config.TokensPath)
+		if err != nil {
+			return fmt.Errorf("could not load API tokens %s: %v", config.TokensPath, err)
+		}
+		config.Tokens = tokens
+	}
+
+	if config.JWT.KeysPath != "" {
+		keys, err := middleware.LoadKeySet(config.JWT.KeysPath)
+		if err != nil {
+			return fmt.Errorf("could not load JWT keys %s: %v", config.JWT.KeysPath, err)
+		}
+		config.JWT.Keys = keys
+	}
+
+	if config.CertificatesPath != "" {
+		certificates, err := middleware.LoadCertificateStore(config.CertificatesPath)
+		if err != nil {
+			return fmt.Errorf("could not load client certificate identities %s: %v", config.CertificatesPath, err)
+		}
+		config.Certificates = certificates
+	}
+
+	return nil
+}
+
+// loadRoutes returns the routes given in the config, or in a routes file.
+func loadRoutes(config *TelepathConfig) (*RoutesConfig, error) {
+	if config.RoutesPath == "" {
+		return config.Routes, nil
+	}
+
+	routes, err := LoadRoutes(config.RoutesPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load routes %s: %v", config.RoutesPath, err)
+	}
+
+	return routes, nil
+}
+
+// followProducer counts and acknowledges the messages Kafka accepted or
+// refused, until the producer is closed and has handed them all back.
+// Refused messages are spooled, if there is a spool and Kafka might take
+// them later, and dead-lettered otherwise.
+func followProducer(producer sarama.AsyncProducer, queue *producerQueue, deadLetters *deadLetters, tally *producerTally) {
+	errs, successes := producer.Errors(), producer.Successes()
+	for errs != nil || successes != nil {
 		select {
-		case <-doneCh:
-			return
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
 
-		case err := <-producer.Errors():
 			msg := err.Msg
 			metrics.KafkaProducerErrorCount(msg.Topic).Inc()
+			acknowledge(msg, err)
+			queue.Acknowledged(msg)
+			spooled := queue.Rescue(err)
+			if !spooled {
+				deadLetters.Failed(err)
+			}
+			tally.Failure(msg, spooled)
 
 			line, _ := msg.Value.Encode()
 			log.WithFields(log.Fields{
-				"line":  string(line),
-				"topic": msg.Topic,
+				"line":    string(line),
+				"topic":   msg.Topic,
+				"spooled": spooled,
 			}).Debugf("Unable to produce a line to the '%s' topic: %v", msg.Topic, err.Err)
 
-		case msg := <-producer.Successes():
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+
 			metrics.KafkaProducerSuccessCount(msg.Topic).Inc()
+			acknowledge(msg, nil)
+			queue.Acknowledged(msg)
+			tally.Success(msg)
 
 			line, _ := msg.Value.Encode()
 			log.WithFields(log.Fields{
@@ -23,6 +23,9 @@ type prometheusMetrics struct {
 	writeRequestCount *prometheus.CounterVec
 	writeRequestTime  *prometheus.SummaryVec
 	writeRequestSize  *prometheus.SummaryVec
+	writeErrorCount   *prometheus.CounterVec
+
+	writePrincipalRequestCount *prometheus.CounterVec
 
 	influxPayloadCount     *prometheus.CounterVec
 	influxPayloadSize      *prometheus.SummaryVec
@@ -32,6 +35,35 @@ type prometheusMetrics struct {
 
 	kafkaProducerSuccessCount *prometheus.CounterVec
 	kafkaProducerErrorCount   *prometheus.CounterVec
+	kafkaProducerMessageLines *prometheus.SummaryVec
+
+	routeLineCount          *prometheus.CounterVec
+	routeErrorCount         *prometheus.CounterVec
+	routeUnmatchedLineCount *prometheus.CounterVec
+
+	tlsCertificateExpiry *prometheus.GaugeVec
+
+	spoolMessageCount         *prometheus.CounterVec
+	spoolDroppedMessageCount  prometheus.Counter
+	spoolReplayedMessageCount prometheus.Counter
+	spoolBytes                prometheus.Gauge
+	spoolAge                  prometheus.Gauge
+
+	backpressureQueueDepth     prometheus.Gauge
+	backpressureInflightBytes  prometheus.Gauge
+	backpressureStall          prometheus.Gauge
+	backpressureRejectionCount *prometheus.CounterVec
+
+	rateLimitRejectedRequestCount *prometheus.CounterVec
+	rateLimitRejectedLineCount    *prometheus.CounterVec
+	rateLimitRejectedByteCount    *prometheus.CounterVec
+	rateLimitBuckets              prometheus.Gauge
+
+	cardinalitySeries            *prometheus.GaugeVec
+	cardinalityStrippedLineCount *prometheus.CounterVec
+
+	deadLetterCount        *prometheus.CounterVec
+	deadLetterSkippedCount *prometheus.CounterVec
 }
 
 var register sync.Once
@@ -62,6 +94,10 @@ func (m *prometheusMetrics) WriteRequestSize(verb []byte, status int) prometheus
 	return m.writeRequestSize.WithLabelValues(string(verb), strconv.Itoa(status))
 }
 
+func (m *prometheusMetrics) WriteErrorCount(db, reason string) prometheus.Counter {
+	return m.writeErrorCount.WithLabelValues(db, reason)
+}
+
 func (m *prometheusMetrics) InfluxPayloadCount(db string) prometheus.Counter {
 	return m.influxPayloadCount.WithLabelValues(db)
 }
@@ -74,14 +110,18 @@ func (m *prometheusMetrics) InfluxTotalLineCount(db string) prometheus.Counter {
 	return m.influxTotalLineCount.WithLabelValues(db)
 }
 
-func (m *prometheusMetrics) InfluxDroppedLineCount(db string) prometheus.Counter {
-	return m.influxDroppedLineCount.WithLabelValues(db)
+func (m *prometheusMetrics) InfluxDroppedLineCount(db, reason string) prometheus.Counter {
+	return m.influxDroppedLineCount.WithLabelValues(db, reason)
 }
 
 func (m *prometheusMetrics) InfluxLineLength(db string) prometheus.Summary {
 	return m.influxLineLength.WithLabelValues(db)
 }
 
+func (m *prometheusMetrics) WritePrincipalRequestCount(method, principal string, status int) prometheus.Counter {
+	return m.writePrincipalRequestCount.WithLabelValues(method, principal, strconv.Itoa(status))
+}
+
 func (m *prometheusMetrics) KafkaProducerSuccessCount(topic string) prometheus.Counter {
 	return m.kafkaProducerSuccessCount.WithLabelValues(topic)
 }
@@ -90,6 +130,99 @@ func (m *prometheusMetrics) KafkaProducerErrorCount(topic string) prometheus.Cou
 	return m.kafkaProducerErrorCount.WithLabelValues(topic)
 }
 
+func (m *prometheusMetrics) KafkaProducerMessageLines(topic string) prometheus.Summary {
+	return m.kafkaProducerMessageLines.WithLabelValues(topic)
+}
+
+func (m *prometheusMetrics) RouteLineCount(route string) prometheus.Counter {
+	return m.routeLineCount.WithLabelValues(route)
+}
+
+func (m *prometheusMetrics) RouteErrorCount(route string) prometheus.Counter {
+	return m.routeErrorCount.WithLabelValues(route)
+}
+
+func (m *prometheusMetrics) RouteUnmatchedLineCount(db, action string) prometheus.Counter {
+	return m.routeUnmatchedLineCount.WithLabelValues(db, action)
+}
+
+func (m *prometheusMetrics) TLSCertificateExpiry(role, path, subject string) prometheus.Gauge {
+	return m.tlsCertificateExpiry.WithLabelValues(role, path, subject)
+}
+
+// ResetTLSCertificateExpiry forgets certificates which are no longer used.
+func (m *prometheusMetrics) ResetTLSCertificateExpiry() {
+	m.tlsCertificateExpiry.Reset()
+}
+
+func (m *prometheusMetrics) SpoolMessageCount(reason string) prometheus.Counter {
+	return m.spoolMessageCount.WithLabelValues(reason)
+}
+
+func (m *prometheusMetrics) SpoolDroppedMessageCount() prometheus.Counter {
+	return m.spoolDroppedMessageCount
+}
+
+func (m *prometheusMetrics) SpoolReplayedMessageCount() prometheus.Counter {
+	return m.spoolReplayedMessageCount
+}
+
+func (m *prometheusMetrics) SpoolBytes() prometheus.Gauge {
+	return m.spoolBytes
+}
+
+func (m *prometheusMetrics) SpoolAge() prometheus.Gauge {
+	return m.spoolAge
+}
+
+func (m *prometheusMetrics) BackpressureQueueDepth() prometheus.Gauge {
+	return m.backpressureQueueDepth
+}
+
+func (m *prometheusMetrics) BackpressureInflightBytes() prometheus.Gauge {
+	return m.backpressureInflightBytes
+}
+
+func (m *prometheusMetrics) BackpressureStall() prometheus.Gauge {
+	return m.backpressureStall
+}
+
+func (m *prometheusMetrics) BackpressureRejectionCount(reason string) prometheus.Counter {
+	return m.backpressureRejectionCount.WithLabelValues(reason)
+}
+
+func (m *prometheusMetrics) RateLimitRejectedRequestCount(db, limit string) prometheus.Counter {
+	return m.rateLimitRejectedRequestCount.WithLabelValues(db, limit)
+}
+
+func (m *prometheusMetrics) RateLimitRejectedLineCount(db string) prometheus.Counter {
+	return m.rateLimitRejectedLineCount.WithLabelValues(db)
+}
+
+func (m *prometheusMetrics) RateLimitRejectedByteCount(db string) prometheus.Counter {
+	return m.rateLimitRejectedByteCount.WithLabelValues(db)
+}
+
+func (m *prometheusMetrics) RateLimitBuckets() prometheus.Gauge {
+	return m.rateLimitBuckets
+}
+
+func (m *prometheusMetrics) CardinalitySeries(db string) prometheus.Gauge {
+	return m.cardinalitySeries.WithLabelValues(db)
+}
+
+func (m *prometheusMetrics) CardinalityStrippedLineCount(db string) prometheus.Counter {
+	return m.cardinalityStrippedLineCount.WithLabelValues(db)
+}
+
+func (m *prometheusMetrics) DeadLetterCount(reason string) prometheus.Counter {
+	return m.deadLetterCount.WithLabelValues(reason)
+}
+
+func (m *prometheusMetrics) DeadLetterSkippedCount(cause string) prometheus.Counter {
+	return m.deadLetterSkippedCount.WithLabelValues(cause)
+}
+
 func init() {
 	metrics = &prometheusMetrics{
 		handler: fasthttpadaptor.NewFastHTTPHandler(prometheus.Handler()),
@@ -128,6 +261,13 @@ func init() {
 			Help:      "Size of requests to the /write endpoint in bytes",
 		}, []string{"verb", "status"}),
 
+		writeErrorCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "write",
+			Name:      "errors_total",
+			Help:      "Count of rejected or partially written requests to the /write endpoint",
+		}, []string{"db", "reason"}),
+
 		influxPayloadCount: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "telepath",
 			Subsystem: "influx",
@@ -153,8 +293,8 @@ func init() {
 			Namespace: "telepath",
 			Subsystem: "influx",
 			Name:      "dropped_lines_total",
-			Help:      "Count of invalid or unparsable Influx metric lines",
-		}, []string{"db"}),
+			Help:      "Count of Influx metric lines dropped, by why",
+		}, []string{"db", "reason"}),
 
 		influxLineLength: prometheus.NewSummaryVec(prometheus.SummaryOpts{
 			Namespace: "telepath",
@@ -163,6 +303,13 @@ func init() {
 			Help:      "Size of Influx metric lines in bytes",
 		}, []string{"db"}),
 
+		writePrincipalRequestCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "write",
+			Name:      "principal_requests_total",
+			Help:      "Count of authenticated requests against the /write endpoint, by user or token name",
+		}, []string{"method", "principal", "status"}),
+
 		kafkaProducerSuccessCount: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "telepath",
 			Subsystem: "kafka_producer",
@@ -176,6 +323,160 @@ func init() {
 			Name:      "errors_total",
 			Help:      "Count of errors returned from Kafka producer",
 		}, []string{"topic"}),
+
+		kafkaProducerMessageLines: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: "telepath",
+			Subsystem: "kafka_producer",
+			Name:      "message_lines",
+			Help:      "Count of Influx metric lines batched into each Kafka message",
+		}, []string{"topic"}),
+
+		routeLineCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "route",
+			Name:      "lines_total",
+			Help:      "Count of Influx metric lines matched by each routing rule",
+		}, []string{"route"}),
+
+		routeErrorCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "route",
+			Name:      "errors_total",
+			Help:      "Count of Influx metric lines a routing rule couldn't build a topic for",
+		}, []string{"route"}),
+
+		routeUnmatchedLineCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "route",
+			Name:      "unmatched_lines_total",
+			Help:      "Count of Influx metric lines matched by no routing rule",
+		}, []string{"db", "action"}),
+
+		tlsCertificateExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "tls",
+			Name:      "certificate_expiry_timestamp_seconds",
+			Help:      "Unix time at which each TLS certificate in use expires",
+		}, []string{"role", "path", "subject"}),
+
+		spoolMessageCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "spool",
+			Name:      "messages_total",
+			Help:      "Count of Kafka messages spooled to disk, because the producer was too slow or failed",
+		}, []string{"reason"}),
+
+		spoolDroppedMessageCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "spool",
+			Name:      "dropped_messages_total",
+			Help:      "Count of Kafka messages the spool was too full to keep, or Kafka refused on replay",
+		}),
+
+		spoolReplayedMessageCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "spool",
+			Name:      "replayed_messages_total",
+			Help:      "Count of spooled Kafka messages replayed to Kafka",
+		}),
+
+		spoolBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "spool",
+			Name:      "bytes",
+			Help:      "Size of the spool's segment files in bytes",
+		}),
+
+		spoolAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "spool",
+			Name:      "oldest_message_age_seconds",
+			Help:      "Age of the oldest message waiting in the spool in seconds",
+		}),
+
+		backpressureQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "backpressure",
+			Name:      "queue_depth",
+			Help:      "Count of Kafka messages handed to the producer and not yet acknowledged",
+		}),
+
+		backpressureInflightBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "backpressure",
+			Name:      "inflight_bytes",
+			Help:      "Size of the write requests being handled in bytes",
+		}),
+
+		backpressureStall: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "backpressure",
+			Name:      "producer_stall_seconds",
+			Help:      "How long writes have been waiting for the producer to take a message in seconds",
+		}),
+
+		backpressureRejectionCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "backpressure",
+			Name:      "rejections_total",
+			Help:      "Count of write requests turned away because Kafka couldn't keep up",
+		}, []string{"reason"}),
+
+		rateLimitRejectedRequestCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "ratelimit",
+			Name:      "rejected_requests_total",
+			Help:      "Count of write requests over a rate limit, by the limit exceeded",
+		}, []string{"db", "limit"}),
+
+		rateLimitRejectedLineCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "ratelimit",
+			Name:      "rejected_lines_total",
+			Help:      "Count of Influx metric lines in write requests over a rate limit",
+		}, []string{"db"}),
+
+		rateLimitRejectedByteCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "ratelimit",
+			Name:      "rejected_bytes_total",
+			Help:      "Size of write requests over a rate limit in bytes",
+		}, []string{"db"}),
+
+		rateLimitBuckets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "ratelimit",
+			Name:      "buckets",
+			Help:      "Count of databases, principals or client IPs with rate limit buckets in use",
+		}),
+
+		cardinalitySeries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "telepath",
+			Subsystem: "cardinality",
+			Name:      "series",
+			Help:      "Estimated count of series written to each database within the cardinality window",
+		}, []string{"db"}),
+
+		cardinalityStrippedLineCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "cardinality",
+			Name:      "stripped_lines_total",
+			Help:      "Count of Influx metric lines over the series limit which had tags stripped",
+		}, []string{"db"}),
+
+		deadLetterCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "deadletter",
+			Name:      "lines_total",
+			Help:      "Count of lines sent to the dead letter topic, by why they couldn't be written",
+		}, []string{"reason"}),
+
+		deadLetterSkippedCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "telepath",
+			Subsystem: "deadletter",
+			Name:      "skipped_lines_total",
+			Help:      "Count of lines which couldn't be written and weren't sent to the dead letter topic either",
+		}, []string{"cause"}),
 	}
 
 	register.Do(func() {
@@ -184,6 +485,8 @@ func init() {
 		prometheus.MustRegister(metrics.writeRequestCount)
 		prometheus.MustRegister(metrics.writeRequestTime)
 		prometheus.MustRegister(metrics.writeRequestSize)
+		prometheus.MustRegister(metrics.writeErrorCount)
+		prometheus.MustRegister(metrics.writePrincipalRequestCount)
 
 		prometheus.MustRegister(metrics.influxPayloadCount)
 		prometheus.MustRegister(metrics.influxPayloadSize)
@@ -193,5 +496,32 @@ func init() {
 
 		prometheus.MustRegister(metrics.kafkaProducerSuccessCount)
 		prometheus.MustRegister(metrics.kafkaProducerErrorCount)
+		prometheus.MustRegister(metrics.kafkaProducerMessageLines)
+
+		prometheus.MustRegister(metrics.routeLineCount)
+		prometheus.MustRegister(metrics.routeErrorCount)
+		prometheus.MustRegister(metrics.routeUnmatchedLineCount)
+
+		prometheus.MustRegister(metrics.tlsCertificateExpiry)
+
+		prometheus.MustRegister(metrics.spoolMessageCount)
+		prometheus.MustRegister(metrics.spoolDroppedMessageCount)
+		prometheus.MustRegister(metrics.spoolReplayedMessageCount)
+		prometheus.MustRegister(metrics.spoolBytes)
+		prometheus.MustRegister(metrics.spoolAge)
+
+		prometheus.MustRegister(metrics.backpressureQueueDepth)
+		prometheus.MustRegister(metrics.backpressureInflightBytes)
+		prometheus.MustRegister(metrics.backpressureStall)
+		prometheus.MustRegister(metrics.backpressureRejectionCount)
+
+		prometheus.MustRegister(metrics.rateLimitRejectedRequestCount)
+		prometheus.MustRegister(metrics.rateLimitRejectedLineCount)
+		prometheus.MustRegister(metrics.rateLimitRejectedByteCount)
+		prometheus.MustRegister(metrics.rateLimitBuckets)
+		prometheus.MustRegister(metrics.cardinalitySeries)
+		prometheus.MustRegister(metrics.cardinalityStrippedLineCount)
+		prometheus.MustRegister(metrics.deadLetterCount)
+		prometheus.MustRegister(metrics.deadLetterSkippedCount)
 	})
 }
@@ -2,45 +2,147 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
+	"sync/atomic"
 
 	"github.com/valyala/fasthttp"
 )
 
 type AuthConfig struct {
-	Enabled  bool
-	Username string
-	Password string
+	Enabled    bool        `yaml:"enabled"`
+	Username   string      `yaml:"username"`
+	Password   string      `yaml:"password"`
+	UsersPath  string      `yaml:"users"`
+	Users      *UserStore  `yaml:"-"`
+	TokensPath string      `yaml:"tokens"`
+	Tokens     *TokenStore `yaml:"-"`
+	JWT        JWTConfig   `yaml:"jwt"`
+
+	CertificatesPath string            `yaml:"certificates"`
+	Certificates     *CertificateStore `yaml:"-"`
 }
 
 var basicAuthHeaderPrefix = []byte("Basic ")
+var tokenAuthHeaderPrefix = []byte("Token ")
+var bearerAuthHeaderPrefix = []byte("Bearer ")
 
-// Auth is an authentication handler
-func Auth(h fasthttp.RequestHandler, config *AuthConfig) fasthttp.RequestHandler {
-	if !config.Enabled {
-		return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-			h(ctx)
-			return
-		})
+// principalKey holds the authenticated Principal in the request's user
+// values.
+const principalKey = "telepath.principal"
+
+// PrincipalFrom returns who authenticated the request, or nil.
+func PrincipalFrom(ctx *fasthttp.RequestCtx) *Principal {
+	principal, _ := ctx.UserValue(principalKey).(*Principal)
+	return principal
+}
+
+// User returns the name of the user, or token, which authenticated the
+// request, if any.
+func User(ctx *fasthttp.RequestCtx) string {
+	if principal := PrincipalFrom(ctx); principal != nil {
+		return principal.Name
 	}
+	return ""
+}
+
+// Authenticator checks requests against credentials which may be replaced
+// while it is serving.
+type Authenticator struct {
+	config atomic.Value
+}
 
+func NewAuthenticator(config AuthConfig) *Authenticator {
+	a := &Authenticator{}
+	a.Update(config)
+	return a
+}
+
+// Update replaces the credentials. Requests already authenticated are
+// unaffected.
+func (a *Authenticator) Update(config AuthConfig) {
+	a.config.Store(&config)
+}
+
+// Handler wraps h, calling it only for authenticated requests, which are
+// allowed to use the database they name. Requests without credentials may
+// be authenticated by their client certificate.
+func (a *Authenticator) Handler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-		if success, attempt := passQuerystringAuth(ctx, config.Username, config.Password); attempt {
-			if success {
-				h(ctx)
-				return
-			}
-		} else if success, _ := passBasicAuth(ctx, config.Username, config.Password); success {
+		config := a.config.Load().(*AuthConfig)
+		if !config.Enabled {
 			h(ctx)
 			return
 		}
 
-		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusUnauthorized), fasthttp.StatusUnauthorized)
-		ctx.Response.Header.Set("WWW-Authenticate", "Basic realm=Restricted")
+		var principal *Principal
+		if p, attempt := passQuerystringAuth(ctx, config); attempt {
+			principal = p
+		} else if p, attempt := passBasicAuth(ctx, config); attempt {
+			principal = p
+		} else if p, attempt := passTokenAuth(ctx, config); attempt {
+			principal = p
+		} else {
+			principal = config.Certificates.Authenticate(ctx.TLSConnectionState())
+		}
+
+		if principal == nil {
+			ctx.Error(fasthttp.StatusMessage(fasthttp.StatusUnauthorized), fasthttp.StatusUnauthorized)
+			ctx.Response.Header.Set("WWW-Authenticate", "Basic realm=Restricted")
+			return
+		}
+
+		for _, db := range requestDatabases(ctx) {
+			if !principal.Databases.Allowed(db) {
+				ctx.Error(fmt.Sprintf("not allowed to use database %q", db), fasthttp.StatusForbidden)
+				return
+			}
+		}
+
+		ctx.SetUserValue(principalKey, principal)
+		h(ctx)
 	})
 }
 
-func passQuerystringAuth(ctx *fasthttp.RequestCtx, username, password string) (success, attempt bool) {
+// Auth is an authentication handler
+func Auth(h fasthttp.RequestHandler, config *AuthConfig) fasthttp.RequestHandler {
+	return NewAuthenticator(*config).Handler(h)
+}
+
+// authenticate checks a username and password against the user store,
+// then the single configured user.
+func (config *AuthConfig) authenticate(username, password string) *Principal {
+	if principal := config.Users.Authenticate(username, password); principal != nil {
+		return principal
+	}
+
+	if config.Username == "" {
+		return nil
+	}
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(config.Username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(config.Password))
+	if u&p != 1 {
+		return nil
+	}
+	return &Principal{Name: config.Username, Method: MethodPassword}
+}
+
+// requestDatabases returns the databases named by a request: the db of an
+// InfluxDB 1.x request, and the bucket of a 2.x one. A request may name
+// both, and each must be allowed, since which one is written to depends on
+// the endpoint.
+func requestDatabases(ctx *fasthttp.RequestCtx) []string {
+	var dbs []string
+	for _, param := range []string{"db", "bucket"} {
+		if db := ctx.QueryArgs().Peek(param); len(db) > 0 {
+			dbs = append(dbs, string(db))
+		}
+	}
+	return dbs
+}
+
+func passQuerystringAuth(ctx *fasthttp.RequestCtx, config *AuthConfig) (principal *Principal, attempt bool) {
 	u := ctx.QueryArgs().Peek("u")
 	p := ctx.QueryArgs().Peek("p")
 	if u == nil {
@@ -48,11 +150,15 @@ func passQuerystringAuth(ctx *fasthttp.RequestCtx, username, password string) (s
 	}
 
 	attempt = true
-	success = string(u) == username && p != nil && string(p) == password
+	if p == nil {
+		return
+	}
+
+	principal = config.authenticate(string(u), string(p))
 	return
 }
 
-func passBasicAuth(ctx *fasthttp.RequestCtx, username, password string) (success, attempt bool) {
+func passBasicAuth(ctx *fasthttp.RequestCtx, config *AuthConfig) (principal *Principal, attempt bool) {
 	auth := ctx.Request.Header.Peek("Authorization")
 	if !bytes.HasPrefix(auth, basicAuthHeaderPrefix) {
 		return
@@ -69,6 +175,27 @@ func passBasicAuth(ctx *fasthttp.RequestCtx, username, password string) (success
 		return
 	}
 
-	success = string(pair[0]) == username && string(pair[1]) == password
+	principal = config.authenticate(string(pair[0]), string(pair[1]))
+	return
+}
+
+func passTokenAuth(ctx *fasthttp.RequestCtx, config *AuthConfig) (principal *Principal, attempt bool) {
+	auth := ctx.Request.Header.Peek("Authorization")
+	var token []byte
+	switch {
+	case bytes.HasPrefix(auth, tokenAuthHeaderPrefix):
+		token = auth[len(tokenAuthHeaderPrefix):]
+	case bytes.HasPrefix(auth, bearerAuthHeaderPrefix):
+		token = auth[len(bearerAuthHeaderPrefix):]
+	default:
+		return
+	}
+
+	attempt = true
+	if config.JWT.Keys != nil && looksLikeJWT(token) {
+		principal, _ = config.JWT.Authenticate(token)
+		return
+	}
+	principal = config.Tokens.Authenticate(token)
 	return
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttputil"
 )
@@ -21,6 +22,7 @@ func Test_auth(t *testing.T) {
 		password      string
 		authorization string
 		querystring   string
+		tokens        []string
 		status        int
 	}{
 		{
@@ -69,11 +71,41 @@ func Test_auth(t *testing.T) {
 			authorization: "Basic am9lOnNlY3JldA==",
 			status:        http.StatusUnauthorized,
 		},
+		{
+			label:         "authorized-with-token",
+			tokens:        []string{"first", "second"},
+			authorization: "Token second",
+			status:        http.StatusOK,
+		},
+		{
+			label:         "unauthorized-with-bad-token",
+			tokens:        []string{"first", "second"},
+			authorization: "Token third",
+			status:        http.StatusUnauthorized,
+		},
+		{
+			label:         "authorized-with-bearer-token",
+			tokens:        []string{"first", "second"},
+			authorization: "Bearer first",
+			status:        http.StatusOK,
+		},
+		{
+			label:         "unauthorized-without-tokens",
+			authorization: "Token first",
+			status:        http.StatusUnauthorized,
+		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.label, func(t *testing.T) {
 			config := AuthConfig{Enabled: true, Username: c.user, Password: c.password}
+			if c.tokens != nil {
+				var tokens []Token
+				for _, token := range c.tokens {
+					tokens = append(tokens, Token{Name: token, Hash: HashToken(token)})
+				}
+				config.Tokens = NewTokenStore(tokens...)
+			}
 			client, teardown := newClient(Auth(okHandlerFunc, &config))
 			defer teardown()
 
@@ -92,6 +124,79 @@ func Test_auth(t *testing.T) {
 	}
 }
 
+func Test_auth_user(t *testing.T) {
+	config := AuthConfig{Enabled: true, Username: "joe", Password: "secret"}
+	client, teardown := newClient(Auth(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(User(ctx))
+	}, &config))
+	defer teardown()
+
+	for _, querystring := range []string{"?u=joe&p=secret", ""} {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+
+		req.SetRequestURI("http://foo/ok" + querystring)
+		req.Header.Add("Authorization", "Basic am9lOnNlY3JldA==")
+		err := client.Do(&req, &resp)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "joe", string(resp.Body()))
+	}
+}
+
+func Test_auth_checks_every_database_named(t *testing.T) {
+	tokens := NewTokenStore(Token{
+		Name:      "telegraf",
+		Hash:      HashToken("secret"),
+		Databases: DatabaseACL{Allow: []string{"telegraf"}},
+	})
+	client, teardown := newClient(Auth(okHandlerFunc, &AuthConfig{Enabled: true, Tokens: tokens}))
+	defer teardown()
+
+	cases := []struct {
+		uri    string
+		status int
+	}{
+		{"http://foo/api/v2/write?bucket=telegraf", http.StatusOK},
+		{"http://foo/api/v2/write?db=telegraf&bucket=secret", http.StatusForbidden},
+		{"http://foo/api/v2/write?bucket=secret&db=telegraf", http.StatusForbidden},
+		{"http://foo/write?db=secret&bucket=telegraf", http.StatusForbidden},
+		{"http://foo/write?db=telegraf&bucket=telegraf", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI(c.uri)
+		req.Header.Set("Authorization", "Token secret")
+		err := client.Do(&req, &resp)
+
+		require.NoError(t, err)
+		assert.Equal(t, c.status, resp.StatusCode(), c.uri)
+	}
+}
+
+func Test_authenticator_update(t *testing.T) {
+	auth := NewAuthenticator(AuthConfig{Enabled: true, Username: "joe", Password: "secret"})
+	client, teardown := newClient(auth.Handler(okHandlerFunc))
+	defer teardown()
+
+	status := func() int {
+		statusCode, _, err := client.Get(nil, "http://foo/ok?u=joe&p=secret")
+		assert.NoError(t, err)
+		return statusCode
+	}
+
+	assert.Equal(t, http.StatusOK, status())
+
+	auth.Update(AuthConfig{Enabled: true, Username: "joe", Password: "changed"})
+	assert.Equal(t, http.StatusUnauthorized, status())
+
+	auth.Update(AuthConfig{Enabled: false})
+	assert.Equal(t, http.StatusOK, status())
+}
+
 func newClient(handlerFunc func(*fasthttp.RequestCtx)) (*fasthttp.Client, func()) {
 	server := &fasthttp.Server{
 		Handler: handlerFunc,
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CertificateStore maps the identities in verified client certificates to
+// principals. Each identity is a glob, as in path.Match, over the
+// certificate's common name, one of its DNS names or one of its URIs,
+// such as a SPIFFE ID. The first identity to match wins.
+//
+//	certificates:
+//	  - name: billing
+//	    uri: spiffe://example.com/ns/billing/sa/*
+//	    databases:
+//	      allow: [billing]
+//	  - name: edge
+//	    dns: "*.edge.example.com"
+type CertificateStore struct {
+	identities []certificateIdentity
+}
+
+type certificateIdentity struct {
+	commonName string
+	dns        string
+	uri        string
+	principal  *Principal
+}
+
+type certificateFile struct {
+	Certificates []struct {
+		Name       string      `yaml:"name"`
+		CommonName string      `yaml:"common_name"`
+		DNS        string      `yaml:"dns"`
+		URI        string      `yaml:"uri"`
+		Databases  DatabaseACL `yaml:"databases"`
+	} `yaml:"certificates"`
+}
+
+// LoadCertificateStore reads a YAML file of client certificate identities.
+func LoadCertificateStore(filename string) (*CertificateStore, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file certificateFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	cs := &CertificateStore{}
+	for i, c := range file.Certificates {
+		if c.Name == "" {
+			return nil, fmt.Errorf("certificate %d: a name is required", i+1)
+		}
+
+		var patterns []string
+		for _, pattern := range []string{c.CommonName, c.DNS, c.URI} {
+			if pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		if len(patterns) != 1 {
+			return nil, fmt.Errorf("certificate %s: exactly one of common_name, dns or uri is required", c.Name)
+		}
+		if _, err := path.Match(patterns[0], ""); err != nil {
+			return nil, fmt.Errorf("certificate %s: invalid pattern %q: %v", c.Name, patterns[0], err)
+		}
+		if err := c.Databases.validate(); err != nil {
+			return nil, fmt.Errorf("certificate %s: %v", c.Name, err)
+		}
+
+		cs.identities = append(cs.identities, certificateIdentity{
+			commonName: c.CommonName,
+			dns:        c.DNS,
+			uri:        c.URI,
+			principal:  &Principal{Name: c.Name, Method: MethodCertificate, Databases: c.Databases},
+		})
+	}
+
+	return cs, nil
+}
+
+// Authenticate returns the principal for the client certificate of a
+// connection, if it was verified.
+func (cs *CertificateStore) Authenticate(state *tls.ConnectionState) *Principal {
+	if cs == nil || state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	certificate := state.VerifiedChains[0][0]
+	for _, identity := range cs.identities {
+		if identity.matches(certificate) {
+			return identity.principal
+		}
+	}
+	return nil
+}
+
+func (identity certificateIdentity) matches(certificate *x509.Certificate) bool {
+	switch {
+	case identity.commonName != "":
+		return matchAny(identity.commonName, certificate.Subject.CommonName)
+	case identity.dns != "":
+		return matchAny(identity.dns, certificate.DNSNames...)
+	default:
+		return matchAny(identity.uri, certificateURIs(certificate)...)
+	}
+}
+
+// The subject alternative name extension, and the tag of the URIs in it.
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+const uriNameTag = 6
+
+// certificateURIs returns the URIs among a certificate's subject
+// alternative names. Go's x509 package only parses them itself from 1.10.
+func certificateURIs(certificate *x509.Certificate) []string {
+	var uris []string
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+
+		var names asn1.RawValue
+		if rest, err := asn1.Unmarshal(extension.Value, &names); err != nil || len(rest) > 0 {
+			return nil
+		}
+		if !names.IsCompound || names.Tag != asn1.TagSequence || names.Class != asn1.ClassUniversal {
+			return nil
+		}
+
+		rest := names.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return nil
+			}
+			if name.Class == asn1.ClassContextSpecific && name.Tag == uriNameTag {
+				uris = append(uris, string(name.Bytes))
+			}
+		}
+	}
+	return uris
+}
+
+func matchAny(pattern string, names ...string) bool {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
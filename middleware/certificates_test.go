@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+const testCertificates = `
+certificates:
+  - name: billing
+    uri: spiffe://example.com/ns/billing/sa/*
+    databases:
+      allow: [billing]
+  - name: edge
+    dns: "*.edge.example.com"
+  - name: legacy
+    common_name: legacy-agent
+    databases:
+      deny: [billing]
+`
+
+func Test_certificate_store(t *testing.T) {
+	path := writeUsers(t, "%s", testCertificates)
+	defer os.Remove(path)
+
+	certificates, err := LoadCertificateStore(path)
+	require.NoError(t, err)
+
+	spiffe := "spiffe://example.com/ns/billing/sa/api"
+	other := "spiffe://example.com/ns/other/sa/api"
+	cases := []struct {
+		label       string
+		certificate *x509.Certificate
+		principal   string
+	}{
+		{"uri", withURIs(t, &x509.Certificate{}, other, spiffe), "billing"},
+		{"dns", &x509.Certificate{DNSNames: []string{"example.com", "a.edge.example.com"}}, "edge"},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "legacy-agent"}}, "legacy"},
+		{"unknown", withURIs(t, &x509.Certificate{Subject: pkix.Name{CommonName: "a.edge.example.com"}}, other), ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{c.certificate}}}
+			principal := certificates.Authenticate(state)
+			if c.principal == "" {
+				assert.Nil(t, principal)
+				return
+			}
+			require.NotNil(t, principal)
+			assert.Equal(t, c.principal, principal.Name)
+			assert.Equal(t, MethodCertificate, principal.Method)
+		})
+	}
+
+	unverified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{DNSNames: []string{"a.edge.example.com"}}}}
+	assert.Nil(t, certificates.Authenticate(unverified))
+	assert.Nil(t, certificates.Authenticate(nil))
+	assert.Nil(t, (*CertificateStore)(nil).Authenticate(unverified))
+}
+
+func Test_load_certificate_store_errors(t *testing.T) {
+	cases := []struct {
+		label   string
+		content string
+		err     string
+	}{
+		{"missing name", "certificates:\n  - dns: a.example.com\n", "certificate 1: a name is required"},
+		{"no identity", "certificates:\n  - name: a\n", "certificate a: exactly one of common_name, dns or uri is required"},
+		{"two identities", "certificates:\n  - name: a\n    dns: a\n    uri: a\n", "certificate a: exactly one of common_name, dns or uri is required"},
+		{"bad pattern", "certificates:\n  - name: a\n    dns: \"[\"\n", `certificate a: invalid pattern "[": syntax error in pattern`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			path := writeUsers(t, "%s", c.content)
+			defer os.Remove(path)
+
+			_, err := LoadCertificateStore(path)
+			assert.EqualError(t, err, c.err)
+		})
+	}
+}
+
+func Test_auth_certificate(t *testing.T) {
+	path := writeUsers(t, "%s", testCertificates)
+	defer os.Remove(path)
+	certificates, err := LoadCertificateStore(path)
+	require.NoError(t, err)
+
+	ca := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}, IsCA: true}, nil)
+	server := newTestCertificate(t, &x509.Certificate{DNSNames: []string{"foo"}}, &ca)
+	legacy := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "legacy-agent"}}, &ca)
+	stranger := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}}, &ca)
+
+	var principal *Principal
+	handler := func(ctx *fasthttp.RequestCtx) {
+		principal = PrincipalFrom(ctx)
+	}
+	config := &AuthConfig{
+		Enabled:      true,
+		Certificates: certificates,
+		Tokens:       NewTokenStore(Token{Name: "telegraf", Hash: HashToken("secret")}),
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	listener := fasthttputil.NewInmemoryListener()
+	defer listener.Close()
+	go fasthttp.Serve(tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}), Auth(handler, config))
+
+	cases := []struct {
+		label         string
+		certificate   *tls.Certificate
+		authorization string
+		uri           string
+		status        int
+		principal     string
+	}{
+		{"certificate", &legacy, "", "http://foo/write?db=telegraf", http.StatusOK, "legacy"},
+		{"denied database", &legacy, "", "http://foo/write?db=billing", http.StatusForbidden, ""},
+		{"unmapped certificate", &stranger, "", "http://foo/write?db=telegraf", http.StatusUnauthorized, ""},
+		{"no certificate", nil, "", "http://foo/write?db=telegraf", http.StatusUnauthorized, ""},
+		{"token wins", &legacy, "Token secret", "http://foo/write?db=billing", http.StatusOK, "telegraf"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			principal = nil
+
+			clientConfig := &tls.Config{RootCAs: pool, ServerName: "foo"}
+			if c.certificate != nil {
+				clientConfig.Certificates = []tls.Certificate{*c.certificate}
+			}
+			client := &fasthttp.Client{
+				Dial: func(addr string) (net.Conn, error) {
+					conn, err := listener.Dial()
+					if err != nil {
+						return nil, err
+					}
+					return tls.Client(conn, clientConfig), nil
+				},
+			}
+
+			var req fasthttp.Request
+			var resp fasthttp.Response
+			req.SetRequestURI(c.uri)
+			if c.authorization != "" {
+				req.Header.Set("Authorization", c.authorization)
+			}
+			require.NoError(t, client.Do(&req, &resp))
+
+			assert.Equal(t, c.status, resp.StatusCode())
+			if c.principal == "" {
+				assert.Nil(t, principal)
+			} else if assert.NotNil(t, principal) {
+				assert.Equal(t, c.principal, principal.Name)
+			}
+		})
+	}
+}
+
+// newTestCertificate issues a certificate from the template, signed by the
+// parent, or self-signed without one.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if template.IsCA {
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// withURIs adds a subject alternative name extension listing the URIs, as
+// parsed from a certificate, alongside a DNS name.
+func withURIs(t *testing.T, certificate *x509.Certificate, uris ...string) *x509.Certificate {
+	names := []asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("example.com")}}
+	for _, uri := range uris {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: uriNameTag, Bytes: []byte(uri)})
+	}
+	value, err := asn1.Marshal(names)
+	require.NoError(t, err)
+
+	certificate.Extensions = append(certificate.Extensions, pkix.Extension{Id: oidSubjectAltName, Value: value})
+	return certificate
+}
@@ -0,0 +1,324 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// JWTConfig accepts JSON Web Tokens, sent as "Authorization: Bearer"
+// headers, signed by one of the keys in a JWKS file.
+type JWTConfig struct {
+	KeysPath string  `yaml:"keys"`
+	Keys     *KeySet `yaml:"-"`
+
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+
+	// DatabasesClaim names the claim listing the database patterns the
+	// caller may use. Without one, callers may use any database.
+	DatabasesClaim string `yaml:"databases_claim"`
+}
+
+// The signing methods accepted, and the type of key each needs.
+var jwtKeyTypes = map[string]string{
+	jwt.SigningMethodHS256.Alg(): "oct",
+	jwt.SigningMethodRS256.Alg(): "RSA",
+	jwt.SigningMethodES256.Alg(): "EC",
+}
+
+// KeySet holds the keys JWTs may be signed with, read from a JWKS file.
+type KeySet struct {
+	keys []jwk
+}
+
+type jwk struct {
+	id      string
+	keyType string
+	alg     string
+	key     interface{}
+}
+
+type jwkFile struct {
+	Keys []struct {
+		KeyType string `json:"kty"`
+		ID      string `json:"kid"`
+		Use     string `json:"use"`
+		Alg     string `json:"alg"`
+		K       string `json:"k"`
+		N       string `json:"n"`
+		E       string `json:"e"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+	} `json:"keys"`
+}
+
+// LoadKeySet reads a JWKS file of HMAC ("oct"), RSA and P-256 EC keys.
+func LoadKeySet(filename string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file jwkFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	for i, k := range file.Keys {
+		label := k.ID
+		if label == "" {
+			label = fmt.Sprint(i + 1)
+		}
+
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if _, ok := jwtKeyTypes[k.Alg]; k.Alg != "" && !ok {
+			return nil, fmt.Errorf("key %s: unsupported algorithm %q", label, k.Alg)
+		}
+
+		key := jwk{id: k.ID, keyType: k.KeyType, alg: k.Alg}
+		switch k.KeyType {
+		case "oct":
+			key.key, err = decodeSegment(k.K)
+		case "RSA":
+			key.key, err = rsaKey(k.N, k.E)
+		case "EC":
+			if k.Curve != "P-256" {
+				err = fmt.Errorf("unsupported curve %q", k.Curve)
+				break
+			}
+			key.key, err = ecKey(k.X, k.Y)
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.KeyType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", label, err)
+		}
+
+		ks.keys = append(ks.keys, key)
+	}
+
+	return ks, nil
+}
+
+// key finds the key a token names with its kid header, or the only key of
+// the right type if it names none.
+func (ks *KeySet) key(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+
+	var found *jwk
+	for i := range ks.keys {
+		k := &ks.keys[i]
+		if k.keyType != jwtKeyTypes[alg] || (k.alg != "" && k.alg != alg) {
+			continue
+		}
+		if kid != "" && k.id != kid {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("token matches more than one key")
+		}
+		found = k
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no %s key %q", alg, kid)
+	}
+	return found.key, nil
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := decodeSegment(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := decodeSegment(e)
+	if err != nil {
+		return nil, err
+	}
+
+	exponent := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || exponent.BitLen() > 31 || exponent.Int64() < 3 {
+		return nil, errors.New("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exponent.Int64())}, nil
+}
+
+func ecKey(x, y string) (*ecdsa.PublicKey, error) {
+	xb, err := decodeSegment(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := decodeSegment(y)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(xb),
+		Y:     new(big.Int).SetBytes(yb),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("invalid EC key")
+	}
+	return key, nil
+}
+
+// looksLikeJWT tells a JWT from an opaque API token.
+func looksLikeJWT(token []byte) bool {
+	return bytes.Count(token, []byte(".")) == 2
+}
+
+// Authenticate verifies a JWT's signature and claims, and returns its
+// subject as the principal.
+func (config *JWTConfig) Authenticate(token []byte) (*Principal, error) {
+	if config.Keys == nil {
+		return nil, errors.New("no JWT keys are configured")
+	}
+
+	parser := jwt.Parser{
+		ValidMethods:         []string{"HS256", "RS256", "ES256"},
+		UseJSONNumber:        true,
+		SkipClaimsValidation: true,
+	}
+	parsed, err := parser.Parse(string(token), config.Keys.key)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := parsed.Claims.(jwt.MapClaims)
+	if err := config.validate(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	principal := &Principal{Name: subject, Method: MethodJWT}
+	if config.DatabasesClaim != "" {
+		patterns, err := stringsClaim(claims, config.DatabasesClaim)
+		if err != nil {
+			return nil, err
+		}
+		principal.Databases = DatabaseACL{Allow: patterns, none: len(patterns) == 0}
+		if err := principal.Databases.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return principal, nil
+}
+
+// validate checks the token is current, and meant for us. Tokens must
+// expire.
+func (config *JWTConfig) validate(claims jwt.MapClaims, now time.Time) error {
+	exp, ok, err := timeClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if !now.Before(exp) {
+		return errors.New("token has expired")
+	}
+
+	nbf, ok, err := timeClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	if config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != config.Issuer {
+			return fmt.Errorf("token issuer %q is not %q", iss, config.Issuer)
+		}
+	}
+
+	if config.Audience != "" {
+		audience, err := stringsClaim(claims, "aud")
+		if err != nil {
+			return err
+		}
+		if !contains(audience, config.Audience) {
+			return fmt.Errorf("token audience %q does not include %q", audience, config.Audience)
+		}
+	}
+
+	return nil
+}
+
+func timeClaim(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("claim %s: %v", name, err)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// stringsClaim reads a claim which may be a string or a list of them. A
+// string may hold several values separated by spaces, as OAuth scopes are.
+func stringsClaim(claims jwt.MapClaims, name string) ([]string, error) {
+	switch value := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Fields(value), nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a list of strings", name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("claim %s is not a string or a list of strings", name)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	hmacSigningKey  = []byte("0123456789abcdef0123456789abcdef")
+	rsaSigningKey   = mustRSAKey()
+	ecdsaSigningKey = mustECDSAKey()
+)
+
+func Test_jwt_authenticate(t *testing.T) {
+	config := jwtConfig(t)
+	config.DatabasesClaim = "databases"
+
+	now := time.Now()
+	valid := jwt.MapClaims{
+		"sub":       "billing",
+		"iss":       "platform",
+		"aud":       "telepath",
+		"exp":       now.Add(time.Hour).Unix(),
+		"databases": []string{"billing", "billing-*"},
+	}
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	otherRSAKey := mustRSAKey()
+	cases := []struct {
+		label  string
+		token  string
+		err    string
+		allows string
+	}{
+		{label: "HS256", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, valid), allows: "billing-eu"},
+		{label: "RS256", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaSigningKey, valid), allows: "billing"},
+		{label: "ES256", token: sign(t, jwt.SigningMethodES256, "", ecdsaSigningKey, valid), allows: "billing"},
+		{label: "audience list", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"aud": []string{"other", "telepath"}})), allows: "billing"},
+		{label: "databases string", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"databases": "a b"})), allows: "b"},
+		{label: "started", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"nbf": now.Add(-time.Minute).Unix()})), allows: "billing"},
+		{label: "expired", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()})), err: "token has expired"},
+		{label: "no expiry", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"exp": nil})), err: "token has no expiry"},
+		{label: "not started", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()})), err: "token is not valid yet"},
+		{label: "wrong issuer", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"iss": "other"})), err: `token issuer "other" is not "platform"`},
+		{label: "wrong audience", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"aud": "other"})), err: `token audience ["other"] does not include "telepath"`},
+		{label: "no subject", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"sub": nil})), err: "token has no subject"},
+		{label: "bad databases", token: sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, with(jwt.MapClaims{"databases": 1})), err: "claim databases is not a string or a list of strings"},
+		{label: "unknown key", token: sign(t, jwt.SigningMethodRS256, "other", rsaSigningKey, valid), err: `no RS256 key "other"`},
+		{label: "wrong key", token: sign(t, jwt.SigningMethodRS256, "rsa", otherRSAKey, valid), err: "crypto/rsa: verification error"},
+		{label: "unsigned", token: sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, valid), err: "signing method none is invalid"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			principal, err := config.Authenticate([]byte(c.token))
+			if c.err != "" {
+				assert.EqualError(t, err, c.err)
+				assert.Nil(t, principal)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "billing", principal.Name)
+			assert.Equal(t, MethodJWT, principal.Method)
+			assert.True(t, principal.Databases.Allowed(c.allows))
+			assert.False(t, principal.Databases.Allowed("other"))
+		})
+	}
+}
+
+func Test_jwt_databases_claim(t *testing.T) {
+	config := jwtConfig(t)
+	claims := jwt.MapClaims{"sub": "billing", "iss": "platform", "aud": "telepath", "exp": time.Now().Add(time.Hour).Unix()}
+	token := []byte(sign(t, jwt.SigningMethodHS256, "", hmacSigningKey, claims))
+
+	principal, err := config.Authenticate(token)
+	require.NoError(t, err)
+	assert.True(t, principal.Databases.Allowed("anything"), "without a databases claim configured")
+
+	config.DatabasesClaim = "databases"
+	principal, err = config.Authenticate(token)
+	require.NoError(t, err)
+	assert.False(t, principal.Databases.Allowed("anything"), "without the claim in the token")
+}
+
+func Test_load_key_set_errors(t *testing.T) {
+	cases := []struct {
+		label   string
+		content string
+		err     string
+	}{
+		{"key type", `{"keys": [{"kty": "OKP", "kid": "a"}]}`, `key a: unsupported key type "OKP"`},
+		{"algorithm", `{"keys": [{"kty": "RSA", "alg": "RS512"}]}`, `key 1: unsupported algorithm "RS512"`},
+		{"curve", `{"keys": [{"kty": "EC", "crv": "P-384"}]}`, `key 1: unsupported curve "P-384"`},
+		{"point", `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`, "key 1: invalid EC key"},
+		{"json", `keys: []`, "invalid character 'k' looking for beginning of value"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			path := writeUsers(t, "%s", c.content)
+			defer os.Remove(path)
+
+			_, err := LoadKeySet(path)
+			assert.EqualError(t, err, c.err)
+		})
+	}
+}
+
+func Test_auth_jwt(t *testing.T) {
+	config := AuthConfig{
+		Enabled: true,
+		Tokens:  NewTokenStore(Token{Name: "telegraf", Hash: HashToken("secret")}),
+		JWT:     *jwtConfig(t),
+	}
+	config.JWT.DatabasesClaim = "databases"
+
+	var principal *Principal
+	handler := func(ctx *fasthttp.RequestCtx) {
+		principal = PrincipalFrom(ctx)
+	}
+	client, teardown := newClient(Auth(handler, &config))
+	defer teardown()
+
+	claims := jwt.MapClaims{
+		"sub":       "billing",
+		"iss":       "platform",
+		"aud":       "telepath",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"databases": "billing",
+	}
+	token := sign(t, jwt.SigningMethodRS256, "rsa", rsaSigningKey, claims)
+
+	cases := []struct {
+		uri           string
+		authorization string
+		status        int
+		principal     string
+	}{
+		{"http://foo/write?db=billing", "Bearer " + token, http.StatusOK, "billing"},
+		{"http://foo/api/v2/write?bucket=billing", "Token " + token, http.StatusOK, "billing"},
+		{"http://foo/write?db=other", "Bearer " + token, http.StatusForbidden, ""},
+		{"http://foo/write?db=billing", "Bearer " + token + "x", http.StatusUnauthorized, ""},
+		{"http://foo/write?db=other", "Bearer secret", http.StatusOK, "telegraf"},
+	}
+
+	for _, c := range cases {
+		principal = nil
+
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI(c.uri)
+		req.Header.Set("Authorization", c.authorization)
+		err := client.Do(&req, &resp)
+
+		require.NoError(t, err)
+		assert.Equal(t, c.status, resp.StatusCode(), c.uri)
+		if c.principal == "" {
+			assert.Nil(t, principal, c.uri)
+		} else if assert.NotNil(t, principal, c.uri) {
+			assert.Equal(t, c.principal, principal.Name, c.uri)
+		}
+	}
+}
+
+// jwtConfig returns a config trusting hmacSigningKey, rsaSigningKey (as
+// "rsa") and ecdsaSigningKey, written to a JWKS file.
+func jwtConfig(t *testing.T) *JWTConfig {
+	path := writeUsers(t, `{"keys": [
+  {"kty": "oct", "k": %q},
+  {"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": %q, "e": %q},
+  {"kty": "EC", "crv": "P-256", "x": %q, "y": %q},
+  {"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQ", "e": "AQAB"}
+]}`,
+		encodeSegment(hmacSigningKey),
+		encodeSegment(rsaSigningKey.N.Bytes()), encodeSegment(big.NewInt(int64(rsaSigningKey.E)).Bytes()),
+		encodeSegment(ecdsaSigningKey.X.Bytes()), encodeSegment(ecdsaSigningKey.Y.Bytes()))
+	defer os.Remove(path)
+
+	keys, err := LoadKeySet(path)
+	require.NoError(t, err)
+	return &JWTConfig{Keys: keys, Issuer: "platform", Audience: "telepath"}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func mustRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mustECDSAKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Token is an API token, accepted in "Authorization: Token" or "Bearer"
+// headers. Only the SHA-256 hash of the token is kept.
+type Token struct {
+	Name      string
+	Hash      []byte
+	Databases DatabaseACL
+	Expires   time.Time
+	Disabled  bool
+}
+
+// TokenStore holds the API tokens, as sent by InfluxDB 2.x clients.
+//
+//	tokens:
+//	  - name: telegraf-east
+//	    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	    databases:
+//	      allow: [telegraf]
+//	    expires: 2027-01-01T00:00:00Z
+//	    disabled: false
+type TokenStore struct {
+	tokens []Token
+	now    func() time.Time
+}
+
+type tokenFile struct {
+	Tokens []struct {
+		Name      string      `yaml:"name"`
+		SHA256    string      `yaml:"sha256"`
+		Databases DatabaseACL `yaml:"databases"`
+		Expires   time.Time   `yaml:"expires"`
+		Disabled  bool        `yaml:"disabled"`
+	} `yaml:"tokens"`
+}
+
+// HashToken returns the hash stored for a token.
+func HashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func NewTokenStore(tokens ...Token) *TokenStore {
+	return &TokenStore{tokens: tokens, now: time.Now}
+}
+
+// LoadTokenStore reads a YAML file of token hashes.
+func LoadTokenStore(filename string) (*TokenStore, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	ts := NewTokenStore()
+	names := make(map[string]bool)
+	for i, t := range file.Tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("token %d: a name is required", i+1)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("token %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+
+		hash, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("token %s: sha256 must be %d hex digits", t.Name, sha256.Size*2)
+		}
+		if err := t.Databases.validate(); err != nil {
+			return nil, fmt.Errorf("token %s: %v", t.Name, err)
+		}
+
+		ts.tokens = append(ts.tokens, Token{
+			Name:      t.Name,
+			Hash:      hash,
+			Databases: t.Databases,
+			Expires:   t.Expires,
+			Disabled:  t.Disabled,
+		})
+	}
+
+	return ts, nil
+}
+
+// Authenticate returns the principal for a valid token, taking the same
+// time whichever token matches. Expired and disabled tokens are invalid.
+func (ts *TokenStore) Authenticate(token []byte) *Principal {
+	if ts == nil || len(token) == 0 {
+		return nil
+	}
+
+	hash := HashToken(string(token))
+	var found *Token
+	for i := range ts.tokens {
+		if subtle.ConstantTimeCompare(ts.tokens[i].Hash, hash) == 1 {
+			found = &ts.tokens[i]
+		}
+	}
+
+	if found == nil || found.Disabled {
+		return nil
+	}
+	if !found.Expires.IsZero() && !ts.now().Before(found.Expires) {
+		return nil
+	}
+
+	return &Principal{
+		Name:      found.Name,
+		Method:    MethodToken,
+		Databases: found.Databases,
+	}
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_load_token_store(t *testing.T) {
+	path := writeUsers(t, `
+tokens:
+  - name: telegraf-east
+    sha256: %s
+    databases:
+      allow: [telegraf]
+  - name: telegraf-west
+    sha256: %s
+    expires: 2020-01-01T00:00:00Z
+  - name: leaked
+    sha256: %s
+    disabled: true
+`, hexHash("first"), hexHash("second"), hexHash("third"))
+	defer os.Remove(path)
+
+	tokens, err := LoadTokenStore(path)
+	require.NoError(t, err)
+	tokens.now = func() time.Time { return time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC) }
+
+	east := tokens.Authenticate([]byte("first"))
+	require.NotNil(t, east)
+	assert.Equal(t, "telegraf-east", east.Name)
+	assert.Equal(t, MethodToken, east.Method)
+	assert.Equal(t, []string{"telegraf"}, east.Databases.Allow)
+
+	assert.NotNil(t, tokens.Authenticate([]byte("second")))
+	assert.Nil(t, tokens.Authenticate([]byte("third")), "disabled")
+	assert.Nil(t, tokens.Authenticate([]byte(hexHash("first"))), "hash")
+	assert.Nil(t, tokens.Authenticate([]byte("")))
+	assert.Nil(t, (*TokenStore)(nil).Authenticate([]byte("first")))
+
+	tokens.now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+	assert.Nil(t, tokens.Authenticate([]byte("second")), "expired")
+	assert.NotNil(t, tokens.Authenticate([]byte("first")))
+}
+
+func Test_load_token_store_errors(t *testing.T) {
+	cases := []struct {
+		label   string
+		content string
+		err     string
+	}{
+		{"missing name", "tokens:\n  - sha256: %s\n", "token 1: a name is required"},
+		{"duplicate name", "tokens:\n  - name: a\n    sha256: %[1]s\n  - name: a\n    sha256: %[1]s\n", "token a: duplicate name"},
+		{"plaintext token", "tokens:\n  - name: a\n    sha256: secret%.0s\n", "token a: sha256 must be 64 hex digits"},
+		{"bad pattern", "tokens:\n  - name: a\n    sha256: %s\n    databases: {deny: [\"[\"]}\n", `token a: invalid database pattern "[": syntax error in pattern`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			path := writeUsers(t, c.content, hexHash("secret"))
+			defer os.Remove(path)
+
+			_, err := LoadTokenStore(path)
+			assert.EqualError(t, err, c.err)
+		})
+	}
+}
+
+func Test_load_missing_token_store(t *testing.T) {
+	_, err := LoadTokenStore("/does/not/exist")
+	assert.Error(t, err)
+}
+
+func Test_auth_token_principal(t *testing.T) {
+	tokens := NewTokenStore(Token{
+		Name:      "telegraf-east",
+		Hash:      HashToken("secret"),
+		Databases: DatabaseACL{Allow: []string{"telegraf"}},
+	})
+
+	var principal *Principal
+	handler := func(ctx *fasthttp.RequestCtx) {
+		principal = PrincipalFrom(ctx)
+	}
+	client, teardown := newClient(Auth(handler, &AuthConfig{Enabled: true, Tokens: tokens}))
+	defer teardown()
+
+	cases := []struct {
+		uri           string
+		authorization string
+		status        int
+		principal     string
+	}{
+		{"http://foo/write?db=telegraf", "Bearer secret", http.StatusOK, "telegraf-east"},
+		{"http://foo/api/v2/write?bucket=telegraf", "Token secret", http.StatusOK, "telegraf-east"},
+		{"http://foo/write?db=other", "Bearer secret", http.StatusForbidden, ""},
+		{"http://foo/write?db=telegraf", "Bearer wrong", http.StatusUnauthorized, ""},
+	}
+
+	for _, c := range cases {
+		principal = nil
+
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI(c.uri)
+		req.Header.Set("Authorization", c.authorization)
+		err := client.Do(&req, &resp)
+
+		label := fmt.Sprintf("%s %s", c.uri, c.authorization)
+		require.NoError(t, err)
+		assert.Equal(t, c.status, resp.StatusCode(), label)
+		if c.principal == "" {
+			assert.Nil(t, principal, label)
+		} else if assert.NotNil(t, principal, label) {
+			assert.Equal(t, c.principal, principal.Name, label)
+		}
+	}
+}
+
+func hexHash(token string) string {
+	return hex.EncodeToString(HashToken(token))
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// The ways a Principal can authenticate.
+const (
+	MethodPassword    = "password"
+	MethodToken       = "token"
+	MethodJWT         = "jwt"
+	MethodCertificate = "certificate"
+)
+
+// Principal is who a request authenticated as, how, and which databases
+// they may use.
+type Principal struct {
+	Name      string
+	Method    string
+	Databases DatabaseACL
+}
+
+// DatabaseACL allows databases matching any Allow pattern, or every
+// database if there are none, unless they match a Deny pattern. Patterns
+// are globs, as in path.Match.
+type DatabaseACL struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// none allows no databases at all.
+	none bool
+}
+
+func (acl DatabaseACL) Allowed(db string) bool {
+	if acl.none {
+		return false
+	}
+
+	for _, pattern := range acl.Deny {
+		if matched, _ := path.Match(pattern, db); matched {
+			return false
+		}
+	}
+
+	if len(acl.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range acl.Allow {
+		if matched, _ := path.Match(pattern, db); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl DatabaseACL) validate() error {
+	for _, pattern := range append(acl.Allow, acl.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid database pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// UserStore holds users with bcrypt-hashed passwords.
+//
+//	users:
+//	  - name: telegraf
+//	    password: $2a$10$...
+//	    databases:
+//	      allow: [telegraf, "team-*"]
+//	      deny: [team-secret]
+type UserStore struct {
+	users map[string]*storedUser
+
+	// A hash to check passwords for unknown users against, so they take
+	// as long to reject as known ones.
+	dummy []byte
+}
+
+type storedUser struct {
+	hash      []byte
+	principal *Principal
+}
+
+type userFile struct {
+	Users []struct {
+		Name      string      `yaml:"name"`
+		Password  string      `yaml:"password"`
+		Databases DatabaseACL `yaml:"databases"`
+	} `yaml:"users"`
+}
+
+// LoadUserStore reads a YAML file of users.
+func LoadUserStore(filename string) (*UserStore, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file userFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	us := &UserStore{users: make(map[string]*storedUser)}
+	for i, u := range file.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user %d: a name is required", i+1)
+		}
+		if _, ok := us.users[u.Name]; ok {
+			return nil, fmt.Errorf("user %s: duplicate name", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, fmt.Errorf("user %s: password is not a bcrypt hash: %v", u.Name, err)
+		}
+		if err := u.Databases.validate(); err != nil {
+			return nil, fmt.Errorf("user %s: %v", u.Name, err)
+		}
+
+		us.users[u.Name] = &storedUser{
+			hash:      []byte(u.Password),
+			principal: &Principal{Name: u.Name, Method: MethodPassword, Databases: u.Databases},
+		}
+		if us.dummy == nil {
+			us.dummy = []byte(u.Password)
+		}
+	}
+
+	return us, nil
+}
+
+// Authenticate returns the user, if the password matches their hash.
+func (us *UserStore) Authenticate(name, password string) *Principal {
+	if us == nil || len(us.dummy) == 0 {
+		return nil
+	}
+
+	user, ok := us.users[name]
+	if !ok {
+		bcrypt.CompareHashAndPassword(us.dummy, []byte(password))
+		return nil
+	}
+
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return nil
+	}
+	return user.principal
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_database_acl(t *testing.T) {
+	cases := []struct {
+		acl    DatabaseACL
+		db     string
+		expect bool
+	}{
+		{DatabaseACL{}, "anything", true},
+		{DatabaseACL{Allow: []string{"telegraf"}}, "telegraf", true},
+		{DatabaseACL{Allow: []string{"telegraf"}}, "telegraf2", false},
+		{DatabaseACL{Allow: []string{"team-*"}}, "team-a", true},
+		{DatabaseACL{Allow: []string{"team-*"}, Deny: []string{"team-secret"}}, "team-secret", false},
+		{DatabaseACL{Deny: []string{"*-prod"}}, "app-prod", false},
+		{DatabaseACL{Deny: []string{"*-prod"}}, "app-dev", true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expect, c.acl.Allowed(c.db), fmt.Sprintf("%+v %s", c.acl, c.db))
+	}
+}
+
+func Test_load_user_store(t *testing.T) {
+	path := writeUsers(t, `
+users:
+  - name: joe
+    password: %s
+    databases:
+      allow: [telegraf, "team-*"]
+      deny: [team-secret]
+  - name: ann
+    password: %s
+`, hash(t, "secret"), hash(t, "hunter2"))
+	defer os.Remove(path)
+
+	users, err := LoadUserStore(path)
+	require.NoError(t, err)
+
+	joe := users.Authenticate("joe", "secret")
+	require.NotNil(t, joe)
+	assert.Equal(t, "joe", joe.Name)
+	assert.Equal(t, []string{"telegraf", "team-*"}, joe.Databases.Allow)
+	assert.Equal(t, []string{"team-secret"}, joe.Databases.Deny)
+
+	assert.NotNil(t, users.Authenticate("ann", "hunter2"))
+	assert.Nil(t, users.Authenticate("joe", "hunter2"))
+	assert.Nil(t, users.Authenticate("bob", "secret"))
+	assert.Nil(t, (*UserStore)(nil).Authenticate("joe", "secret"))
+}
+
+func Test_load_user_store_errors(t *testing.T) {
+	cases := []struct {
+		label   string
+		content string
+		err     string
+	}{
+		{"missing name", "users:\n  - password: %s\n", "user 1: a name is required"},
+		{"duplicate name", "users:\n  - name: joe\n    password: %[1]s\n  - name: joe\n    password: %[1]s\n", "user joe: duplicate name"},
+		{"plaintext password", "users:\n  - name: joe\n    password: secret%.0s\n", "user joe: password is not a bcrypt hash: crypto/bcrypt: hashedSecret too short to be a bcrypted password"},
+		{"bad pattern", "users:\n  - name: joe\n    password: %s\n    databases: {allow: [\"[\"]}\n", `user joe: invalid database pattern "[": syntax error in pattern`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			path := writeUsers(t, c.content, hash(t, "secret"))
+			defer os.Remove(path)
+
+			_, err := LoadUserStore(path)
+			assert.EqualError(t, err, c.err)
+		})
+	}
+}
+
+func Test_auth_database_permissions(t *testing.T) {
+	path := writeUsers(t, "users:\n  - name: joe\n    password: %s\n    databases: {allow: [telegraf]}\n", hash(t, "secret"))
+	defer os.Remove(path)
+
+	users, err := LoadUserStore(path)
+	require.NoError(t, err)
+
+	client, teardown := newClient(Auth(okHandlerFunc, &AuthConfig{Enabled: true, Users: users}))
+	defer teardown()
+
+	cases := []struct {
+		uri    string
+		status int
+	}{
+		{"http://foo/write?db=telegraf&u=joe&p=secret", http.StatusOK},
+		{"http://foo/write?db=other&u=joe&p=secret", http.StatusForbidden},
+		{"http://foo/api/v2/write?bucket=other&u=joe&p=secret", http.StatusForbidden},
+		{"http://foo/query?u=joe&p=secret", http.StatusOK},
+		{"http://foo/write?db=telegraf&u=joe&p=wrong", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+
+		req.SetRequestURI(c.uri)
+		err := client.Do(&req, &resp)
+
+		assert.NoError(t, err)
+		assert.Equal(t, c.status, resp.StatusCode(), c.uri)
+	}
+}
+
+func hash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func writeUsers(t *testing.T, format string, args ...interface{}) string {
+	file, err := ioutil.TempFile("", "users")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, format, args...)
+	require.NoError(t, err)
+	return file.Name()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var ErrMissingMeasurement = errors.New("missing measurement")
+var ErrMissingTagKey = errors.New("missing tag key")
+var ErrMissingTagValue = errors.New("missing tag value")
+var ErrMissingFields = errors.New("missing fields")
+var ErrMissingFieldKey = errors.New("missing field key")
+var ErrMissingFieldValue = errors.New("missing field value")
+var ErrInvalidFieldValue = errors.New("invalid field value")
+var ErrUnterminatedString = errors.New("unterminated string field value")
+var ErrInvalidTimestamp = errors.New("invalid timestamp")
+var ErrTimestampOutOfRange = errors.New("timestamp out of range")
+var ErrLineTooLong = errors.New("line is too long")
+var ErrInvalidPrecision = errors.New("invalid precision")
+
+// ParseError describes a line which could not be parsed.
+type ParseError struct {
+	Line string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse '%s': %v", e.Line, e.Err)
+}
+
+type FieldType int
+
+const (
+	FieldFloat FieldType = iota
+	FieldInteger
+	FieldUnsigned
+	FieldBoolean
+	FieldString
+)
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field holds a field value as a float64, int64, uint64, bool or string,
+// according to its Type.
+type Field struct {
+	Key   string
+	Type  FieldType
+	Value interface{}
+}
+
+// Point is a single line of InfluxDB line-protocol.
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	Time        int64 // Nanoseconds since the Unix epoch
+
+	key    []byte // The escaped measurement and tag set, as received
+	fields []byte // The escaped field set, as received
+}
+
+// Tag returns the value of the named tag, or an empty string.
+func (p *Point) Tag(key string) string {
+	for _, tag := range p.Tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// SeriesKey returns the canonical series key: the escaped measurement,
+// followed by the escaped tags sorted by key.
+func (p *Point) SeriesKey() string {
+	tags := make([]Tag, len(p.Tags))
+	copy(tags, p.Tags)
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+
+	key := make([]byte, 0, len(p.key))
+	key = appendEscaped(key, p.Measurement, ", ")
+	for _, tag := range tags {
+		key = append(key, ',')
+		key = appendEscaped(key, tag.Key, ",= ")
+		key = append(key, '=')
+		key = appendEscaped(key, tag.Value, ",= ")
+	}
+	return string(key)
+}
+
+// RemoveTags drops the tags with the given keys, keeping the rest in
+// their order, and returns the keys it dropped.
+func (p *Point) RemoveTags(keys ...string) []string {
+	var removed []string
+	tags := p.Tags[:0]
+	for _, tag := range p.Tags {
+		if isOneOfStrings(tag.Key, keys) {
+			removed = append(removed, tag.Key)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	p.Tags = tags
+
+	key := make([]byte, 0, len(p.key))
+	key = appendEscaped(key, p.Measurement, ", ")
+	for _, tag := range p.Tags {
+		key = append(key, ',')
+		key = appendEscaped(key, tag.Key, ",= ")
+		key = append(key, '=')
+		key = appendEscaped(key, tag.Value, ",= ")
+	}
+	p.key = key
+	return removed
+}
+
+// Line returns the point as line-protocol with a nanosecond timestamp.
+func (p *Point) Line() []byte {
+	line := make([]byte, 0, len(p.key)+len(p.fields)+21)
+	line = append(line, p.key...)
+	line = append(line, ' ')
+	line = append(line, p.fields...)
+	line = append(line, ' ')
+	return strconv.AppendInt(line, p.Time, 10)
+}
+
+// ParsePoint parses a single line, without its trailing newline. Lines
+// without a timestamp are stamped with now.
+func ParsePoint(line []byte, precision string, now time.Time) (*Point, error) {
+	point, err := parsePoint(line, precision, now)
+	if err != nil {
+		return nil, &ParseError{Line: string(line), Err: err}
+	}
+	return point, nil
+}
+
+func parsePoint(line []byte, precision string, now time.Time) (*Point, error) {
+	p := &Point{}
+
+	i := scanTo(line, 0, ", ")
+	if i == 0 {
+		return nil, ErrMissingMeasurement
+	}
+	p.Measurement = unescape(line[:i], ", ")
+
+	for i < len(line) && line[i] == ',' {
+		start := i + 1
+		i = scanTo(line, start, ",= ")
+		if i == start {
+			return nil, ErrMissingTagKey
+		}
+		if i == len(line) || line[i] != '=' {
+			return nil, ErrMissingTagValue
+		}
+		key := unescape(line[start:i], ",= ")
+
+		start = i + 1
+		i = scanTo(line, start, ", ")
+		if i == start {
+			return nil, ErrMissingTagValue
+		}
+		p.Tags = append(p.Tags, Tag{Key: key, Value: unescape(line[start:i], ",= ")})
+	}
+	p.key = append([]byte(nil), line[:i]...)
+
+	i = skipSpaces(line, i)
+	if i == len(line) {
+		return nil, ErrMissingFields
+	}
+
+	fieldsStart := i
+	for {
+		start := i
+		i = scanTo(line, start, ",= ")
+		if i == start {
+			return nil, ErrMissingFieldKey
+		}
+		if i == len(line) || line[i] != '=' {
+			return nil, ErrMissingFieldValue
+		}
+		key := unescape(line[start:i], ",= ")
+
+		start = i + 1
+		var field Field
+		var err error
+		if start < len(line) && line[start] == '"' {
+			i = scanString(line, start+1)
+			if i == len(line) {
+				return nil, ErrUnterminatedString
+			}
+			i++
+			field = Field{Key: key, Type: FieldString, Value: unescapeString(line[start+1 : i-1])}
+		} else {
+			i = scanTo(line, start, ", ")
+			field, err = parseField(key, line[start:i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.Fields = append(p.Fields, field)
+
+		if i == len(line) || line[i] == ' ' {
+			break
+		}
+		if line[i] != ',' {
+			return nil, ErrInvalidFieldValue
+		}
+		i++
+	}
+	p.fields = append([]byte(nil), line[fieldsStart:i]...)
+
+	i = skipSpaces(line, i)
+	timestamp := bytes.TrimRight(line[i:], " \t\r")
+	if len(timestamp) == 0 {
+		p.Time = now.UnixNano()
+		return p, nil
+	}
+
+	t, err := strconv.ParseInt(string(timestamp), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidTimestamp
+	}
+
+	duration, err := precisionMultiplier(precision)
+	if err != nil {
+		return nil, ErrInvalidPrecision
+	}
+
+	multiplier := int64(duration)
+	if t > math.MaxInt64/multiplier || t < math.MinInt64/multiplier {
+		return nil, ErrTimestampOutOfRange
+	}
+	p.Time = t * multiplier
+
+	return p, nil
+}
+
+func parseField(key string, value []byte) (Field, error) {
+	length := len(value)
+	if length == 0 {
+		return Field{}, ErrMissingFieldValue
+	}
+
+	switch string(value) {
+	case "t", "T", "true", "True", "TRUE":
+		return Field{Key: key, Type: FieldBoolean, Value: true}, nil
+	case "f", "F", "false", "False", "FALSE":
+		return Field{Key: key, Type: FieldBoolean, Value: false}, nil
+	}
+
+	switch value[length-1] {
+	case 'i':
+		v, err := strconv.ParseInt(string(value[:length-1]), 10, 64)
+		if err != nil {
+			return Field{}, ErrInvalidFieldValue
+		}
+		return Field{Key: key, Type: FieldInteger, Value: v}, nil
+
+	case 'u':
+		v, err := strconv.ParseUint(string(value[:length-1]), 10, 64)
+		if err != nil {
+			return Field{}, ErrInvalidFieldValue
+		}
+		return Field{Key: key, Type: FieldUnsigned, Value: v}, nil
+	}
+
+	v, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Field{}, ErrInvalidFieldValue
+	}
+	return Field{Key: key, Type: FieldFloat, Value: v}, nil
+}
+
+// precisionMultiplier converts an InfluxDB precision into the duration of
+// a single timestamp unit. An empty precision means nanoseconds.
+func precisionMultiplier(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	default:
+		return 0, fmt.Errorf("%v %q: use n, u, ms, s, m or h", ErrInvalidPrecision, precision)
+	}
+}
+
+// scanTo returns the index of the first unescaped stop character at or
+// after i, or the length of the line.
+func scanTo(line []byte, i int, stops string) int {
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && isOneOf(line[i+1], stops) {
+			i++
+			continue
+		}
+		if isOneOf(c, stops) {
+			return i
+		}
+	}
+	return i
+}
+
+// scanString returns the index of the closing quote of a string field
+// value starting at i, or the length of the line.
+func scanString(line []byte, i int) int {
+	for ; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return len(line)
+}
+
+func skipSpaces(line []byte, i int) int {
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+func unescape(b []byte, escaped string) string {
+	if bytes.IndexByte(b, '\\') == -1 {
+		return string(b)
+	}
+
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) && isOneOf(b[i+1], escaped) {
+			i++
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+func appendEscaped(dst []byte, s string, escaped string) []byte {
+	for i := 0; i < len(s); i++ {
+		if isOneOf(s[i], escaped) {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, s[i])
+	}
+	return dst
+}
+
+func unescapeString(b []byte) string {
+	return unescape(b, `"\`)
+}
+
+func isOneOf(c byte, set string) bool {
+	for i := 0; i < len(set); i++ {
+		if set[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+func isOneOfStrings(s string, set []string) bool {
+	for _, member := range set {
+		if member == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_point_parsing(t *testing.T) {
+	cases := []struct {
+		label       string
+		input       string
+		measurement string
+		tags        []Tag
+		fields      []Field
+		time        int64
+		line        string
+	}{
+		{
+			label:       "simple point",
+			input:       "foo value=1 1",
+			measurement: "foo",
+			fields:      []Field{{"value", FieldFloat, 1.0}},
+			time:        1,
+			line:        "foo value=1 1",
+		},
+		{
+			label:       "tags",
+			input:       "foo,host=Hoth,region=outer value=1 1",
+			measurement: "foo",
+			tags:        []Tag{{"host", "Hoth"}, {"region", "outer"}},
+			fields:      []Field{{"value", FieldFloat, 1.0}},
+			time:        1,
+			line:        "foo,host=Hoth,region=outer value=1 1",
+		},
+		{
+			label:       "escaped measurement and tags",
+			input:       `foo\ bar,host\=name=Echo\ Base,x=a\,b value=1 1`,
+			measurement: "foo bar",
+			tags:        []Tag{{"host=name", "Echo Base"}, {"x", "a,b"}},
+			fields:      []Field{{"value", FieldFloat, 1.0}},
+			time:        1,
+			line:        `foo\ bar,host\=name=Echo\ Base,x=a\,b value=1 1`,
+		},
+		{
+			label:       "typed fields",
+			input:       "foo f=1.5,i=-2i,u=3u,b=true,B=F 1",
+			measurement: "foo",
+			fields: []Field{
+				{"f", FieldFloat, 1.5},
+				{"i", FieldInteger, int64(-2)},
+				{"u", FieldUnsigned, uint64(3)},
+				{"b", FieldBoolean, true},
+				{"B", FieldBoolean, false},
+			},
+			time: 1,
+			line: "foo f=1.5,i=-2i,u=3u,b=true,B=F 1",
+		},
+		{
+			label:       "quoted string field",
+			input:       `foo msg="hello, wide world",q="say \"hi\"" 1`,
+			measurement: "foo",
+			fields: []Field{
+				{"msg", FieldString, "hello, wide world"},
+				{"q", FieldString, `say "hi"`},
+			},
+			time: 1,
+			line: `foo msg="hello, wide world",q="say \"hi\"" 1`,
+		},
+		{
+			label:       "extra whitespace",
+			input:       "foo  value=1   1  ",
+			measurement: "foo",
+			fields:      []Field{{"value", FieldFloat, 1.0}},
+			time:        1,
+			line:        "foo value=1 1",
+		},
+		{
+			label:       "negative timestamp",
+			input:       "foo value=1 -1",
+			measurement: "foo",
+			fields:      []Field{{"value", FieldFloat, 1.0}},
+			time:        -1,
+			line:        "foo value=1 -1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			point, err := ParsePoint([]byte(c.input), "ns", time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, c.measurement, point.Measurement)
+			assert.Equal(t, c.tags, point.Tags)
+			assert.Equal(t, c.fields, point.Fields)
+			assert.Equal(t, c.time, point.Time)
+			assert.Equal(t, c.line, string(point.Line()))
+		})
+	}
+}
+
+func Test_point_parsing_errors(t *testing.T) {
+	cases := []struct {
+		label string
+		input string
+		err   error
+	}{
+		{"missing measurement", ",x=y value=1", ErrMissingMeasurement},
+		{"missing tag key", "foo,=y value=1", ErrMissingTagKey},
+		{"missing tag value", "foo,x= value=1", ErrMissingTagValue},
+		{"tag without equals", "foo,x value=1", ErrMissingTagValue},
+		{"missing fields", "foo,x=y", ErrMissingFields},
+		{"missing fields before timestamp", "foo,x=y ", ErrMissingFields},
+		{"missing field key", "foo =1", ErrMissingFieldKey},
+		{"missing field value", "foo value=", ErrMissingFieldValue},
+		{"field without equals", "foo value", ErrMissingFieldValue},
+		{"bad float", "foo value=1x", ErrInvalidFieldValue},
+		{"bad integer", "foo value=1.5i", ErrInvalidFieldValue},
+		{"bad unsigned", "foo value=-1u", ErrInvalidFieldValue},
+		{"not a number", "foo value=NaN", ErrInvalidFieldValue},
+		{"unquoted string", "foo value=bar", ErrInvalidFieldValue},
+		{"unterminated string", `foo value="bar 1`, ErrUnterminatedString},
+		{"trailing field comma", "foo value=1, 1", ErrMissingFieldKey},
+		{"bad timestamp", "foo value=1 abc", ErrInvalidTimestamp},
+		{"extra timestamp", "foo value=1 1 2", ErrInvalidTimestamp},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			point, err := ParsePoint([]byte(c.input), "ns", time.Now())
+			assert.Nil(t, point)
+			require.IsType(t, &ParseError{}, err)
+			assert.Equal(t, c.err, err.(*ParseError).Err)
+			assert.Equal(t, c.input, err.(*ParseError).Line)
+		})
+	}
+}
+
+func Test_point_timestamp_out_of_range(t *testing.T) {
+	_, err := ParsePoint([]byte("foo value=1 9223372036854775"), "s", time.Now())
+	require.IsType(t, &ParseError{}, err)
+	assert.Equal(t, ErrTimestampOutOfRange, err.(*ParseError).Err)
+}
+
+func Test_point_tag_lookup(t *testing.T) {
+	point, err := ParsePoint([]byte("foo,host=Hoth value=1 1"), "ns", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "Hoth", point.Tag("host"))
+	assert.Equal(t, "", point.Tag("region"))
+}
+
+func Test_point_series_key(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect string
+	}{
+		{"foo value=1 1", "foo"},
+		{"foo,b=2,a=1 value=1 1", "foo,a=1,b=2"},
+		{`foo\ bar,b=x\ y,a\,z=1 value=1 1`, `foo\ bar,a\,z=1,b=x\ y`},
+	}
+
+	for _, c := range cases {
+		point, err := ParsePoint([]byte(c.input), "ns", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, c.expect, point.SeriesKey())
+	}
+}
+
+func Test_point_remove_tags(t *testing.T) {
+	cases := []struct {
+		input   string
+		remove  []string
+		removed []string
+		expect  string
+	}{
+		{"foo,b=2,a=1 value=1 1", []string{"a"}, []string{"a"}, "foo,b=2 value=1 1"},
+		{"foo,b=2,a=1 value=1 1", []string{"a", "b"}, []string{"b", "a"}, "foo value=1 1"},
+		{"foo,b=2,a=1 value=1 1", []string{"c"}, nil, "foo,b=2,a=1 value=1 1"},
+		{`foo\ bar,b=x\ y,a\,z=1 value=1 1`, []string{"a,z"}, []string{"a,z"}, `foo\ bar,b=x\ y value=1 1`},
+	}
+
+	for _, c := range cases {
+		point, err := ParsePoint([]byte(c.input), "ns", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, c.removed, point.RemoveTags(c.remove...))
+		assert.Equal(t, c.expect, string(point.Line()))
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What rate limits are kept for, besides each database.
+const (
+	RateLimitByDatabase  = ""
+	RateLimitByPrincipal = "principal"
+	RateLimitByClientIP  = "client_ip"
+)
+
+// Which limit a write went over.
+const (
+	rateLimitLines = "lines"
+	rateLimitBytes = "bytes"
+)
+
+// Buckets left idle this long are full again, and are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitConfig sets token bucket limits on the lines and bytes written
+// to each database, and optionally by each principal or client IP within
+// it.
+//
+//	rate_limits:
+//	  by: principal
+//	  default:
+//	    lines: 10000
+//	    lines_burst: 50000
+//	  databases:
+//	    telegraf:
+//	      lines: 100000
+type RateLimitConfig struct {
+	By        string               `yaml:"by"`
+	Default   RateLimit            `yaml:"default"`
+	Databases map[string]RateLimit `yaml:"databases"`
+}
+
+// RateLimit is the rate of lines and bytes allowed per second, and how
+// many may be written at once. Each burst defaults to a second's worth.
+// A zero rate is no limit.
+type RateLimit struct {
+	Lines      float64 `yaml:"lines"`
+	LinesBurst float64 `yaml:"lines_burst"`
+	Bytes      float64 `yaml:"bytes"`
+	BytesBurst float64 `yaml:"bytes_burst"`
+}
+
+func (rl RateLimit) enabled() bool {
+	return rl.Lines > 0 || rl.Bytes > 0
+}
+
+func (rl RateLimit) validate() error {
+	if rl.Lines < 0 || rl.LinesBurst < 0 || rl.Bytes < 0 || rl.BytesBurst < 0 {
+		return fmt.Errorf("rates and bursts can't be negative")
+	}
+	return nil
+}
+
+// validateRateLimits reports problems with the rate limits.
+func (c *TelepathConfig) validateRateLimits(fail func(string, ...interface{})) {
+	switch c.RateLimits.By {
+	case RateLimitByDatabase, RateLimitByPrincipal, RateLimitByClientIP:
+	default:
+		fail("invalid rate limit key %q: use principal or client_ip, or leave it empty", c.RateLimits.By)
+	}
+	if err := c.RateLimits.Default.validate(); err != nil {
+		fail("invalid default rate limit: %v", err)
+	}
+	for db, limit := range c.RateLimits.Databases {
+		if err := limit.validate(); err != nil {
+			fail("invalid rate limit for database %s: %v", db, err)
+		}
+	}
+}
+
+// rateLimiter keeps a pair of token buckets, for lines and bytes, for
+// each database and principal or client IP writing to it.
+type rateLimiter struct {
+	sync.Mutex
+	by        string
+	defaults  RateLimit
+	databases map[string]RateLimit
+	buckets   map[rateLimitKey]*rateBuckets
+	swept     time.Time
+	now       func() time.Time
+}
+
+type rateLimitKey struct {
+	db     string
+	client string
+}
+
+type rateBuckets struct {
+	lines tokenBucket
+	bytes tokenBucket
+}
+
+// newRateLimiter returns a limiter for the config, or nil if it sets no
+// limits.
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	enabled := config.Default.enabled()
+	for _, limit := range config.Databases {
+		enabled = enabled || limit.enabled()
+	}
+	if !enabled {
+		return nil
+	}
+
+	return &rateLimiter{
+		by:        config.By,
+		defaults:  config.Default,
+		databases: config.Databases,
+		buckets:   make(map[rateLimitKey]*rateBuckets),
+		now:       time.Now,
+	}
+}
+
+// Client returns what a request is limited by besides its database: its
+// principal or client IP, if the limiter is keyed by one.
+func (rl *rateLimiter) Client(principal, ip string) string {
+	switch rl.by {
+	case RateLimitByPrincipal:
+		return principal
+	case RateLimitByClientIP:
+		return ip
+	default:
+		return ""
+	}
+}
+
+// Allow takes tokens for a write of the given lines and bytes. If there
+// aren't enough, it takes none, and returns a rejection saying how long
+// to wait. A write larger than the burst is allowed once the bucket is
+// full, leaving it in debt.
+func (rl *rateLimiter) Allow(db, client string, lines, bytes int) *rejection {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	key := rateLimitKey{db, client}
+	buckets, ok := rl.buckets[key]
+	if !ok {
+		limit, ok := rl.databases[db]
+		if !ok {
+			limit = rl.defaults
+		}
+		buckets = &rateBuckets{
+			lines: newTokenBucket(limit.Lines, limit.LinesBurst, now),
+			bytes: newTokenBucket(limit.Bytes, limit.BytesBurst, now),
+		}
+		rl.buckets[key] = buckets
+		metrics.RateLimitBuckets().Set(float64(len(rl.buckets)))
+	}
+
+	linesWait := buckets.lines.wait(float64(lines), now)
+	bytesWait := buckets.bytes.wait(float64(bytes), now)
+	if linesWait == 0 && bytesWait == 0 {
+		buckets.lines.take(float64(lines))
+		buckets.bytes.take(float64(bytes))
+		return nil
+	}
+
+	limit, wait := rateLimitLines, linesWait
+	if bytesWait > linesWait {
+		limit, wait = rateLimitBytes, bytesWait
+	}
+	metrics.RateLimitRejectedRequestCount(db, limit).Inc()
+	metrics.RateLimitRejectedLineCount(db).Add(float64(lines))
+	metrics.RateLimitRejectedByteCount(db).Add(float64(bytes))
+
+	return &rejection{
+		status:     http.StatusTooManyRequests,
+		reason:     reasonRateLimited,
+		message:    fmt.Sprintf("rate limit exceeded for %s; retry after %v", limit, (wait+time.Millisecond/2)/time.Millisecond*time.Millisecond),
+		retryAfter: wait,
+	}
+}
+
+// sweep forgets buckets which have refilled, so that clients which have
+// gone away don't hold on to memory. It must be called with the lock
+// held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < rateLimitSweepInterval {
+		return
+	}
+	rl.swept = now
+
+	for key, buckets := range rl.buckets {
+		if buckets.lines.full(now) && buckets.bytes.full(now) {
+			delete(rl.buckets, key)
+		}
+	}
+	metrics.RateLimitBuckets().Set(float64(len(rl.buckets)))
+}
+
+// tokenBucket refills at rate tokens per second, up to its burst. A zero
+// rate never runs out.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// wait returns how long until n tokens can be taken, or zero if they can
+// be now.
+func (tb *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	tb.refill(now)
+	need := math.Min(n, tb.burst)
+	if tb.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb.rate > 0 {
+		tb.tokens -= n
+	}
+}
+
+func (tb *tokenBucket) full(now time.Time) bool {
+	if tb.rate <= 0 {
+		return true
+	}
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_rate_limiter(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{
+		Default: RateLimit{Lines: 10, LinesBurst: 20},
+		Databases: map[string]RateLimit{
+			"bulk": {Bytes: 1000},
+		},
+	})
+	require.NotNil(t, rl)
+	now := time.Unix(1500000000, 0)
+	rl.now = func() time.Time { return now }
+
+	assert.Nil(t, rl.Allow("test", "", 15, 100))
+	rejected := rl.Allow("test", "", 10, 100)
+	require.NotNil(t, rejected)
+	assert.Equal(t, http.StatusTooManyRequests, rejected.status)
+	assert.Equal(t, reasonRateLimited, rejected.reason)
+	assert.Equal(t, 500*time.Millisecond, rejected.retryAfter)
+	assert.Equal(t, "rate limit exceeded for lines; retry after 500ms", rejected.message)
+
+	// Each database has its own buckets, and limits.
+	assert.Nil(t, rl.Allow("other", "", 20, 100))
+	assert.Nil(t, rl.Allow("bulk", "", 1000000, 1000))
+	rejected = rl.Allow("bulk", "", 1, 100)
+	require.NotNil(t, rejected)
+	assert.Equal(t, "rate limit exceeded for bytes; retry after 100ms", rejected.message)
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, rl.Allow("test", "", 10, 100))
+	assert.Nil(t, rl.Allow("bulk", "", 1, 100))
+}
+
+func Test_rate_limiter_bursts(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{Default: RateLimit{Lines: 10}})
+	now := time.Unix(1500000000, 0)
+	rl.now = func() time.Time { return now }
+
+	// A write larger than the burst waits for a full bucket, and leaves
+	// it in debt.
+	assert.Nil(t, rl.Allow("test", "", 30, 0))
+	rejected := rl.Allow("test", "", 1, 0)
+	require.NotNil(t, rejected)
+	assert.Equal(t, 2100*time.Millisecond, rejected.retryAfter)
+
+	now = now.Add(2100 * time.Millisecond)
+	assert.Nil(t, rl.Allow("test", "", 1, 0))
+}
+
+func Test_rate_limiter_keys(t *testing.T) {
+	cases := []struct {
+		by     string
+		expect string
+	}{
+		{RateLimitByDatabase, ""},
+		{RateLimitByPrincipal, "alice"},
+		{RateLimitByClientIP, "10.0.0.1"},
+	}
+
+	for _, c := range cases {
+		rl := newRateLimiter(RateLimitConfig{By: c.by, Default: RateLimit{Lines: 1}})
+		assert.Equal(t, c.expect, rl.Client("alice", "10.0.0.1"))
+	}
+
+	rl := newRateLimiter(RateLimitConfig{By: RateLimitByPrincipal, Default: RateLimit{Lines: 1}})
+	now := time.Unix(1500000000, 0)
+	rl.now = func() time.Time { return now }
+
+	assert.Nil(t, rl.Allow("test", "alice", 1, 0))
+	assert.Nil(t, rl.Allow("test", "bob", 1, 0))
+	assert.NotNil(t, rl.Allow("test", "alice", 1, 0))
+	assert.Len(t, rl.buckets, 2)
+
+	// Refilled buckets are forgotten.
+	now = now.Add(rateLimitSweepInterval)
+	assert.Nil(t, rl.Allow("test", "alice", 1, 0))
+	assert.Len(t, rl.buckets, 1)
+}
+
+func Test_rate_limiter_disabled(t *testing.T) {
+	assert.Nil(t, newRateLimiter(RateLimitConfig{}))
+	assert.Nil(t, newRateLimiter(RateLimitConfig{Databases: map[string]RateLimit{"test": {}}}))
+	assert.NotNil(t, newRateLimiter(RateLimitConfig{Databases: map[string]RateLimit{"test": {Bytes: 1}}}))
+}
+
+func Test_write_handler_rate_limits(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+
+	client, teardown := newClient(makeWriteHandler(p, writeConfig{
+		rateLimits: RateLimitConfig{Default: RateLimit{Lines: 2}},
+	}))
+	defer teardown()
+
+	p.ExpectInputAndSucceed()
+	p.ExpectInputAndSucceed()
+
+	for _, expect := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foo/write?db=test")
+		req.Header.SetMethod("POST")
+		req.SetBody([]byte("foo value=1 1\nfoo value=2 2"))
+		require.NoError(t, client.Do(&req, &resp))
+
+		assert.Equal(t, expect, resp.StatusCode())
+		if expect == http.StatusTooManyRequests {
+			assert.Equal(t, "1", string(resp.Header.Peek("Retry-After")))
+			assert.Contains(t, string(resp.Body()), "rate limit exceeded for lines")
+		}
+	}
+}
+
+func Test_rate_limit_config(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-ratelimit.by", "user",
+		"-ratelimit.lines", "-1",
+	}, noEnv)
+	require.Error(t, err)
+	assert.Equal(t, `invalid rate limit key "user": use principal or client_ip, or leave it empty; `+
+		"invalid default rate limit: rates and bursts can't be negative", err.Error())
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Nordstrom/telepath/middleware"
+	log "github.com/Sirupsen/logrus"
+)
+
+// restartSettings can't be changed while Telepath is running. Reloading
+// a change to them only logs a warning.
+var restartSettings = []struct {
+	name  string
+	value func(*TelepathConfig) interface{}
+}{
+	{"kafka.brokers", func(c *TelepathConfig) interface{} { return c.Brokers }},
+	{"kafka.version", func(c *TelepathConfig) interface{} { return c.KafkaVersion }},
+	{"kafka.headers", func(c *TelepathConfig) interface{} { return c.RecordHeaders }},
+	{"kafka.producer", func(c *TelepathConfig) interface{} { return c.Producer }},
+	{"kafka.tls", func(c *TelepathConfig) interface{} { return c.KafkaTLS }},
+	{"kafka.sasl", func(c *TelepathConfig) interface{} { return c.KafkaSASL }},
+	{"kafka.batch", func(c *TelepathConfig) interface{} { return c.Batch }},
+	{"spool", func(c *TelepathConfig) interface{} { return c.Spool }},
+	{"backpressure", func(c *TelepathConfig) interface{} { return c.Backpressure }},
+	{"ratelimit", func(c *TelepathConfig) interface{} { return c.RateLimits }},
+	{"cardinality", func(c *TelepathConfig) interface{} { return c.Cardinality }},
+	{"shutdown", func(c *TelepathConfig) interface{} { return c.Shutdown }},
+	{"deadletter", func(c *TelepathConfig) interface{} { return c.DeadLetter }},
+	{"write.ack", func(c *TelepathConfig) interface{} { return c.AckMode }},
+	{"write.ack.timeout", func(c *TelepathConfig) interface{} { return c.AckTimeout }},
+	{"http.enabled", func(c *TelepathConfig) interface{} { return c.HTTP.Enabled }},
+	{"http.addr", func(c *TelepathConfig) interface{} { return c.HTTP.Addr }},
+	{"https.enabled", func(c *TelepathConfig) interface{} { return c.HTTPS.Enabled }},
+	{"https.addr", func(c *TelepathConfig) interface{} { return c.HTTPS.Addr }},
+	{"config.watch", func(c *TelepathConfig) interface{} { return c.ConfigWatch }},
+	{"https.certificate.watch", func(c *TelepathConfig) interface{} { return c.HTTPS.CertificateWatch }},
+}
+
+// reloader re-reads the configuration, and swaps in the parts which can
+// change at runtime: the topic and key templates and routes, the auth
+// credentials, users and tokens, the log settings and the TLS material.
+type reloader struct {
+	sync.Mutex
+	args      []string
+	lookupEnv func(string) (string, bool)
+	config    *TelepathConfig
+	write     *writeHandler
+	auth      *middleware.Authenticator
+	tls       *tlsStore
+	stamps    map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newReloader(config *TelepathConfig, write *writeHandler, auth *middleware.Authenticator, tls *tlsStore) *reloader {
+	r := &reloader{
+		args:      os.Args[1:],
+		lookupEnv: os.LookupEnv,
+		config:    config,
+		write:     write,
+		auth:      auth,
+		tls:       tls,
+	}
+	r.stamps = r.fileStamps(config)
+	return r
+}
+
+// Reload applies the current configuration. Nothing is changed unless
+// all of it is valid.
+func (r *reloader) Reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	config, err := loadConfig(r.args, r.lookupEnv)
+	if err != nil {
+		return err
+	}
+
+	routes, err := loadRoutes(config)
+	if err != nil {
+		return err
+	}
+	routing, err := newWriteRouting(writeConfig{
+		topicTemplate: config.TopicTemplate,
+		keyTemplate:   config.KeyTemplate,
+		routes:        routes,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := loadCredentials(&config.Auth); err != nil {
+		return err
+	}
+
+	var material *tlsMaterial
+	if r.tls != nil && config.HTTPS.Enabled {
+		if material, err = loadTLSMaterial(&config.HTTPS); err != nil {
+			return err
+		}
+	}
+
+	r.write.SetRouting(routing)
+	r.auth.Update(config.Auth)
+	if material != nil {
+		r.tls.Set(&config.HTTPS, material)
+	}
+	SetLogFormat(config.LogFormat)
+	SetLogLevel(config.LogLevel)
+
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(setting.value(r.config), setting.value(config)) {
+			log.Warnf("Ignoring the change to %s until Telepath is restarted.", setting.name)
+		}
+	}
+
+	r.config = config
+	r.stamps = r.fileStamps(config)
+	return nil
+}
+
+// Watch reloads the configuration whenever one of its files changes.
+func (r *reloader) Watch(interval time.Duration, doneCh chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneCh:
+			return
+
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+
+			log.Info("Configuration files changed, reloading.")
+			if err := r.Reload(); err != nil {
+				log.WithError(err).Error("Couldn't reload the configuration.")
+			}
+		}
+	}
+}
+
+// changed reports whether any file has changed since it was last loaded,
+// or last found to have changed, so a broken file is reported only once.
+// The TLS store watches its own files.
+func (r *reloader) changed() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	stamps := r.fileStamps(r.config)
+	if reflect.DeepEqual(stamps, r.stamps) {
+		return false
+	}
+
+	r.stamps = stamps
+	return true
+}
+
+func (r *reloader) fileStamps(config *TelepathConfig) map[string]fileStamp {
+	return statFiles([]string{
+		config.ConfigPath,
+		config.RoutesPath,
+		config.Auth.UsersPath,
+		config.Auth.TokensPath,
+		config.Auth.JWT.KeysPath,
+		config.Auth.CertificatesPath,
+	})
+}
+
+// statFiles notes the size and modification time of each file, or that
+// it is missing.
+func statFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		var stamp fileStamp
+		if info, err := os.Stat(path); err == nil {
+			stamp = fileStamp{info.ModTime(), info.Size()}
+		}
+		stamps[path] = stamp
+	}
+
+	return stamps
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Nordstrom/telepath/middleware"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_reload(t *testing.T) {
+	file, err := ioutil.TempFile("", "telepath")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	writeFile(t, file.Name(), "brokers: localhost:9092\ntopic: before\n")
+
+	config, err := loadConfig([]string{"-config", file.Name()}, noEnv)
+	require.NoError(t, err)
+
+	p := mocks.NewAsyncProducer(t, nil)
+	defer p.Close()
+	wh, err := NewWriteHandler(p, writeConfig{topicTemplate: config.TopicTemplate})
+	require.NoError(t, err)
+
+	r := newReloader(config, wh, middleware.NewAuthenticator(config.Auth), nil)
+	r.args = []string{"-config", file.Name()}
+	r.lookupEnv = noEnv
+
+	writeFile(t, file.Name(), "brokers: localhost:9093\ntopic: after\nlog_level: debug\n")
+	require.NoError(t, r.Reload())
+	assert.Equal(t, "after", routedTopic(t, wh))
+	assert.Equal(t, "localhost:9093", r.config.Brokers)
+
+	// An invalid config changes nothing.
+	writeFile(t, file.Name(), "brokers: localhost:9093\ntopic: other\nkey: \"{{\"\nlog_level: loud\n")
+	err = r.Reload()
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Len(t, err.(ConfigErrors), 2)
+	assert.Equal(t, "after", routedTopic(t, wh))
+
+	SetLogLevel("info")
+}
+
+func Test_reload_watches_files(t *testing.T) {
+	file, err := ioutil.TempFile("", "telepath")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	writeFile(t, file.Name(), "brokers: localhost:9092\n")
+
+	config, err := loadConfig([]string{"-config", file.Name()}, noEnv)
+	require.NoError(t, err)
+
+	r := newReloader(config, nil, nil, nil)
+	assert.False(t, r.changed())
+
+	writeFile(t, file.Name(), "brokers: localhost:9092,localhost:9093\n")
+	assert.True(t, r.changed())
+	assert.False(t, r.changed())
+}
+
+func routedTopic(t *testing.T, wh *writeHandler) string {
+	topic, err := wh.routing.Load().(*writeRouting).tt.Execute(pointParams{})
+	require.NoError(t, err)
+	return topic
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+
+	// Make sure the change is visible to a watcher, however coarse the
+	// file system's timestamps.
+	later := time.Now().Add(time.Duration(len(content)) * time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const UnmatchedDrop = "drop"
+const UnmatchedDefault = "default"
+const UnmatchedReject = "reject"
+
+const defaultRouteName = "default"
+
+var ErrNoRoute = errors.New("no route matches the point")
+
+// RoutesConfig is an ordered list of routing rules, read from YAML.
+//
+//	rules:
+//	  - name: prod-cpu
+//	    database: ^prod-
+//	    measurement: cpu*
+//	    tags: {env: prod}
+//	    topics: [cpu, "{{.Database}}-all"]
+//	    continue: true
+//	default:
+//	  topics: [telepath-influx-metrics]
+//	unmatched: default
+type RoutesConfig struct {
+	Rules     []RuleConfig `yaml:"rules"`
+	Default   RuleConfig   `yaml:"default"`
+	Unmatched string       `yaml:"unmatched"`
+}
+
+// RuleConfig matches points which meet every condition it sets, and
+// sends them to each of its topics. Matching stops at the first rule
+// which matches, unless it is marked to continue.
+type RuleConfig struct {
+	Name        string            `yaml:"name"`
+	Database    string            `yaml:"database"`
+	Measurement string            `yaml:"measurement"`
+	Tags        map[string]string `yaml:"tags"`
+	User        string            `yaml:"user"`
+	Topics      []string          `yaml:"topics"`
+	Key         string            `yaml:"key"`
+	Continue    bool              `yaml:"continue"`
+}
+
+type routeTable struct {
+	rules     []*route
+	def       *route
+	unmatched string
+}
+
+type route struct {
+	name        string
+	database    *regexp.Regexp
+	measurement *regexp.Regexp
+	tags        []Tag
+	user        string
+	topics      []*topicTemplate
+	kt          *keyTemplate
+	next        bool
+}
+
+// destination is a topic, and an optional key template which overrides
+// the handler's own.
+type destination struct {
+	topic string
+	kt    *keyTemplate
+}
+
+// LoadRoutes reads a routing table from a YAML file.
+func LoadRoutes(path string) (*RoutesConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &RoutesConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// NewRouteTable compiles the routing rules, returning ConfigErrors listing
+// every problem found. Without topics of its own, the default route uses
+// the handler's topic template. Rules must have unique names, other than
+// the default route's, so that their metrics can be told apart.
+func NewRouteTable(config RoutesConfig, tt *topicTemplate) (*routeTable, error) {
+	var errs ConfigErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	unmatched := config.Unmatched
+	if unmatched == "" {
+		unmatched = UnmatchedDefault
+	}
+	if unmatched != UnmatchedDrop && unmatched != UnmatchedDefault && unmatched != UnmatchedReject {
+		fail("invalid unmatched action %q: use drop, default or reject", unmatched)
+	}
+
+	rt := &routeTable{unmatched: unmatched}
+	names := make(map[string]bool)
+	for i, rc := range config.Rules {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		switch {
+		case rc.Name == defaultRouteName:
+			fail("route %s: the name is reserved for the default route", rc.Name)
+		case names[rc.Name]:
+			fail("route %s: the name is used by an earlier rule", rc.Name)
+		}
+		names[rc.Name] = true
+		if len(rc.Topics) == 0 {
+			fail("route %s: at least one topic is required", rc.Name)
+			continue
+		}
+
+		r, err := newRoute(rc)
+		if err != nil {
+			fail("route %s: %v", rc.Name, err)
+			continue
+		}
+		rt.rules = append(rt.rules, r)
+	}
+
+	def := config.Default
+	def.Name = defaultRouteName
+	def.Continue = false
+	r, err := newRoute(def)
+	if err != nil {
+		fail("route %s: %v", def.Name, err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(r.topics) == 0 {
+		r.topics = []*topicTemplate{tt}
+	}
+	rt.def = r
+
+	return rt, nil
+}
+
+func newRoute(config RuleConfig) (r *route, err error) {
+	r = &route{
+		name: config.Name,
+		user: config.User,
+		next: config.Continue,
+	}
+
+	if config.Database != "" {
+		if r.database, err = regexp.Compile(config.Database); err != nil {
+			return nil, fmt.Errorf("invalid database pattern: %v", err)
+		}
+	}
+
+	if config.Measurement != "" {
+		r.measurement = compileGlob(config.Measurement)
+	}
+
+	for key, value := range config.Tags {
+		r.tags = append(r.tags, Tag{key, value})
+	}
+
+	for _, text := range config.Topics {
+		// An empty template would be the default topic template.
+		if strings.TrimSpace(text) == "" {
+			return nil, errors.New("topics can't be empty")
+		}
+		tt, err := NewTopicTemplate(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic %q: %v", text, err)
+		}
+		r.topics = append(r.topics, tt)
+	}
+
+	if r.kt, err = NewKeyTemplate(config.Key); err != nil {
+		return nil, fmt.Errorf("invalid key %q: %v", config.Key, err)
+	}
+
+	return r, nil
+}
+
+// compileGlob converts a glob, where * matches any run of characters and
+// ? any single character, into an anchored regular expression.
+func compileGlob(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// Route returns the destinations for a point. Unmatched points go to the
+// default route, are dropped with no destinations, or are refused with
+// ErrNoRoute.
+func (rt *routeTable) Route(params pointParams) ([]destination, error) {
+	var destinations []destination
+	matched := false
+	for _, r := range rt.rules {
+		if !r.matches(params) {
+			continue
+		}
+
+		matched = true
+		ds, err := r.destinations(params)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, ds...)
+
+		if !r.next {
+			break
+		}
+	}
+
+	if matched {
+		return destinations, nil
+	}
+
+	metrics.RouteUnmatchedLineCount(params.Database, rt.unmatched).Inc()
+	switch rt.unmatched {
+	case UnmatchedDrop:
+		return nil, nil
+	case UnmatchedReject:
+		return nil, ErrNoRoute
+	}
+
+	return rt.def.destinations(params)
+}
+
+func (r *route) matches(params pointParams) bool {
+	if r.database != nil && !r.database.MatchString(params.Database) {
+		return false
+	}
+	if r.measurement != nil && !r.measurement.MatchString(params.Measurement()) {
+		return false
+	}
+	for _, tag := range r.tags {
+		if params.Tag(tag.Key) != tag.Value {
+			return false
+		}
+	}
+	if r.user != "" && r.user != params.User {
+		return false
+	}
+
+	return true
+}
+
+func (r *route) destinations(params pointParams) ([]destination, error) {
+	destinations := make([]destination, len(r.topics))
+	for i, tt := range r.topics {
+		topic, err := tt.Execute(params)
+		if err != nil {
+			metrics.RouteErrorCount(r.name).Inc()
+			return nil, err
+		}
+		destinations[i] = destination{topic, r.kt}
+	}
+
+	metrics.RouteLineCount(r.name).Inc()
+	return destinations, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_load_routes(t *testing.T) {
+	file, err := ioutil.TempFile("", "routes")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`
+rules:
+  - name: prod-cpu
+    database: ^prod$
+    measurement: cpu*
+    tags: {env: prod}
+    topics: [cpu, "{{.Database}}-all"]
+    key: "{{.SeriesKey}}"
+    continue: true
+default:
+  topics: [fallback]
+unmatched: drop
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	config, err := LoadRoutes(file.Name())
+	require.NoError(t, err)
+	require.Len(t, config.Rules, 1)
+
+	rule := config.Rules[0]
+	assert.Equal(t, "prod-cpu", rule.Name)
+	assert.Equal(t, "^prod$", rule.Database)
+	assert.Equal(t, "cpu*", rule.Measurement)
+	assert.Equal(t, map[string]string{"env": "prod"}, rule.Tags)
+	assert.Equal(t, []string{"cpu", "{{.Database}}-all"}, rule.Topics)
+	assert.Equal(t, "{{.SeriesKey}}", rule.Key)
+	assert.True(t, rule.Continue)
+	assert.Equal(t, []string{"fallback"}, config.Default.Topics)
+	assert.Equal(t, UnmatchedDrop, config.Unmatched)
+}
+
+func Test_load_routes_with_unknown_fields(t *testing.T) {
+	file, err := ioutil.TempFile("", "routes")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("rules:\n  - topic: cpu\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = LoadRoutes(file.Name())
+	assert.Error(t, err)
+}
+
+func Test_route_table(t *testing.T) {
+	rules := []RuleConfig{
+		{Name: "cpu", Measurement: "cpu*", Topics: []string{"cpu"}, Continue: true},
+		{Name: "prod", Database: "^prod", Tags: map[string]string{"env": "prod"}, Topics: []string{"prod-{{.Measurement}}"}},
+		{Name: "joe", User: "joe", Topics: []string{"joe", "audit"}},
+		{Name: "everything", Database: ".", Topics: []string{"everything"}},
+	}
+
+	cases := []struct {
+		label     string
+		db        string
+		user      string
+		line      string
+		unmatched string
+		topics    []string
+		err       error
+	}{
+		{
+			label:  "Measurement glob",
+			db:     "test",
+			line:   "cpu_load value=1 1",
+			topics: []string{"cpu", "everything"},
+		}, {
+			label:  "Continue then stop",
+			db:     "prod-east",
+			line:   "cpu,env=prod value=1 1",
+			topics: []string{"cpu", "prod-cpu"},
+		}, {
+			label:  "Tag mismatch",
+			db:     "prod-east",
+			line:   "mem,env=dev value=1 1",
+			topics: []string{"everything"},
+		}, {
+			label:  "Authenticated user",
+			db:     "test",
+			user:   "joe",
+			line:   "mem value=1 1",
+			topics: []string{"joe", "audit"},
+		}, {
+			label:  "Unmatched to default route",
+			line:   "mem value=1 1",
+			topics: []string{"default"},
+		}, {
+			label:     "Unmatched dropped",
+			line:      "mem value=1 1",
+			unmatched: UnmatchedDrop,
+		}, {
+			label:     "Unmatched rejected",
+			line:      "mem value=1 1",
+			unmatched: UnmatchedReject,
+			err:       ErrNoRoute,
+		}, {
+			label: "Invalid topic",
+			db:    "prod",
+			line:  "a/b,env=prod value=1 1",
+			err:   ErrTopicNameChars,
+		},
+	}
+
+	tt, err := NewTopicTemplate("default")
+	require.NoError(t, err)
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			rt, err := NewRouteTable(RoutesConfig{Rules: rules, Unmatched: c.unmatched}, tt)
+			require.NoError(t, err)
+
+			point, err := ParsePoint([]byte(c.line), "ns", time.Now())
+			require.NoError(t, err)
+
+			destinations, err := rt.Route(pointParams{Database: c.db, User: c.user, point: point})
+			assert.Equal(t, c.err, err)
+
+			var topics []string
+			for _, dest := range destinations {
+				topics = append(topics, dest.topic)
+			}
+			assert.Equal(t, c.topics, topics)
+		})
+	}
+}
+
+func Test_route_table_errors(t *testing.T) {
+	cases := []struct {
+		label  string
+		config RoutesConfig
+		err    string
+	}{
+		{
+			label:  "Invalid unmatched action",
+			config: RoutesConfig{Unmatched: "ignore"},
+			err:    `invalid unmatched action "ignore": use drop, default or reject`,
+		}, {
+			label:  "Missing topics",
+			config: RoutesConfig{Rules: []RuleConfig{{Database: "foo"}}},
+			err:    "route rule-1: at least one topic is required",
+		}, {
+			label:  "Invalid database pattern",
+			config: RoutesConfig{Rules: []RuleConfig{{Name: "bad", Database: "(", Topics: []string{"foo"}}}},
+			err:    "route bad: invalid database pattern: error parsing regexp: missing closing ): `(`",
+		}, {
+			label:  "Invalid topic template",
+			config: RoutesConfig{Rules: []RuleConfig{{Name: "bad", Topics: []string{"{{"}}}},
+			err:    `route bad: invalid topic "{{": template: :1: unclosed action`,
+		}, {
+			label:  "Invalid key template",
+			config: RoutesConfig{Default: RuleConfig{Key: "{{.Nope}}"}},
+		}, {
+			label:  "Empty topic",
+			config: RoutesConfig{Rules: []RuleConfig{{Name: "empty", Topics: []string{"foo", " "}}}},
+			err:    "route empty: topics can't be empty",
+		}, {
+			label: "Duplicate names",
+			config: RoutesConfig{Rules: []RuleConfig{
+				{Name: "cpu", Topics: []string{"foo"}},
+				{Name: "cpu", Topics: []string{"bar"}},
+			}},
+			err: "route cpu: the name is used by an earlier rule",
+		}, {
+			label: "Duplicate generated names",
+			config: RoutesConfig{Rules: []RuleConfig{
+				{Name: "rule-2", Topics: []string{"foo"}},
+				{Topics: []string{"bar"}},
+			}},
+			err: "route rule-2: the name is used by an earlier rule",
+		}, {
+			label:  "Reserved name",
+			config: RoutesConfig{Rules: []RuleConfig{{Name: "default", Topics: []string{"foo"}}}},
+			err:    "route default: the name is reserved for the default route",
+		}, {
+			label: "Every problem",
+			config: RoutesConfig{
+				Rules:     []RuleConfig{{Name: "default"}},
+				Unmatched: "ignore",
+			},
+			err: `invalid unmatched action "ignore": use drop, default or reject; ` +
+				"route default: the name is reserved for the default route; " +
+				"route default: at least one topic is required",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			_, err := NewRouteTable(c.config, nil)
+			require.Error(t, err)
+			require.IsType(t, ConfigErrors{}, err)
+			if c.err != "" {
+				assert.Equal(t, c.err, err.Error())
+			}
+		})
+	}
+}
+
+func Test_route_key_override(t *testing.T) {
+	rt, err := NewRouteTable(RoutesConfig{
+		Rules: []RuleConfig{{Topics: []string{"foo"}, Key: "{{.Measurement}}"}},
+	}, nil)
+	require.NoError(t, err)
+
+	point, err := ParsePoint([]byte("cpu value=1 1"), "ns", time.Now())
+	require.NoError(t, err)
+
+	destinations, err := rt.Route(pointParams{point: point})
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	require.NotNil(t, destinations[0].kt)
+
+	key, err := destinations[0].kt.Execute(pointParams{point: point})
+	require.NoError(t, err)
+	assert.Equal(t, "cpu", string(key))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/valyala/fasthttp"
+)
+
+// Shutdown defaults.
+const (
+	DefaultShutdownGrace        = 30 * time.Second
+	DefaultShutdownFlushTimeout = 30 * time.Second
+)
+
+// ShutdownConfig bounds how long Telepath waits for its work to finish
+// when it's asked to stop.
+type ShutdownConfig struct {
+	// Grace is how long requests being handled have to finish.
+	Grace time.Duration `yaml:"grace"`
+
+	// FlushTimeout is how long Kafka has to acknowledge the messages the
+	// producer still holds.
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+}
+
+// validateShutdown reports problems with the shutdown settings.
+func (c *TelepathConfig) validateShutdown(fail func(string, ...interface{})) {
+	if c.Shutdown.Grace < 0 {
+		fail("shutdown grace period can't be negative")
+	}
+	if c.Shutdown.FlushTimeout < 0 {
+		fail("shutdown flush timeout can't be negative")
+	}
+}
+
+// drainer keeps track of the requests being handled, so that shutdown can
+// wait for them. fasthttp servers can't be shut down, and keep serving
+// open connections after their listeners are closed, so once it's
+// draining, further requests are turned away and their connections
+// closed.
+type drainer struct {
+	sync.Mutex
+	handlers sync.WaitGroup
+	inflight int64
+	draining bool
+}
+
+// Handler counts the requests handled by h.
+func (d *drainer) Handler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !d.enter() {
+			ctx.Error("Telepath is shutting down", http.StatusServiceUnavailable)
+			ctx.SetConnectionClose()
+			return
+		}
+		defer d.leave()
+
+		h(ctx)
+
+		d.Lock()
+		if d.draining {
+			ctx.SetConnectionClose()
+		}
+		d.Unlock()
+	}
+}
+
+func (d *drainer) enter() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.handlers.Add(1)
+	atomic.AddInt64(&d.inflight, 1)
+	return true
+}
+
+func (d *drainer) leave() {
+	atomic.AddInt64(&d.inflight, -1)
+	d.handlers.Done()
+}
+
+// Drain turns further requests away, and waits up to the grace period for
+// those being handled to finish. It returns how many didn't.
+func (d *drainer) Drain(grace time.Duration) int64 {
+	d.Lock()
+	d.draining = true
+	d.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.handlers.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+		return atomic.LoadInt64(&d.inflight)
+	}
+}
+
+// producerTally counts the messages Kafka accepted, and those it refused,
+// telling those which were spooled from those which were lost. Replayed
+// messages are left out, as they stay in the spool until Kafka takes them,
+// and so are dead letters.
+type producerTally struct {
+	succeeded int64
+	failed    int64
+	spooled   int64
+}
+
+func (t *producerTally) Success(msg *sarama.ProducerMessage) {
+	if t == nil || bypassedQueue(msg) {
+		return
+	}
+	atomic.AddInt64(&t.succeeded, 1)
+}
+
+func (t *producerTally) Failure(msg *sarama.ProducerMessage, spooled bool) {
+	if t == nil || bypassedQueue(msg) {
+		return
+	}
+	if spooled {
+		atomic.AddInt64(&t.spooled, 1)
+	} else {
+		atomic.AddInt64(&t.failed, 1)
+	}
+}
+
+// Snapshot returns the counts so far.
+func (t *producerTally) Snapshot() producerTally {
+	return producerTally{
+		succeeded: atomic.LoadInt64(&t.succeeded),
+		failed:    atomic.LoadInt64(&t.failed),
+		spooled:   atomic.LoadInt64(&t.spooled),
+	}
+}
+
+// Since returns the counts since an earlier snapshot.
+func (t producerTally) Since(earlier producerTally) producerTally {
+	return producerTally{
+		succeeded: t.succeeded - earlier.succeeded,
+		failed:    t.failed - earlier.failed,
+		spooled:   t.spooled - earlier.spooled,
+	}
+}
+
+// bypassedQueue reports whether a message went straight to the producer,
+// rather than through the producer queue.
+func bypassedQueue(msg *sarama.ProducerMessage) bool {
+	switch msg.Metadata.(type) {
+	case *replayMetadata, *deadLetterMetadata:
+		return true
+	}
+	return false
+}
+
+// flushProducer closes the producer, and waits up to the timeout for it to
+// hand back every message it holds, which it does through followProducer.
+// It reports whether it did.
+func flushProducer(producer sarama.AsyncProducer, followed <-chan struct{}, timeout time.Duration) bool {
+	producer.AsyncClose()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-followed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
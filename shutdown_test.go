@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_drainer_waits_for_requests(t *testing.T) {
+	d := &drainer{}
+	release := make(chan struct{})
+	handler := d.Handler(func(ctx *fasthttp.RequestCtx) {
+		<-release
+		ctx.SetStatusCode(http.StatusNoContent)
+	})
+
+	var ctx fasthttp.RequestCtx
+	go handler(&ctx)
+	for atomic.LoadInt64(&d.inflight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	drained := make(chan int64)
+	go func() { drained <- d.Drain(time.Minute) }()
+
+	// Further requests are turned away while draining.
+	for !d.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	var turnedAway fasthttp.RequestCtx
+	handler(&turnedAway)
+	assert.Equal(t, http.StatusServiceUnavailable, turnedAway.Response.StatusCode())
+	assert.True(t, turnedAway.Response.ConnectionClose())
+
+	close(release)
+	assert.Equal(t, int64(0), <-drained)
+	assert.Equal(t, http.StatusNoContent, ctx.Response.StatusCode())
+	assert.True(t, ctx.Response.ConnectionClose(), "the connection is closed after the request")
+}
+
+func (d *drainer) isDraining() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.draining
+}
+
+func Test_drainer_grace_period(t *testing.T) {
+	d := &drainer{}
+	release := make(chan struct{})
+	defer close(release)
+	handler := d.Handler(func(ctx *fasthttp.RequestCtx) { <-release })
+
+	go handler(&fasthttp.RequestCtx{})
+	for atomic.LoadInt64(&d.inflight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, int64(1), d.Drain(10*time.Millisecond))
+}
+
+func Test_producer_tally(t *testing.T) {
+	tally := &producerTally{}
+	msg := &sarama.ProducerMessage{Topic: "metrics"}
+	replayed := &sarama.ProducerMessage{Topic: "metrics", Metadata: &replayMetadata{}}
+
+	tally.Success(msg)
+	before := tally.Snapshot()
+
+	tally.Success(msg)
+	tally.Success(replayed)
+	tally.Failure(msg, true)
+	tally.Failure(msg, false)
+	tally.Failure(replayed, false)
+
+	assert.Equal(t, producerTally{succeeded: 1, failed: 1, spooled: 1}, tally.Snapshot().Since(before))
+	(*producerTally)(nil).Success(msg)
+}
+
+func Test_flush_producer(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	p := mocks.NewAsyncProducer(t, config)
+
+	tally := &producerTally{}
+	followed := make(chan struct{})
+	go func() {
+		followProducer(p, nil, nil, tally)
+		close(followed)
+	}()
+
+	p.ExpectInputAndSucceed()
+	p.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	p.Input() <- &sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("foo value=1 1")}
+	p.Input() <- &sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("foo value=2 2")}
+
+	require.True(t, flushProducer(p, followed, time.Second))
+	assert.Equal(t, producerTally{succeeded: 1, failed: 1}, tally.Snapshot())
+}
+
+func Test_flush_producer_timeout(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+
+	// Nothing follows the producer, so it's never seen to finish.
+	assert.False(t, flushProducer(p, make(chan struct{}), 10*time.Millisecond))
+}
+
+func Test_shutdown_config_validation(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-shutdown.grace", "-1s",
+	}, noEnv)
+	require.Error(t, err)
+	assert.Equal(t, "shutdown grace period can't be negative", err.Error())
+}
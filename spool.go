@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Spool defaults.
+const (
+	DefaultSpoolSegmentBytes   = 64 * 1024 * 1024
+	DefaultSpoolMaxBytes       = 1024 * 1024 * 1024
+	DefaultSpoolDeadline       = 5 * time.Second
+	DefaultSpoolReplayInterval = 5 * time.Second
+)
+
+// Why a message was spooled.
+const (
+	spoolReasonDeadline = "deadline"
+	spoolReasonError    = "error"
+	spoolReasonShutdown = "shutdown"
+)
+
+const (
+	spoolExtension = ".spool"
+
+	// Each record has a header of its payload's length and CRC.
+	spoolHeaderSize = 8
+
+	// The most messages to replay before waiting for Kafka to acknowledge
+	// them.
+	spoolReplayBatch = 500
+)
+
+// errSpooled is the delivery error for a message which the producer
+// didn't take in time, and was spooled instead.
+var errSpooled = errors.New("Kafka didn't accept the line in time; it was spooled to disk")
+
+// errNotSpooled is the delivery error for a message which the producer
+// didn't take in time, and couldn't be spooled either.
+var errNotSpooled = errors.New("Kafka didn't accept the line in time, and it couldn't be spooled")
+
+// SpoolConfig sets up the write-ahead spool, which keeps messages Kafka
+// can't take on disk until it recovers. It is disabled without a Dir.
+type SpoolConfig struct {
+	Dir            string        `yaml:"dir"`
+	SegmentBytes   int64         `yaml:"segment_bytes"`
+	MaxBytes       int64         `yaml:"max_bytes"`
+	Deadline       time.Duration `yaml:"deadline"`
+	ReplayInterval time.Duration `yaml:"replay_interval"`
+}
+
+// validateSpool reports problems with the spool settings.
+func (c *TelepathConfig) validateSpool(fail func(string, ...interface{})) {
+	s := c.Spool
+	if s.Dir == "" {
+		return
+	}
+	if s.SegmentBytes < 1 {
+		fail("spool segment bytes must be at least 1")
+	}
+	if s.MaxBytes < s.SegmentBytes {
+		fail("spool max bytes must be at least the segment bytes")
+	}
+	if s.Deadline <= 0 {
+		fail("spool deadline must be positive")
+	}
+	if s.ReplayInterval <= 0 {
+		fail("spool replay interval must be positive")
+	}
+}
+
+// spool appends messages to segment files in a directory, and replays
+// them to Kafka in order once it recovers. Each message is synced to disk
+// before it's reported as spooled, so that it survives the host
+// crashing. Segments are deleted once every message in them has been
+// acknowledged. Delivery is at least once: a segment partly replayed
+// before a restart is replayed again from its start.
+type spool struct {
+	sync.Mutex
+	dir            string
+	segmentBytes   int64
+	maxBytes       int64
+	deadline       time.Duration
+	replayInterval time.Duration
+
+	// segments are oldest first; the last is appended to while file is
+	// open.
+	segments []*spoolSegment
+	file     *os.File
+	sequence uint64
+	bytes    int64
+
+	// offset is how far into the oldest segment has been replayed.
+	offset int64
+}
+
+type spoolSegment struct {
+	path   string
+	size   int64
+	oldest time.Time
+}
+
+// spoolRecord is a message as it is kept on disk.
+type spoolRecord struct {
+	spooled   time.Time
+	topic     string
+	key       []byte
+	value     []byte
+	timestamp time.Time
+	headers   []sarama.RecordHeader
+}
+
+// replayMetadata marks a message replayed from the spool, which stays on
+// disk until the whole batch is acknowledged.
+type replayMetadata struct {
+	tracker *deliveryTracker
+}
+
+// newSpool opens the spool directory, creating it if need be, and picks
+// up any segments left by an earlier run.
+func newSpool(config *SpoolConfig) (*spool, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory %s: %v", config.Dir, err)
+	}
+
+	s := &spool{
+		dir:            config.Dir,
+		segmentBytes:   config.SegmentBytes,
+		maxBytes:       config.MaxBytes,
+		deadline:       config.Deadline,
+		replayInterval: config.ReplayInterval,
+	}
+
+	entries, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory %s: %v", config.Dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != spoolExtension {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		if sequence > s.sequence {
+			s.sequence = sequence
+		}
+
+		segment := &spoolSegment{path: filepath.Join(config.Dir, name), size: entry.Size()}
+		segment.oldest = firstRecordTime(segment.path, segment.size, entry.ModTime())
+		s.segments = append(s.segments, segment)
+		s.bytes += segment.size
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].path < s.segments[j].path
+	})
+
+	if len(s.segments) > 0 {
+		log.WithFields(log.Fields{
+			"dir":      config.Dir,
+			"segments": len(s.segments),
+			"bytes":    s.bytes,
+		}).Info("Found spooled messages to replay.")
+	}
+	s.report()
+	return s, nil
+}
+
+// Produce hands a message to the producer, spooling it instead if the
+// producer doesn't take it within the deadline. Without a spool, it waits
+// as long as it takes. It gives up, without spooling the message, once
+// done is closed. It returns whether the producer took the message, and
+// if not, whether it was spooled; either way, the message is left for the
+// caller to acknowledge.
+func (s *spool) Produce(input chan<- *sarama.ProducerMessage, done <-chan struct{}, msg *sarama.ProducerMessage) (taken, spooled bool) {
+	if s == nil {
+		select {
+		case input <- msg:
+			return true, false
+		case <-done:
+			return false, false
+		}
+	}
+
+	select {
+	case input <- msg:
+		return true, false
+	default:
+	}
+
+	timer := time.NewTimer(s.deadline)
+	defer timer.Stop()
+
+	select {
+	case input <- msg:
+		return true, false
+	case <-done:
+		return false, false
+	case <-timer.C:
+		return false, s.Spool(msg, spoolReasonDeadline)
+	}
+}
+
+// Rescue spools a message the producer gave up on, if the error suggests
+// Kafka will take it later. It returns whether the message was spooled.
+func (s *spool) Rescue(err *sarama.ProducerError) bool {
+	if s == nil || !retriable(err.Err) {
+		return false
+	}
+	if _, ok := err.Msg.Metadata.(*replayMetadata); ok {
+		// It's still on disk, and will be replayed again.
+		return false
+	}
+
+	return s.Spool(err.Msg, spoolReasonError)
+}
+
+// Spool appends a message to the current segment, starting a new one if
+// it is full. Messages which would take the spool past its limit are
+// dropped.
+func (s *spool) Spool(msg *sarama.ProducerMessage, reason string) bool {
+	record := spoolRecord{
+		spooled:   time.Now(),
+		topic:     msg.Topic,
+		timestamp: msg.Timestamp,
+		headers:   msg.Headers,
+	}
+	if msg.Key != nil {
+		record.key, _ = msg.Key.Encode()
+	}
+	if msg.Value != nil {
+		record.value, _ = msg.Value.Encode()
+	}
+	data := record.encode()
+
+	s.Lock()
+	defer s.Unlock()
+	defer s.report()
+
+	if s.bytes+int64(len(data)) > s.maxBytes {
+		metrics.SpoolDroppedMessageCount().Inc()
+		log.WithFields(log.Fields{
+			"topic": msg.Topic,
+			"bytes": s.bytes,
+		}).Error("The spool is full; dropped a message.")
+		return false
+	}
+
+	if err := s.append(data, record.spooled); err != nil {
+		metrics.SpoolDroppedMessageCount().Inc()
+		log.WithError(err).WithFields(log.Fields{
+			"topic": msg.Topic,
+			"dir":   s.dir,
+		}).Error("Couldn't spool a message.")
+		return false
+	}
+
+	metrics.SpoolMessageCount(reason).Inc()
+	return true
+}
+
+// append must be called with the lock held.
+func (s *spool) append(data []byte, spooled time.Time) error {
+	current := s.current()
+	if s.file != nil && current.size > 0 && current.size+int64(len(data)) > s.segmentBytes {
+		s.file.Close()
+		s.file = nil
+	}
+
+	if s.file == nil {
+		s.sequence++
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.sequence, spoolExtension))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		if err := syncDir(s.dir); err != nil {
+			file.Close()
+			os.Remove(path)
+			return err
+		}
+		s.file = file
+		current = &spoolSegment{path: path, oldest: spooled}
+		s.segments = append(s.segments, current)
+	}
+
+	n, err := s.file.Write(data)
+	current.size += int64(n)
+	s.bytes += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// syncDir syncs a directory, so that the files created in it survive a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// current returns the segment being appended to, if there is one. It
+// must be called with the lock held.
+func (s *spool) current() *spoolSegment {
+	if s.file == nil || len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// Replay sends the spooled messages to the producer every replay
+// interval, until Kafka stops taking them. It's done once doneCh is
+// closed, and sends nothing more, so that the producer can be closed.
+func (s *spool) Replay(input chan<- *sarama.ProducerMessage, wg *sync.WaitGroup, doneCh chan bool) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(s.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneCh:
+			return
+
+		case <-ticker.C:
+			if err := s.replay(input, doneCh); err != nil {
+				log.WithError(err).Warn("Couldn't replay the spool to Kafka; will try again.")
+			}
+			s.Lock()
+			s.report()
+			s.Unlock()
+		}
+	}
+}
+
+// replay sends the spooled messages in order, a batch at a time, and
+// waits for Kafka to acknowledge each batch before moving on.
+func (s *spool) replay(input chan<- *sarama.ProducerMessage, doneCh chan bool) error {
+	for {
+		s.Lock()
+		if len(s.segments) == 0 {
+			s.Unlock()
+			return nil
+		}
+		segment := s.segments[0]
+		offset, limit := s.offset, segment.size
+		s.Unlock()
+
+		records, next, err := readSpoolRecords(segment.path, offset, limit, spoolReplayBatch)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"segment": segment.path,
+				"offset":  offset,
+			}).Error("Skipping the rest of a damaged spool segment.")
+			next = limit
+		}
+
+		if len(records) > 0 {
+			replayed, err := s.replayRecords(input, records, doneCh)
+			if err != nil {
+				return err
+			}
+			metrics.SpoolReplayedMessageCount().Add(float64(replayed))
+		}
+
+		s.Lock()
+		s.offset = next
+		if len(records) > 0 {
+			segment.oldest = records[len(records)-1].spooled
+		}
+		if s.offset >= segment.size {
+			s.remove(segment)
+		}
+		s.Unlock()
+	}
+}
+
+// remove deletes a fully replayed segment. It must be called with the
+// lock held.
+func (s *spool) remove(segment *spoolSegment) {
+	if segment == s.current() {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Remove(segment.path); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"segment": segment.path,
+		}).Error("Couldn't remove a replayed spool segment.")
+	}
+
+	s.segments = s.segments[1:]
+	s.bytes -= segment.size
+	s.offset = 0
+}
+
+// replayRecords produces a batch of records, returning how many Kafka
+// took. Messages Kafka refuses outright are dropped, so they can't hold up
+// the rest of the spool.
+func (s *spool) replayRecords(input chan<- *sarama.ProducerMessage, records []spoolRecord, doneCh chan bool) (int, error) {
+	tracker := newDeliveryTracker()
+	for _, record := range records {
+		msg := &sarama.ProducerMessage{
+			Topic:     record.topic,
+			Value:     sarama.ByteEncoder(record.value),
+			Headers:   record.headers,
+			Timestamp: record.timestamp,
+			Metadata:  &replayMetadata{tracker},
+		}
+		if record.key != nil {
+			msg.Key = sarama.ByteEncoder(record.key)
+		}
+
+		// Once done, don't send even if the producer is ready, too.
+		select {
+		case <-doneCh:
+			return 0, errors.New("shutting down")
+		default:
+		}
+
+		tracker.Add()
+		select {
+		case input <- msg:
+		case <-doneCh:
+			return 0, errors.New("shutting down")
+		}
+	}
+	tracker.Seal()
+
+	select {
+	case <-tracker.done:
+	case <-doneCh:
+		return 0, errors.New("shutting down")
+	}
+
+	succeeded, failed, _, err := tracker.Result()
+	if failed > 0 && retriable(err) {
+		return 0, err
+	}
+	if failed > 0 {
+		metrics.SpoolDroppedMessageCount().Add(float64(failed))
+		log.WithError(err).WithFields(log.Fields{
+			"failed": failed,
+		}).Error("Kafka refused spooled messages; dropped them.")
+	}
+	return succeeded, nil
+}
+
+// report updates the spool's gauges. It must be called with the lock
+// held.
+func (s *spool) report() {
+	metrics.SpoolBytes().Set(float64(s.bytes))
+	if len(s.segments) == 0 {
+		metrics.SpoolAge().Set(0)
+		return
+	}
+	metrics.SpoolAge().Set(time.Since(s.segments[0].oldest).Seconds())
+}
+
+// Close closes the segment being appended to. The spool is replayed when
+// Telepath next starts.
+func (s *spool) Close() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// retriable tells errors Kafka may recover from, such as a broker being
+// unreachable, from those it won't, such as a message being too large.
+func retriable(err error) bool {
+	switch err {
+	case sarama.ErrOutOfBrokers, sarama.ErrNotConnected, sarama.ErrLeaderNotAvailable,
+		sarama.ErrNotLeaderForPartition, sarama.ErrRequestTimedOut, sarama.ErrBrokerNotAvailable,
+		sarama.ErrReplicaNotAvailable, sarama.ErrNetworkException, sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// encode lays out a record as its header, then the time it was spooled,
+// its topic, its key (with a length of -1 if it has none), its record
+// timestamp (the least int64 if it has none), its record headers and its
+// value.
+func (r spoolRecord) encode() []byte {
+	size := 8 + 2 + len(r.topic) + 4 + len(r.key) + 8 + 2 + len(r.value)
+	for _, header := range r.headers {
+		size += 2 + len(header.Key) + 4 + len(header.Value)
+	}
+	data := make([]byte, spoolHeaderSize+size)
+	payload := data[spoolHeaderSize:]
+
+	binary.BigEndian.PutUint64(payload, uint64(r.spooled.UnixNano()))
+	binary.BigEndian.PutUint16(payload[8:], uint16(len(r.topic)))
+	i := 10 + copy(payload[10:], r.topic)
+	if r.key == nil {
+		binary.BigEndian.PutUint32(payload[i:], 0xffffffff)
+	} else {
+		binary.BigEndian.PutUint32(payload[i:], uint32(len(r.key)))
+	}
+	i += 4
+	i += copy(payload[i:], r.key)
+
+	timestamp := int64(math.MinInt64)
+	if !r.timestamp.IsZero() {
+		timestamp = r.timestamp.UnixNano()
+	}
+	binary.BigEndian.PutUint64(payload[i:], uint64(timestamp))
+	i += 8
+
+	binary.BigEndian.PutUint16(payload[i:], uint16(len(r.headers)))
+	i += 2
+	for _, header := range r.headers {
+		binary.BigEndian.PutUint16(payload[i:], uint16(len(header.Key)))
+		i += 2
+		i += copy(payload[i:], header.Key)
+		binary.BigEndian.PutUint32(payload[i:], uint32(len(header.Value)))
+		i += 4
+		i += copy(payload[i:], header.Value)
+	}
+	copy(payload[i:], r.value)
+
+	binary.BigEndian.PutUint32(data, uint32(size))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+	return data
+}
+
+func decodeSpoolRecord(payload []byte) (spoolRecord, error) {
+	var r spoolRecord
+	if len(payload) < 14 {
+		return r, io.ErrUnexpectedEOF
+	}
+
+	r.spooled = time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	topicLength := int(binary.BigEndian.Uint16(payload[8:]))
+	i := 10
+	if len(payload) < i+topicLength+4 {
+		return r, io.ErrUnexpectedEOF
+	}
+	r.topic = string(payload[i : i+topicLength])
+	i += topicLength
+
+	keyLength := binary.BigEndian.Uint32(payload[i:])
+	i += 4
+	if keyLength != 0xffffffff {
+		if len(payload) < i+int(keyLength) {
+			return r, io.ErrUnexpectedEOF
+		}
+		r.key = payload[i : i+int(keyLength)]
+		i += int(keyLength)
+	}
+
+	if len(payload) < i+8+2 {
+		return r, io.ErrUnexpectedEOF
+	}
+	if timestamp := int64(binary.BigEndian.Uint64(payload[i:])); timestamp != math.MinInt64 {
+		r.timestamp = time.Unix(0, timestamp)
+	}
+	i += 8
+
+	headers := int(binary.BigEndian.Uint16(payload[i:]))
+	i += 2
+	for ; headers > 0; headers-- {
+		if len(payload) < i+2 {
+			return r, io.ErrUnexpectedEOF
+		}
+		keyLength := int(binary.BigEndian.Uint16(payload[i:]))
+		i += 2
+		if len(payload) < i+keyLength+4 {
+			return r, io.ErrUnexpectedEOF
+		}
+		key := payload[i : i+keyLength]
+		i += keyLength
+
+		valueLength := int(binary.BigEndian.Uint32(payload[i:]))
+		i += 4
+		if valueLength < 0 || len(payload) < i+valueLength {
+			return r, io.ErrUnexpectedEOF
+		}
+		r.headers = append(r.headers, sarama.RecordHeader{Key: key, Value: payload[i : i+valueLength]})
+		i += valueLength
+	}
+
+	r.value = payload[i:]
+	return r, nil
+}
+
+// readSpoolRecords reads up to max records from a segment, starting at
+// offset and stopping at limit. It returns the offset of the record after
+// the last one read.
+func readSpoolRecords(path string, offset, limit int64, max int) ([]spoolRecord, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	reader := bufio.NewReader(io.LimitReader(file, limit-offset))
+
+	var records []spoolRecord
+	header := make([]byte, spoolHeaderSize)
+	for len(records) < max && offset < limit {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return records, offset, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		if offset+spoolHeaderSize+size > limit {
+			return records, offset, io.ErrUnexpectedEOF
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return records, offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return records, offset, errors.New("record checksum doesn't match")
+		}
+
+		record, err := decodeSpoolRecord(payload)
+		if err != nil {
+			return records, offset, err
+		}
+		records = append(records, record)
+		offset += int64(spoolHeaderSize + len(payload))
+	}
+
+	return records, offset, nil
+}
+
+// firstRecordTime returns when the first message in a segment was
+// spooled, or otherwise the given time.
+func firstRecordTime(path string, size int64, otherwise time.Time) time.Time {
+	records, _, err := readSpoolRecords(path, 0, size, 1)
+	if err != nil || len(records) == 0 {
+		return otherwise
+	}
+	return records[0].spooled
+}
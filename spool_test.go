@@ -0,0 +1,306 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_spool_record_encoding(t *testing.T) {
+	cases := []spoolRecord{
+		{spooled: time.Unix(0, 1500000000000000000), topic: "metrics", key: []byte("cpu"), value: []byte("cpu value=1 1")},
+		{spooled: time.Unix(0, 1), topic: "metrics", value: []byte("cpu value=1 1")},
+		{spooled: time.Unix(0, 1), topic: "metrics", key: []byte{}, value: []byte{}},
+		{
+			spooled:   time.Unix(0, 1),
+			topic:     "metrics",
+			value:     []byte("cpu value=1 1"),
+			timestamp: time.Unix(0, 0),
+			headers: []sarama.RecordHeader{
+				{Key: []byte("db"), Value: []byte("telegraf")},
+				{Key: []byte("principal"), Value: []byte{}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		data := c.encode()
+		record, err := decodeSpoolRecord(data[spoolHeaderSize:])
+		require.NoError(t, err)
+		assert.Equal(t, c, record)
+	}
+}
+
+func Test_spool_replays_in_order(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 100, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+	for _, line := range []string{"a value=1 1", "b value=2 2", "c value=3 3", "d value=4 4"} {
+		require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder(line)}, spoolReasonError))
+	}
+	assert.Len(t, spoolSegments(t, dir), 2, "segments are capped at 100 bytes")
+	s.Close()
+
+	// A restarted spool picks up where the last left off.
+	s, err = newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 100, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Key: sarama.StringEncoder("e"), Value: sarama.StringEncoder("e value=5 5")}, spoolReasonDeadline))
+	assert.Len(t, spoolSegments(t, dir), 3)
+
+	input, lines := acknowledgingInput(nil)
+	doneCh := make(chan bool)
+	defer close(doneCh)
+	require.NoError(t, s.replay(input, doneCh))
+
+	assert.Equal(t, []string{"a value=1 1", "b value=2 2", "c value=3 3", "d value=4 4", "e value=5 5"}, *lines)
+	assert.Empty(t, spoolSegments(t, dir))
+	assert.Equal(t, int64(0), s.bytes)
+
+	// The spool carries on after replaying everything.
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("f value=6 6")}, spoolReasonError))
+	assert.Len(t, spoolSegments(t, dir), 1)
+}
+
+func Test_spool_keeps_headers_and_timestamps(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+	headers := []sarama.RecordHeader{
+		{Key: []byte("db"), Value: []byte("telegraf")},
+		{Key: []byte("request_id"), Value: []byte("abc")},
+	}
+	require.True(t, s.Spool(&sarama.ProducerMessage{
+		Topic:     "metrics",
+		Value:     sarama.StringEncoder("a value=1 1"),
+		Headers:   headers,
+		Timestamp: time.Unix(1, 0),
+	}, spoolReasonError))
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("b value=2 2")}, spoolReasonError))
+
+	input := make(chan *sarama.ProducerMessage)
+	replayed := make(chan *sarama.ProducerMessage, 2)
+	go func() {
+		for msg := range input {
+			replayed <- msg
+			acknowledge(msg, nil)
+		}
+	}()
+	defer close(input)
+
+	doneCh := make(chan bool)
+	defer close(doneCh)
+	require.NoError(t, s.replay(input, doneCh))
+
+	msg := <-replayed
+	assert.Equal(t, headers, msg.Headers)
+	assert.True(t, time.Unix(1, 0).Equal(msg.Timestamp))
+
+	msg = <-replayed
+	assert.Nil(t, msg.Headers)
+	assert.True(t, msg.Timestamp.IsZero())
+}
+
+func Test_spool_keeps_messages_until_kafka_recovers(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")}, spoolReasonError))
+
+	doneCh := make(chan bool)
+	defer close(doneCh)
+
+	input, lines := acknowledgingInput(sarama.ErrOutOfBrokers)
+	assert.Equal(t, sarama.ErrOutOfBrokers, s.replay(input, doneCh))
+	assert.Len(t, spoolSegments(t, dir), 1)
+
+	input, lines = acknowledgingInput(nil)
+	require.NoError(t, s.replay(input, doneCh))
+	assert.Equal(t, []string{"a value=1 1"}, *lines)
+	assert.Empty(t, spoolSegments(t, dir))
+}
+
+func Test_spool_replay_stops_when_done(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond, ReplayInterval: time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")}, spoolReasonError))
+
+	// The producer takes a message, but never acknowledges it.
+	input := make(chan *sarama.ProducerMessage)
+	doneCh := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go s.Replay(input, wg, doneCh)
+	<-input
+
+	close(doneCh)
+	replayed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(replayed)
+	}()
+	select {
+	case <-replayed:
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout while waiting for the replay to stop")
+	}
+	assert.Len(t, spoolSegments(t, dir), 1)
+}
+
+func Test_spool_drops_messages_kafka_refuses(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")}, spoolReasonError))
+
+	doneCh := make(chan bool)
+	defer close(doneCh)
+
+	input, _ := acknowledgingInput(sarama.ErrMessageSizeTooLarge)
+	require.NoError(t, s.replay(input, doneCh))
+	assert.Empty(t, spoolSegments(t, dir))
+}
+
+func Test_spool_limits(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 50, MaxBytes: 50, Deadline: time.Millisecond})
+	require.NoError(t, err)
+
+	msg := &sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")}
+	assert.True(t, s.Spool(msg, spoolReasonError))
+	assert.False(t, s.Spool(msg, spoolReasonError), "the spool is full")
+	assert.Len(t, spoolSegments(t, dir), 1)
+}
+
+func Test_spool_skips_damaged_segments(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, s.Spool(&sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")}, spoolReasonError))
+	s.Close()
+
+	// A crash part way through writing a record leaves it cut short.
+	segments := spoolSegments(t, dir)
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.Write((spoolRecord{topic: "metrics", value: []byte("b value=2 2")}).encode()[:20])
+	require.NoError(t, err)
+	file.Close()
+
+	s, err = newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+
+	input, lines := acknowledgingInput(nil)
+	doneCh := make(chan bool)
+	defer close(doneCh)
+	require.NoError(t, s.replay(input, doneCh))
+
+	assert.Equal(t, []string{"a value=1 1"}, *lines)
+	assert.Empty(t, spoolSegments(t, dir))
+}
+
+func Test_spool_produce_deadline(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	// Nothing reads the input, as when the producer is stuck.
+	input := make(chan *sarama.ProducerMessage)
+	taken, spooled := s.Produce(input, nil, &sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")})
+	assert.False(t, taken)
+	assert.True(t, spooled)
+	assert.Len(t, spoolSegments(t, dir), 1)
+
+	// Without a spool, the producer is waited on.
+	input = make(chan *sarama.ProducerMessage, 1)
+	taken, spooled = (*spool)(nil).Produce(input, nil, &sarama.ProducerMessage{Topic: "metrics"})
+	assert.True(t, taken)
+	assert.False(t, spooled)
+	assert.Len(t, input, 1)
+}
+
+func Test_spool_rescue(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(&SpoolConfig{Dir: dir, SegmentBytes: 1000, MaxBytes: 10000, Deadline: time.Millisecond})
+	require.NoError(t, err)
+
+	msg := &sarama.ProducerMessage{Topic: "metrics", Value: sarama.StringEncoder("a value=1 1")}
+	assert.True(t, s.Rescue(&sarama.ProducerError{Msg: msg, Err: sarama.ErrNotLeaderForPartition}))
+	assert.False(t, s.Rescue(&sarama.ProducerError{Msg: msg, Err: sarama.ErrMessageSizeTooLarge}))
+
+	replayed := &sarama.ProducerMessage{Topic: "metrics", Metadata: &replayMetadata{newDeliveryTracker()}}
+	assert.False(t, s.Rescue(&sarama.ProducerError{Msg: replayed, Err: sarama.ErrOutOfBrokers}))
+	assert.False(t, (*spool)(nil).Rescue(&sarama.ProducerError{Msg: msg, Err: sarama.ErrOutOfBrokers}))
+}
+
+func Test_spool_config_validation(t *testing.T) {
+	_, err := loadConfig([]string{
+		"-kafka.brokers", "localhost:9092",
+		"-spool.dir", "/var/spool/telepath",
+		"-spool.segment.bytes", "1000",
+		"-spool.max.bytes", "100",
+		"-spool.deadline", "0",
+		"-spool.replay.interval", "-1s",
+	}, noEnv)
+	require.Error(t, err)
+	assert.Equal(t, "spool max bytes must be at least the segment bytes; "+
+		"spool deadline must be positive; "+
+		"spool replay interval must be positive", err.Error())
+}
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "telepath-spool")
+	require.NoError(t, err)
+	return dir
+}
+
+func spoolSegments(t *testing.T, dir string) []string {
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+spoolExtension))
+	require.NoError(t, err)
+	return segments
+}
+
+// acknowledgingInput stands in for the producer, acknowledging each
+// message it takes with the given error, and collecting their values.
+func acknowledgingInput(err error) (chan<- *sarama.ProducerMessage, *[]string) {
+	input := make(chan *sarama.ProducerMessage)
+	var lines []string
+	go func() {
+		for msg := range input {
+			value, _ := msg.Value.Encode()
+			if err != nil {
+				acknowledge(msg, &sarama.ProducerError{Msg: msg, Err: err})
+				continue
+			}
+			lines = append(lines, string(value))
+			acknowledge(msg, nil)
+		}
+	}()
+	return input, &lines
+}
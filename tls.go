@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The roles a certificate's expiry is reported under.
+const (
+	certificateRoleServer   = "server"
+	certificateRoleClientCA = "client_ca"
+)
+
+// Files in a client CA directory with these extensions are read.
+var caFileExtensions = []string{".pem", ".crt", ".cer"}
+
+// tlsStore holds the HTTPS server's certificate and client verification
+// settings. They may be replaced while serving; new connections use the
+// latest.
+type tlsStore struct {
+	sync.Mutex
+	config      atomic.Value
+	certificate atomic.Value
+	https       HTTPSConfig
+	paths       []string
+	stamps      map[string]fileStamp
+}
+
+// tlsMaterial is everything read from the HTTPS certificate files.
+type tlsMaterial struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	clientAuth  tls.ClientAuthType
+
+	// Every certificate, for reporting when they expire, and every file
+	// and directory read, for noticing when they change.
+	certificates []loadedCertificate
+	paths        []string
+}
+
+type loadedCertificate struct {
+	role        string
+	path        string
+	certificate *x509.Certificate
+}
+
+func newTLSStore(config *HTTPSConfig) (*tlsStore, error) {
+	material, err := loadTLSMaterial(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &tlsStore{}
+	ts.Set(config, material)
+	return ts, nil
+}
+
+// Set serves new TLS material, and watches the files it was read from.
+func (ts *tlsStore) Set(config *HTTPSConfig, material *tlsMaterial) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	ts.certificate.Store(material.certificate)
+	ts.config.Store(&tls.Config{
+		GetCertificate: ts.GetCertificate,
+		ClientCAs:      material.clientCAs,
+		ClientAuth:     material.clientAuth,
+	})
+	ts.https = *config
+	ts.paths = material.paths
+	ts.stamps = statFiles(material.paths)
+
+	metrics.ResetTLSCertificateExpiry()
+	for _, c := range material.certificates {
+		metrics.TLSCertificateExpiry(c.role, c.path, c.certificate.Subject.CommonName).
+			Set(float64(c.certificate.NotAfter.Unix()))
+	}
+}
+
+// GetCertificate returns the current server certificate.
+func (ts *tlsStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return ts.certificate.Load().(*tls.Certificate), nil
+}
+
+// ListenerConfig returns a config which defers to the store for each
+// connection.
+func (ts *tlsStore) ListenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return ts.config.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// Watch reloads the certificates whenever their files change, so they can
+// be rotated without restarting Telepath.
+func (ts *tlsStore) Watch(interval time.Duration, doneCh chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneCh:
+			return
+
+		case <-ticker.C:
+			if err := ts.reload(); err != nil {
+				log.WithError(err).Error("Couldn't reload the TLS certificates.")
+			}
+		}
+	}
+}
+
+// reload reads the certificates again if any of their files changed. A
+// broken file is reported once, until it changes again.
+func (ts *tlsStore) reload() error {
+	ts.Lock()
+	stamps := statFiles(ts.paths)
+	if reflect.DeepEqual(stamps, ts.stamps) {
+		ts.Unlock()
+		return nil
+	}
+	ts.stamps = stamps
+	config := ts.https
+	ts.Unlock()
+
+	material, err := loadTLSMaterial(&config)
+	if err != nil {
+		return err
+	}
+
+	ts.Set(&config, material)
+	log.WithFields(log.Fields{
+		"certificate": config.CertificatePath,
+		"expires":     material.certificate.Leaf.NotAfter,
+	}).Info("Reloaded the TLS certificates.")
+	return nil
+}
+
+// loadTLSMaterial reads the server certificate, and any client CA
+// certificates it should trust.
+func loadTLSMaterial(config *HTTPSConfig) (*tlsMaterial, error) {
+	serverCertificate, err := tls.LoadX509KeyPair(config.CertificatePath, config.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load server certificate %s: %v", config.CertificatePath, err)
+	}
+	leaf, err := x509.ParseCertificate(serverCertificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse server certificate %s: %v", config.CertificatePath, err)
+	}
+	serverCertificate.Leaf = leaf
+
+	material := &tlsMaterial{
+		certificate:  &serverCertificate,
+		certificates: []loadedCertificate{{certificateRoleServer, config.CertificatePath, leaf}},
+		paths:        []string{config.CertificatePath, config.KeyPath},
+	}
+
+	switch config.ClientVerify {
+	case "optional":
+		material.clientAuth = tls.VerifyClientCertIfGiven
+	case "required":
+		material.clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if material.clientAuth == tls.NoClientCert {
+		return material, nil
+	}
+
+	certificatePaths := append([]string{}, config.ClientCertificatePaths...)
+	if config.ClientCertificateDir != "" {
+		dirPaths, err := caFiles(config.ClientCertificateDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client certificate directory %s: %v", config.ClientCertificateDir, err)
+		}
+		certificatePaths = append(certificatePaths, dirPaths...)
+		material.paths = append(material.paths, config.ClientCertificateDir)
+	}
+
+	material.clientCAs = x509.NewCertPool()
+	for _, certificatePath := range certificatePaths {
+		certificates, err := loadCertificates(certificatePath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, certificate := range certificates {
+			log.Debugf("Adding client certificate %s: %s", certificatePath, certificate.Subject.CommonName)
+
+			material.clientCAs.AddCert(certificate)
+			material.certificates = append(material.certificates,
+				loadedCertificate{certificateRoleClientCA, certificatePath, certificate})
+		}
+		material.paths = append(material.paths, certificatePath)
+	}
+
+	return material, nil
+}
+
+// loadCertificates reads every certificate in a PEM bundle, skipping any
+// other blocks.
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate %s: %v", path, err)
+	}
+
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse client certificate %s: %v", path, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("could not parse client certificate %s: no PEM data found", path)
+	}
+	return certificates, nil
+}
+
+// caFiles lists the certificate files in a directory, in name order.
+// Hidden files, such as the ..data link in a Kubernetes secret volume,
+// are skipped.
+func caFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || entry.IsDir() {
+			continue
+		}
+		for _, extension := range caFileExtensions {
+			if strings.EqualFold(filepath.Ext(name), extension) {
+				paths = append(paths, filepath.Join(dir, name))
+				break
+			}
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tls_store(t *testing.T) {
+	store, err := newTLSStore(&HTTPSConfig{
+		CertificatePath: "etc/server.pem",
+		KeyPath:         "etc/server-key.pem",
+		ClientVerify:    "none",
+	})
+	require.NoError(t, err)
+
+	listenerConfig := store.ListenerConfig()
+	config, err := listenerConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	certificate, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.NotNil(t, certificate.Leaf)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	https := &HTTPSConfig{
+		CertificatePath:        "etc/server.pem",
+		KeyPath:                "etc/server-key.pem",
+		ClientVerify:           "required",
+		ClientCertificatePaths: []string{"etc/ca.pem"},
+	}
+	reloaded, err := loadTLSMaterial(https)
+	require.NoError(t, err)
+	store.Set(https, reloaded)
+
+	config, err = listenerConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+	assert.NotNil(t, config.ClientCAs)
+}
+
+func Test_tls_config_errors(t *testing.T) {
+	_, err := loadTLSMaterial(&HTTPSConfig{
+		CertificatePath: "etc/missing.pem",
+		KeyPath:         "etc/server-key.pem",
+	})
+	assert.Error(t, err)
+
+	_, err = loadTLSMaterial(&HTTPSConfig{
+		CertificatePath:        "etc/server.pem",
+		KeyPath:                "etc/server-key.pem",
+		ClientVerify:           "required",
+		ClientCertificatePaths: []string{"etc/telegraf.conf"},
+	})
+	assert.EqualError(t, err, "could not parse client certificate etc/telegraf.conf: no PEM data found")
+
+	_, err = loadTLSMaterial(&HTTPSConfig{
+		CertificatePath:      "etc/server.pem",
+		KeyPath:              "etc/server-key.pem",
+		ClientVerify:         "required",
+		ClientCertificateDir: "etc/missing",
+	})
+	assert.EqualError(t, err, "could not read client certificate directory etc/missing: open etc/missing: no such file or directory")
+}
+
+func Test_tls_client_ca_bundles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telepath")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first, _ := newTestCertificate(t, "first")
+	second, _ := newTestCertificate(t, "second")
+	third, key := newTestCertificate(t, "third")
+	writeFile(t, filepath.Join(dir, "bundle.pem"), string(first)+string(key)+string(second))
+	writeFile(t, filepath.Join(dir, "third.CRT"), string(third))
+	writeFile(t, filepath.Join(dir, ".hidden.pem"), "not a certificate")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "not a certificate")
+
+	material, err := loadTLSMaterial(&HTTPSConfig{
+		CertificatePath:        "etc/server.pem",
+		KeyPath:                "etc/server-key.pem",
+		ClientVerify:           "optional",
+		ClientCertificatePaths: []string{"etc/ca.pem"},
+		ClientCertificateDir:   dir,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, material.clientAuth)
+
+	var subjects []string
+	for _, c := range material.certificates[1:] {
+		assert.Equal(t, certificateRoleClientCA, c.role)
+		subjects = append(subjects, c.certificate.Subject.CommonName)
+	}
+	assert.Equal(t, []string{"*", "first", "second", "third"}, subjects)
+}
+
+func Test_tls_store_reloads_certificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telepath")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	https := &HTTPSConfig{
+		CertificatePath: filepath.Join(dir, "tls.crt"),
+		KeyPath:         filepath.Join(dir, "tls.key"),
+		ClientVerify:    "none",
+	}
+	certificate, key := newTestCertificate(t, "before")
+	writeFile(t, https.CertificatePath, string(certificate))
+	writeFile(t, https.KeyPath, string(key))
+
+	store, err := newTLSStore(https)
+	require.NoError(t, err)
+	assert.Equal(t, "before", servedCertificate(t, store).Subject.CommonName)
+	require.NoError(t, store.reload())
+	assert.Equal(t, "before", servedCertificate(t, store).Subject.CommonName)
+
+	// A half-written rotation is reported, and the old certificate kept.
+	certificate, key = newTestCertificate(t, "after")
+	writeFile(t, https.CertificatePath, string(certificate))
+	assert.Error(t, store.reload())
+	assert.Equal(t, "before", servedCertificate(t, store).Subject.CommonName)
+
+	writeFile(t, https.KeyPath, string(key))
+	require.NoError(t, store.reload())
+	leaf := servedCertificate(t, store)
+	assert.Equal(t, "after", leaf.Subject.CommonName)
+
+	var metric dto.Metric
+	require.NoError(t, metrics.TLSCertificateExpiry(certificateRoleServer, https.CertificatePath, "after").Write(&metric))
+	assert.Equal(t, float64(leaf.NotAfter.Unix()), metric.GetGauge().GetValue())
+}
+
+func servedCertificate(t *testing.T, store *tlsStore) *x509.Certificate {
+	config, err := store.ListenerConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	certificate, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	return certificate.Leaf
+}
+
+// newTestCertificate returns a PEM encoded, self-signed certificate, and
+// its key.
+func newTestCertificate(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
+	"text/template/parse"
 )
 
 var ErrTopicNameChars = errors.New("Topic name has abnormal characters.")
@@ -14,15 +16,69 @@ var ErrTopicNameInvalid = errors.New("Topic name is invalid.")
 
 const maxTopicLen = 249
 const DefaultTopicTemplate = "telepath-influx-metrics"
+const DefaultTopicCacheSize = 10000
 
 var topicCharMatcher = regexp.MustCompile(`[a-zA-Z0-9\._\-]`)
 
+// The pointParams methods which depend on the point, rather than the
+// request.
+var pointMethods = map[string]bool{
+	"Measurement": true,
+	"Tag":         true,
+	"Tags":        true,
+	"SeriesKey":   true,
+}
+
 type topicTemplate struct {
-	tmpl *template.Template
+	tmpl       *template.Template
+	pointAware bool
+
+	sync.RWMutex
+	cache     map[string]cachedTopic
+	cacheSize int
+}
+
+type cachedTopic struct {
+	topic string
+	err   error
 }
 
-type topicParams struct {
+// pointParams expose a single point, and the request it arrived in, to
+// templates.
+type pointParams struct {
 	Database string
+	Org      string
+	Bucket   string
+
+	// User is who authenticated the request: a user, an API token's name
+	// or a JWT's subject.
+	User string
+
+	point *Point
+}
+
+func (pp pointParams) Measurement() string {
+	return pp.point.Measurement
+}
+
+// Tag returns the value of a single tag, or an empty string.
+func (pp pointParams) Tag(key string) string {
+	return pp.point.Tag(key)
+}
+
+// Tags returns the values of several tags, joined with commas.
+func (pp pointParams) Tags(keys ...string) string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = pp.point.Tag(key)
+	}
+	return strings.Join(values, ",")
+}
+
+// SeriesKey returns the measurement and its sorted tag set, which
+// identifies the series the point belongs to.
+func (pp pointParams) SeriesKey() string {
+	return pp.point.SeriesKey()
 }
 
 func NewTopicTemplate(text string) (*topicTemplate, error) {
@@ -45,13 +101,50 @@ func NewTopicTemplate(text string) (*topicTemplate, error) {
 		return nil, err
 	}
 
-	return &topicTemplate{tmpl}, nil
+	return &topicTemplate{
+		tmpl:       tmpl,
+		pointAware: usesPoint(tmpl.Tree.Root),
+		cache:      make(map[string]cachedTopic),
+		cacheSize:  DefaultTopicCacheSize,
+	}, nil
 }
 
-func (tf *topicTemplate) Execute(db string) (string, error) {
-	var w bytes.Buffer
-	params := topicParams{db}
+// PointAware reports whether the template refers to the point, rather
+// than just the request, and so must be executed for every point.
+func (tf *topicTemplate) PointAware() bool {
+	return tf.pointAware
+}
 
+// Execute returns the topic for the params. Results, including invalid
+// topic names, are cached for each distinct input.
+func (tf *topicTemplate) Execute(params pointParams) (string, error) {
+	key := params.Database + "\x00" + params.Org + "\x00" + params.Bucket +
+		"\x00" + params.User
+	if tf.pointAware {
+		key = key + "\x00" + string(params.point.key)
+	}
+
+	tf.RLock()
+	cached, ok := tf.cache[key]
+	tf.RUnlock()
+	if ok {
+		return cached.topic, cached.err
+	}
+
+	topic, err := tf.execute(params)
+
+	tf.Lock()
+	if len(tf.cache) >= tf.cacheSize {
+		tf.cache = make(map[string]cachedTopic)
+	}
+	tf.cache[key] = cachedTopic{topic, err}
+	tf.Unlock()
+
+	return topic, err
+}
+
+func (tf *topicTemplate) execute(params pointParams) (string, error) {
+	var w bytes.Buffer
 	if err := tf.tmpl.Execute(&w, params); err != nil {
 		return "", err
 	}
@@ -64,6 +157,55 @@ func (tf *topicTemplate) Execute(db string) (string, error) {
 	return topic, nil
 }
 
+// usesPoint walks a template's parse tree, looking for references to the
+// point's measurement or tags.
+func usesPoint(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesPoint(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesPoint(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesPoint(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesPoint(arg) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && pointMethods[n.Ident[0]]
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && pointMethods[n.Ident[1]]
+	case *parse.TemplateNode:
+		// We won't follow calls to other templates, so assume the worst.
+		return true
+	case *parse.ChainNode:
+		return usesPoint(n.Node)
+	case *parse.IfNode:
+		return usesPoint(n.Pipe) || usesPoint(n.List) || usesPoint(n.ElseList)
+	case *parse.RangeNode:
+		return usesPoint(n.Pipe) || usesPoint(n.List) || usesPoint(n.ElseList)
+	case *parse.WithNode:
+		return usesPoint(n.Pipe) || usesPoint(n.List) || usesPoint(n.ElseList)
+	}
+	return false
+}
+
 // https://github.com/apache/kafka/blob/trunk/core/src/main/scala/kafka/common/Topic.scala#L24
 func validateTopicName(topic string) error {
 	if len(topic) > maxTopicLen {
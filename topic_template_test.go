@@ -3,14 +3,19 @@ package main
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_topic_template(t *testing.T) {
 	cases := []struct {
 		label    string
 		db       string
+		bucket   string
+		org      string
+		line     string
 		template string
 		expect   string
 		err      error
@@ -29,6 +34,13 @@ func Test_topic_template(t *testing.T) {
 			db:       "foo",
 			template: "{{.Database}}-topic",
 			expect:   "foo-topic",
+		}, {
+			label:    "Templated org and bucket",
+			db:       "foo",
+			org:      "acme",
+			bucket:   "foo",
+			template: "{{.Org}}-{{.Bucket}}-topic",
+			expect:   "acme-foo-topic",
 		}, {
 			label:    "Template toLower",
 			db:       "Foo",
@@ -59,6 +71,30 @@ func Test_topic_template(t *testing.T) {
 			db:       "foo",
 			template: "..",
 			err:      ErrTopicNameInvalid,
+		}, {
+			label:    "Templated measurement",
+			db:       "foo",
+			line:     "cpu,host=Hoth value=1 1",
+			template: "{{.Database}}-{{.Measurement}}",
+			expect:   "foo-cpu",
+		}, {
+			label:    "Templated tag",
+			db:       "foo",
+			line:     "cpu,host=Hoth,env=prod value=1 1",
+			template: "{{.Database}}-{{.Tag \"env\"|toLower}}",
+			expect:   "foo-prod",
+		}, {
+			label:    "Missing tag",
+			db:       "foo",
+			line:     "cpu,host=Hoth value=1 1",
+			template: "{{.Database}}-{{.Tag \"env\"}}",
+			expect:   "foo-",
+		}, {
+			label:    "Bad chars in tag",
+			db:       "foo",
+			line:     "cpu,env=a/b value=1 1",
+			template: "{{.Database}}-{{.Tag \"env\"}}",
+			err:      ErrTopicNameChars,
 		},
 	}
 
@@ -66,13 +102,65 @@ func Test_topic_template(t *testing.T) {
 		tf, err := NewTopicTemplate(c.template)
 		assert.NoError(t, err)
 
-		topic, err := tf.Execute(c.db)
+		params := pointParams{Database: c.db, Org: c.org, Bucket: c.bucket}
+		if c.line != "" {
+			params.point, err = ParsePoint([]byte(c.line), "ns", time.Now())
+			require.NoError(t, err)
+		}
+
+		topic, err := tf.Execute(params)
 		if c.err == nil {
-			assert.NoError(t, err)
-			assert.Equal(t, c.expect, topic)
+			assert.NoError(t, err, c.label)
+			assert.Equal(t, c.expect, topic, c.label)
 		} else {
-			assert.Empty(t, topic)
-			assert.Error(t, err)
+			assert.Empty(t, topic, c.label)
+			assert.Equal(t, c.err, err, c.label)
 		}
 	}
 }
+
+func Test_topic_template_point_aware(t *testing.T) {
+	cases := []struct {
+		template string
+		expect   bool
+	}{
+		{"", false},
+		{"{{.Database}}-{{.Org}}-{{.Bucket}}", false},
+		{"{{.Database|toLower}}", false},
+		{"{{.Measurement}}", true},
+		{"{{.Tag \"env\"}}", true},
+		{"{{.Tags \"env\" \"region\"}}", true},
+		{"{{.Database}}-{{.Measurement|toLower}}", true},
+		{"{{if eq .Database \"foo\"}}{{.Measurement}}{{else}}x{{end}}", true},
+		{"{{with $p := .}}{{$p.Measurement}}{{end}}", true},
+	}
+
+	for _, c := range cases {
+		tf, err := NewTopicTemplate(c.template)
+		require.NoError(t, err)
+		assert.Equal(t, c.expect, tf.PointAware(), c.template)
+	}
+}
+
+func Test_topic_template_cache(t *testing.T) {
+	tf, err := NewTopicTemplate("{{.Database}}-{{.Measurement}}")
+	require.NoError(t, err)
+	tf.cacheSize = 2
+
+	for _, line := range []string{"cpu value=1 1", "cpu value=2 2", "mem value=1 1"} {
+		point, err := ParsePoint([]byte(line), "ns", time.Now())
+		require.NoError(t, err)
+
+		topic, err := tf.Execute(pointParams{Database: "foo", point: point})
+		require.NoError(t, err)
+		assert.Equal(t, "foo-"+point.Measurement, topic)
+	}
+	assert.Len(t, tf.cache, 2)
+
+	// Filling the cache starts it afresh.
+	point, err := ParsePoint([]byte("disk value=1 1"), "ns", time.Now())
+	require.NoError(t, err)
+	_, err = tf.Execute(pointParams{Database: "foo", point: point})
+	require.NoError(t, err)
+	assert.Len(t, tf.cache, 1)
+}